@@ -32,7 +32,7 @@ func newPeer(addr wire.Addr, serverhost, secret string, OnMessage func(message *
 	io.WriteString(h, nonce)
 	io.WriteString(h, secret)
 
-	query := fmt.Sprintf("addr=%v&nonce=%v&digest=%v&notice=1", addr.String(), nonce, hex.EncodeToString(h.Sum(nil)))
+	query := fmt.Sprintf("addr=%v&nonce=%v&digest=%v&notice=1&ver=%v", addr.String(), nonce, hex.EncodeToString(h.Sum(nil)), wire.ProtocolVersionMax)
 
 	u := url.URL{Scheme: "ws", Host: serverhost, Path: "/client", RawQuery: query}
 	log.Printf("connecting to %s", u.String())
@@ -0,0 +1,303 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-xorm/xorm"
+)
+
+// Conversation 会话，Owner 的单聊或群会话。
+// The timeline of a group is the row whose Owner is empty, it has the count and the last message of the group,
+// while the row of a member only has the read count of the member.
+type Conversation struct {
+	ID             uint64 `xorm:"pk autoincr 'id'"`
+	OwnerDomain    uint32 `xorm:"unique(idx_conversation) index(idx_conversation_owner)"`
+	Owner          string `xorm:"unique(idx_conversation) index(idx_conversation_owner)"`
+	IsGroup        bool   `xorm:"unique(idx_conversation)"`
+	PeerDomain     uint32 `xorm:"unique(idx_conversation)"`
+	Peer           string `xorm:"unique(idx_conversation)"`
+	MsgCount       uint64 // messages in the conversation
+	ReadCount      uint64 // messages read by owner
+	ReadMsgID      uint64 `xorm:"'read_msg_id'"`
+	LastMsgID      uint64 `xorm:"'last_msg_id'"`
+	LastFromDomain uint32 // sender of the last message
+	LastFrom       string
+	LastType       uint8
+	LastText       string `xorm:"mediumtext"`
+	LastExtra      string
+	LastAt         time.Time `xorm:"index(idx_conversation_owner)"`
+}
+
+// Unread count of unread messages
+func (c *Conversation) Unread() uint64 {
+	if c.MsgCount > c.ReadCount {
+		return c.MsgCount - c.ReadCount
+	}
+	return 0
+}
+
+// ConversationMsg a message counted in the conversations of Owner, the timeline of a group has empty Owner.
+// A message is counted once, the rows older than conversationMsgKeep are purged.
+type ConversationMsg struct {
+	ID          uint64    `xorm:"pk autoincr 'id'"`
+	MsgID       uint64    `xorm:"unique(idx_conversation_msg) 'msg_id'"`
+	OwnerDomain uint32    `xorm:"unique(idx_conversation_msg)"`
+	Owner       string    `xorm:"unique(idx_conversation_msg)"`
+	CreateAt    time.Time `xorm:"index"`
+}
+
+const (
+	// conversationMsgKeep a message saved again after this is counted again
+	conversationMsgKeep = 7 * 24 * time.Hour
+	// conversationMsgPurge counted messages are purged every this many messages
+	conversationMsgPurge = 10000
+)
+
+// ConversationIndex conversations and unread counts of clients, it is kept in the message store.
+// Updates are idempotent by message id: a message saved twice is counted once,
+// and the last message of a conversation is only replaced by a newer one.
+type ConversationIndex struct {
+	engine  *xorm.Engine
+	counted uint64 // messages counted, accessed atomically
+}
+
+// NewConversationIndex new a ConversationIndex in the database of store
+func NewConversationIndex(store *DbMessageStore) (*ConversationIndex, error) {
+	if store.engine == nil {
+		return nil, fmt.Errorf("conversation index needs a database")
+	}
+	if err := store.engine.Sync2(new(Conversation), new(ConversationMsg)); err != nil {
+		return nil, err
+	}
+	return &ConversationIndex{engine: store.engine}, nil
+}
+
+// AddChatMsg the message is unread by the receiver and read by the sender
+func (c *ConversationIndex) AddChatMsg(msg *ChatMsg) error {
+	last := &lastMsg{msg.MsgID, msg.FromDomain, msg.From, msg.Type, msg.Text, msg.Extra, msg.CreateAt}
+	err := c.touch(&Conversation{OwnerDomain: msg.FromDomain, Owner: msg.From, PeerDomain: msg.ToDomain, Peer: msg.To}, last, true)
+	if err != nil {
+		return err
+	}
+	return c.touch(&Conversation{OwnerDomain: msg.ToDomain, Owner: msg.To, PeerDomain: msg.FromDomain, Peer: msg.From}, last, false)
+}
+
+// AddGroupMsg the message is added to the timeline of the group and read by the sender
+func (c *ConversationIndex) AddGroupMsg(msg *GroupMsg) error {
+	last := &lastMsg{msg.MsgID, msg.FromDomain, msg.From, msg.Type, msg.Text, msg.Extra, msg.CreateAt}
+	err := c.touch(&Conversation{IsGroup: true, PeerDomain: msg.ToDomain, Peer: msg.To}, last, false)
+	if err != nil {
+		return err
+	}
+	return c.MarkRead(msg.FromDomain, msg.From, true, msg.ToDomain, msg.To)
+}
+
+// JoinGroup messages before joining are read
+func (c *ConversationIndex) JoinGroup(domain uint32, client string, groupDomain uint32, group string) error {
+	return c.MarkRead(domain, client, true, groupDomain, group)
+}
+
+// LeaveGroup remove the conversation of a group member
+func (c *ConversationIndex) LeaveGroup(domain uint32, client string, groupDomain uint32, group string) error {
+	where, args := conversationKey(domain, client, true, groupDomain, group)
+	_, err := c.engine.Where(where, args...).Delete(new(Conversation))
+	return err
+}
+
+// MarkRead all messages in the conversation are read by owner
+func (c *ConversationIndex) MarkRead(domain uint32, owner string, isGroup bool, peerDomain uint32, peer string) error {
+	table := c.engine.TableName(new(Conversation))
+	if !isGroup {
+		where, args := conversationKey(domain, owner, false, peerDomain, peer)
+		_, err := c.engine.Exec(append([]interface{}{
+			fmt.Sprintf("UPDATE %v SET read_count = msg_count, read_msg_id = last_msg_id WHERE %v", table, where)}, args...)...)
+		return err
+	}
+	timeline := new(Conversation)
+	where, args := conversationKey(0, "", true, peerDomain, peer)
+	if _, err := c.engine.Where(where, args...).Get(timeline); err != nil {
+		return err
+	}
+	// read count never goes back, the timeline may be read before a concurrent update
+	where, args = conversationKey(domain, owner, true, peerDomain, peer)
+	res, err := c.engine.Exec(append([]interface{}{fmt.Sprintf("UPDATE %v SET read_count = ?, read_msg_id = ? WHERE %v AND read_count < ?", table, where),
+		timeline.MsgCount, timeline.LastMsgID}, append(args, timeline.MsgCount)...)...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	if has, err := c.exist(domain, owner, true, peerDomain, peer); err != nil || has {
+		return err
+	}
+	member := &Conversation{OwnerDomain: domain, Owner: owner, IsGroup: true, PeerDomain: peerDomain, Peer: peer,
+		ReadCount: timeline.MsgCount, ReadMsgID: timeline.LastMsgID}
+	if _, err = c.engine.Insert(member); err != nil {
+		// inserted by another server at the same time
+		if has, _ := c.exist(domain, owner, true, peerDomain, peer); has {
+			return nil
+		}
+	}
+	return err
+}
+
+// Conversations conversations of a client which have messages, from the latest to the oldest.
+// A group conversation has the count and the last message of the group.
+func (c *ConversationIndex) Conversations(domain uint32, owner string, before time.Time, limit int) ([]*Conversation, error) {
+	convs := make([]*Conversation, 0, limit)
+	session := c.engine.Where("owner_domain = ? AND owner = ? AND is_group = ? AND msg_count > 0", domain, owner, false)
+	if !before.IsZero() {
+		session = session.And("last_at < ?", formatTime(c.engine, before))
+	}
+	if err := session.Desc("last_at").Limit(limit).Find(&convs); err != nil {
+		return nil, err
+	}
+
+	members := make([]*Conversation, 0)
+	if err := c.engine.Where("owner_domain = ? AND owner = ? AND is_group = ?", domain, owner, true).Find(&members); err != nil {
+		return nil, err
+	}
+	if len(members) > 0 {
+		conds := make([]string, 0, len(members))
+		args := []interface{}{0, "", true}
+		for _, member := range members {
+			conds = append(conds, "(peer_domain = ? AND peer = ?)")
+			args = append(args, member.PeerDomain, member.Peer)
+		}
+		timelines := make([]*Conversation, 0, len(members))
+		err := c.engine.Where(fmt.Sprintf("owner_domain = ? AND owner = ? AND is_group = ? AND (%v)", strings.Join(conds, " OR ")), args...).
+			Find(&timelines)
+		if err != nil {
+			return nil, err
+		}
+		for _, member := range members {
+			for _, timeline := range timelines {
+				if timeline.PeerDomain != member.PeerDomain || timeline.Peer != member.Peer || timeline.MsgCount == 0 {
+					continue
+				}
+				if !before.IsZero() && !timeline.LastAt.Before(before) {
+					continue
+				}
+				group := *timeline
+				group.ID, group.OwnerDomain, group.Owner = member.ID, member.OwnerDomain, member.Owner
+				group.ReadCount, group.ReadMsgID = member.ReadCount, member.ReadMsgID
+				convs = append(convs, &group)
+			}
+		}
+	}
+
+	sort.SliceStable(convs, func(i, j int) bool { return convs[i].LastAt.After(convs[j].LastAt) })
+	if len(convs) > limit {
+		convs = convs[:limit]
+	}
+	return convs, nil
+}
+
+type lastMsg struct {
+	msgID      uint64
+	fromDomain uint32
+	from       string
+	typ        uint8
+	text       string
+	extra      string
+	createAt   time.Time
+}
+
+// touch count a message in the conversation once, and make it the last message if it is newer than the last one.
+// The row is created if it doesn't exist.
+func (c *ConversationIndex) touch(conv *Conversation, last *lastMsg, read bool) error {
+	table := c.engine.TableName(new(Conversation))
+	where, key := conversationKey(conv.OwnerDomain, conv.Owner, conv.IsGroup, conv.PeerDomain, conv.Peer)
+	// mysql assigns from left to right with updated values, so read_count is assigned before msg_count
+	set := "msg_count = msg_count + 1"
+	if read {
+		set = "read_count = msg_count + 1, " + set
+	}
+	counts := append([]interface{}{fmt.Sprintf("UPDATE %v SET %v WHERE %v", table, set, where)}, key...)
+	lasts := []interface{}{""}
+	set = "last_msg_id = ?, last_from_domain = ?, last_from = ?, last_type = ?, last_text = ?, last_extra = ?, last_at = ?"
+	if read {
+		set = "read_msg_id = ?, " + set
+		lasts = append(lasts, last.msgID)
+	}
+	lasts[0] = fmt.Sprintf("UPDATE %v SET %v WHERE %v AND last_msg_id < ?", table, set, where)
+	lasts = append(lasts, last.msgID, last.fromDomain, last.from, last.typ, last.text, last.extra, formatTime(c.engine, last.createAt))
+	lasts = append(append(lasts, key...), last.msgID)
+
+	session := c.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	counted, err := c.count(session, conv, last)
+	if err != nil || !counted {
+		session.Rollback()
+		return err
+	}
+	for retry := 0; ; retry++ {
+		res, err := session.Exec(counts...)
+		if err != nil {
+			session.Rollback()
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			if _, err = session.Exec(lasts...); err != nil {
+				session.Rollback()
+				return err
+			}
+			break
+		}
+		row := &Conversation{OwnerDomain: conv.OwnerDomain, Owner: conv.Owner, IsGroup: conv.IsGroup, PeerDomain: conv.PeerDomain, Peer: conv.Peer,
+			MsgCount: 1, LastMsgID: last.msgID, LastFromDomain: last.fromDomain, LastFrom: last.from,
+			LastType: last.typ, LastText: last.text, LastExtra: last.extra, LastAt: last.createAt}
+		if read {
+			row.ReadCount, row.ReadMsgID = 1, last.msgID
+		}
+		if _, err = session.Insert(row); err == nil {
+			break
+		}
+		// inserted by another server at the same time, update it again
+		if retry > 0 {
+			session.Rollback()
+			return err
+		}
+	}
+	if err := session.Commit(); err != nil {
+		return err
+	}
+	if atomic.AddUint64(&c.counted, 1)%conversationMsgPurge == 0 {
+		before := formatTime(c.engine, time.Now().Add(-conversationMsgKeep))
+		_, err = c.engine.Where("create_at < ?", before).Delete(new(ConversationMsg))
+	}
+	return err
+}
+
+// count record the message is counted in the conversations of the owner, false if it is counted already
+func (c *ConversationIndex) count(session *xorm.Session, conv *Conversation, last *lastMsg) (bool, error) {
+	msg := &ConversationMsg{MsgID: last.msgID, OwnerDomain: conv.OwnerDomain, Owner: conv.Owner, CreateAt: last.createAt}
+	if _, err := session.Insert(msg); err != nil {
+		has, e := session.Where("msg_id = ? AND owner_domain = ? AND owner = ?", msg.MsgID, msg.OwnerDomain, msg.Owner).
+			Exist(new(ConversationMsg))
+		if e != nil || !has {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+func (c *ConversationIndex) exist(domain uint32, owner string, isGroup bool, peerDomain uint32, peer string) (bool, error) {
+	where, args := conversationKey(domain, owner, isGroup, peerDomain, peer)
+	return c.engine.Where(where, args...).Exist(new(Conversation))
+}
+
+// conversationKey condition of the unique key, zero values are matched too
+func conversationKey(domain uint32, owner string, isGroup bool, peerDomain uint32, peer string) (string, []interface{}) {
+	return "owner_domain = ? AND owner = ? AND is_group = ? AND peer_domain = ? AND peer = ?",
+		[]interface{}{domain, owner, isGroup, peerDomain, peer}
+}
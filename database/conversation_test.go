@@ -0,0 +1,100 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConversationIndex(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+	index, err := NewConversationIndex(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	chat := func(id uint64, from, to string) *ChatMsg {
+		return &ChatMsg{MsgID: id, FromDomain: 1, From: from, ToDomain: 1, To: to, Text: "hi", CreateAt: base.Add(time.Duration(id) * time.Minute)}
+	}
+	group := func(id uint64, from string) *GroupMsg {
+		return &GroupMsg{MsgID: id, FromDomain: 1, From: from, ToDomain: 1, To: "room", Text: "hey", CreateAt: base.Add(time.Duration(id) * time.Minute)}
+	}
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(index.JoinGroup(1, "bob", 1, "room"))
+	must(index.AddChatMsg(chat(1, "alice", "bob")))
+	must(index.AddChatMsg(chat(2, "alice", "bob")))
+	must(index.AddChatMsg(chat(2, "alice", "bob"))) // saved twice
+	must(index.AddGroupMsg(group(3, "carol")))
+	must(index.AddChatMsg(chat(4, "carol", "bob")))
+	must(index.AddGroupMsg(group(5, "carol")))
+	must(index.AddGroupMsg(group(5, "carol"))) // saved twice
+	// arrive out of order
+	must(index.AddChatMsg(chat(7, "erin", "bob")))
+	must(index.AddChatMsg(chat(6, "erin", "bob")))
+
+	unread := func(owner string) map[string]uint64 {
+		t.Helper()
+		convs, err := index.Conversations(1, owner, time.Time{}, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]uint64)
+		for i, conv := range convs {
+			if i > 0 && conv.LastAt.After(convs[i-1].LastAt) {
+				t.Errorf("conversations of %v are not ordered by time", owner)
+			}
+			got[conv.Peer] = conv.Unread()
+		}
+		return got
+	}
+	equal := func(got, want map[string]uint64) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("conversations = %v, want %v", got, want)
+			return
+		}
+		for peer, n := range want {
+			if got[peer] != n {
+				t.Errorf("conversations = %v, want %v", got, want)
+				return
+			}
+		}
+	}
+	equal(unread("bob"), map[string]uint64{"alice": 2, "room": 2, "carol": 1, "erin": 2})
+	equal(unread("erin"), map[string]uint64{"bob": 0})
+	// sent messages are read, carol joined the group by sending to it
+	equal(unread("alice"), map[string]uint64{"bob": 0})
+	equal(unread("carol"), map[string]uint64{"bob": 0, "room": 0})
+
+	// dave joins after the messages
+	must(index.JoinGroup(1, "dave", 1, "room"))
+	equal(unread("dave"), map[string]uint64{"room": 0})
+
+	must(index.MarkRead(1, "bob", false, 1, "alice"))
+	must(index.MarkRead(1, "bob", true, 1, "room"))
+	equal(unread("bob"), map[string]uint64{"alice": 0, "room": 0, "carol": 1, "erin": 2})
+
+	convs, err := index.Conversations(1, "bob", time.Time{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 || convs[0].Peer != "erin" || convs[0].LastMsgID != 7 || convs[0].MsgCount != 2 {
+		t.Errorf("Conversations() latest = %+v, want the last message 7 of erin", convs)
+	}
+	convs, err = index.Conversations(1, "bob", base.Add(5*time.Minute), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 || convs[0].Peer != "carol" || convs[0].LastMsgID != 4 {
+		t.Errorf("Conversations() before the group message = %+v", convs)
+	}
+
+	must(index.LeaveGroup(1, "bob", 1, "room"))
+	equal(unread("bob"), map[string]uint64{"alice": 0, "carol": 1, "erin": 2})
+}
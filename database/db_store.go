@@ -2,12 +2,15 @@ package database
 
 import (
 	"fmt"
-	"log"
+	"time"
 
 	// just init
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/go-xorm/xorm"
+	_ "github.com/mattn/go-sqlite3"
 	"xorm.io/core"
+
+	"github.com/ws-cluster/logger"
 )
 
 var (
@@ -20,53 +23,314 @@ type DbMessageStore struct {
 	engine *xorm.Engine
 }
 
+var dbLog = logger.New("database")
+
 // NewDbMessageStore new a DbMessageStore
 func NewDbMessageStore(engine *xorm.Engine) *DbMessageStore {
 	if engine == nil {
 		return &DbMessageStore{}
 	}
-	err := engine.Sync2(new(ChatMsg), new(GroupMsg))
+	err := engine.Sync2(new(ChatMsg), new(GroupMsg), new(GroupAudit))
 	if err != nil {
-		log.Println(err)
+		dbLog.Error("sync tables failed", logger.Err(err))
+	}
+	for _, table := range []interface{}{new(ChatMsg), new(GroupMsg)} {
+		if err := uniqueMsgID(engine, engine.TableName(table)); err != nil {
+			dbLog.Warn("unique index of msg id isn't created, messages saved at the same time may be duplicated",
+				logger.F("table", engine.TableName(table)), logger.Err(err))
+		}
 	}
 	return &DbMessageStore{
 		engine: engine,
 	}
 }
 
-// SaveChatMsg save message to mysql
+// uniqueMsgID a message is saved once by its msg id, rows without msg id aren't unique.
+// mysql has no partial index, the unique key is a generated column which is null for no msg id.
+// It fails if there are duplicated rows saved before.
+func uniqueMsgID(engine *xorm.Engine, table string) error {
+	if engine.DriverName() != DriverMysql {
+		_, err := engine.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS UQE_%[1]v_msg_id ON %[1]v (msg_id) WHERE msg_id <> 0", table))
+		return err
+	}
+	n, err := engine.Table("information_schema.COLUMNS").
+		Where("TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, "msg_key").Count()
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = engine.Exec(fmt.Sprintf("ALTER TABLE %[1]v ADD COLUMN msg_key BIGINT UNSIGNED AS (NULLIF(msg_id, 0)) STORED, "+
+		"ADD UNIQUE INDEX UQE_%[1]v_msg_key (msg_key)", table))
+	return err
+}
+
+// Ping check the database is reachable
+func (s *DbMessageStore) Ping() error {
+	if s.engine == nil {
+		return nil
+	}
+	return s.engine.Ping()
+}
+
+// SaveChatMsg save message to mysql, a message saved already by its msg id is skipped,
+// as each server a message crossed saves it, and the message log may be replayed
 func (s *DbMessageStore) SaveChatMsg(msgs []*ChatMsg) error {
 	if s.engine == nil {
 		return nil
 	}
-	_, err := s.engine.Insert(msgs)
+	ids := make([]uint64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.MsgID
+	}
+	saved, err := s.savedMsgIDs(new(ChatMsg), ids)
 	if err != nil {
 		return err
 	}
-	return nil
+	batch := make([]*ChatMsg, 0, len(msgs))
+	rows := make([]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		if !saved.skip(msg.MsgID) {
+			batch = append(batch, msg)
+			rows = append(rows, msg)
+		}
+	}
+	return s.insertMsgs(new(ChatMsg), batch, rows)
 }
 
-// SaveGroupMsg SaveGroupMsg
+// SaveGroupMsg SaveGroupMsg, a message saved already by its msg id is skipped like SaveChatMsg
 func (s *DbMessageStore) SaveGroupMsg(msgs []*GroupMsg) error {
 	if s.engine == nil {
 		return nil
 	}
-	_, err := s.engine.Insert(msgs)
+	ids := make([]uint64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.MsgID
+	}
+	saved, err := s.savedMsgIDs(new(GroupMsg), ids)
 	if err != nil {
 		return err
 	}
+	batch := make([]*GroupMsg, 0, len(msgs))
+	rows := make([]interface{}, 0, len(msgs))
+	for _, msg := range msgs {
+		if !saved.skip(msg.MsgID) {
+			batch = append(batch, msg)
+			rows = append(rows, msg)
+		}
+	}
+	return s.insertMsgs(new(GroupMsg), batch, rows)
+}
+
+// msgIDSet msg ids saved, or added to the batch
+type msgIDSet map[uint64]bool
+
+// skip the message is saved, or it is in the batch already. A message without msg id is never skipped
+func (set msgIDSet) skip(msgID uint64) bool {
+	if msgID == 0 {
+		return false
+	}
+	if set[msgID] {
+		return true
+	}
+	set[msgID] = true
+	return false
+}
+
+// savedMsgIDs msg ids of a batch which are in the table
+func (s *DbMessageStore) savedMsgIDs(table interface{}, ids []uint64) (msgIDSet, error) {
+	set := make(msgIDSet)
+	query := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if id != 0 {
+			query = append(query, id)
+		}
+	}
+	if len(query) == 0 {
+		return set, nil
+	}
+	saved := make([]uint64, 0)
+	if err := s.engine.Table(table).In("msg_id", query...).Cols("msg_id").Find(&saved); err != nil {
+		return nil, err
+	}
+	for _, id := range saved {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// insertMsgs insert the batch, a slice of rows. If a message is saved by another server at the same time,
+// the unique index fails the batch, then rows are inserted one by one and the saved ones are skipped
+func (s *DbMessageStore) insertMsgs(table interface{}, batch interface{}, rows []interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	_, err := s.engine.Insert(batch)
+	if err == nil {
+		return nil
+	}
+	for _, row := range rows {
+		if _, err := s.engine.Insert(row); err != nil {
+			var msgID uint64
+			switch msg := row.(type) {
+			case *ChatMsg:
+				msgID = msg.MsgID
+			case *GroupMsg:
+				msgID = msg.MsgID
+			}
+			has, e := s.engine.Table(table).Where("msg_id = ?", msgID).Exist()
+			if msgID == 0 || e != nil || !has {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// InitMysqlDb init mysql database
-func InitMysqlDb(source string) *xorm.Engine {
-	url := fmt.Sprintf("%s?charset=utf8&parseTime=True&loc=Local", source)
-	// url := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8&parseTime=True&loc=Local", user, pwd, ip, port, dbname)
-	engine, err := xorm.NewEngine("mysql", url)
-	if err != nil {
-		log.Println(err)
+// SaveGroupAudit SaveGroupAudit
+func (s *DbMessageStore) SaveGroupAudit(audits []*GroupAudit) error {
+	if s.engine == nil {
 		return nil
 	}
+	_, err := s.engine.Insert(audits)
+	return err
+}
+
+// ModifyChatMsg recall or edit chat messages, a message is only modified by its sender
+func (s *DbMessageStore) ModifyChatMsg(mods []*MsgModify) error {
+	for _, mod := range mods {
+		if err := s.modify(new(ChatMsg), mod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ModifyGroupMsg recall or edit group messages, a message is only modified by its sender
+func (s *DbMessageStore) ModifyGroupMsg(mods []*MsgModify) error {
+	for _, mod := range mods {
+		if err := s.modify(new(GroupMsg), mod); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *DbMessageStore) modify(table interface{}, mod *MsgModify) error {
+	if s.engine == nil {
+		return nil
+	}
+	session := s.engine.Table(table).
+		Where("msg_id = ? AND from_domain = ? AND `from` = ?", mod.MsgID, mod.FromDomain, mod.From)
+	var err error
+	if mod.Recall {
+		_, err = session.Cols("recalled", "text", "extra").
+			Update(map[string]interface{}{"recalled": true, "text": "", "extra": ""})
+	} else { // a recalled message isn't edited, even if the edit is replayed
+		_, err = session.And("recalled = ?", false).Cols("text", "extra", "edit_at").
+			Update(map[string]interface{}{"text": mod.Text, "extra": mod.Extra, "edit_at": mod.ModifyAt})
+	}
+	return err
+}
+
+// QueryChatMsg messages between two clients in both directions
+func (s *DbMessageStore) QueryChatMsg(domain uint32, addr string, peerDomain uint32, peer string, q *HistoryQuery) ([]*ChatMsg, error) {
+	msgs := make([]*ChatMsg, 0)
+	if s.engine == nil {
+		return msgs, nil
+	}
+	session := s.engine.Where("(from_domain = ? AND `from` = ? AND to_domain = ? AND `to` = ?) OR (from_domain = ? AND `from` = ? AND to_domain = ? AND `to` = ?)",
+		domain, addr, peerDomain, peer, peerDomain, peer, domain, addr)
+	err := historySession(s.engine, session, q).Find(&msgs)
+	return msgs, err
+}
+
+// QueryGroupMsg timeline of a group
+func (s *DbMessageStore) QueryGroupMsg(domain uint32, group string, q *HistoryQuery) ([]*GroupMsg, error) {
+	msgs := make([]*GroupMsg, 0)
+	if s.engine == nil {
+		return msgs, nil
+	}
+	session := s.engine.Where("to_domain = ? AND `to` = ?", domain, group)
+	err := historySession(s.engine, session, q).Find(&msgs)
+	return msgs, err
+}
+
+// GetChatMsg the chat message with the msg id, nil if there is none
+func (s *DbMessageStore) GetChatMsg(msgID uint64) (*ChatMsg, error) {
+	if s.engine == nil || msgID == 0 {
+		return nil, nil
+	}
+	msg := new(ChatMsg)
+	if has, err := s.engine.Where("msg_id = ?", msgID).Get(msg); err != nil || !has {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// GetGroupMsg the group message with the msg id, nil if there is none
+func (s *DbMessageStore) GetGroupMsg(msgID uint64) (*GroupMsg, error) {
+	if s.engine == nil || msgID == 0 {
+		return nil, nil
+	}
+	msg := new(GroupMsg)
+	if has, err := s.engine.Where("msg_id = ?", msgID).Get(msg); err != nil || !has {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// historySession apply the cursor, messages are ordered by id which is in the order of saving
+func historySession(engine *xorm.Engine, session *xorm.Session, q *HistoryQuery) *xorm.Session {
+	if q.BeforeID != 0 {
+		session = session.And("id < ?", q.BeforeID)
+	}
+	if q.AfterID != 0 {
+		session = session.And("id > ?", q.AfterID)
+	}
+	if !q.BeforeTime.IsZero() {
+		session = session.And("create_at < ?", formatTime(engine, q.BeforeTime))
+	}
+	if !q.AfterTime.IsZero() {
+		session = session.And("create_at > ?", formatTime(engine, q.AfterTime))
+	}
+	if q.Ascending() {
+		session = session.Asc("id")
+	} else {
+		session = session.Desc("id")
+	}
+	return session.Limit(q.Limit)
+}
+
+// formatTime format a time as xorm saves a datetime column, so it is compared correctly in sqlite
+func formatTime(engine *xorm.Engine, t time.Time) string {
+	return t.In(engine.DatabaseTZ).Format("2006-01-02 15:04:05")
+}
+
+// Database drivers
+const (
+	DriverMysql  = "mysql"
+	DriverSqlite = "sqlite3"
+)
+
+// InitDb init a database by driver, source of sqlite3 is a file path
+func InitDb(driver, source string) (*xorm.Engine, error) {
+	var url string
+	switch driver {
+	case DriverMysql:
+		url = fmt.Sprintf("%s?charset=utf8&parseTime=True&loc=Local", source)
+		// url := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8&parseTime=True&loc=Local", user, pwd, ip, port, dbname)
+	case DriverSqlite:
+		url = fmt.Sprintf("file:%s?_busy_timeout=5000&_journal_mode=WAL", source)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %v", driver)
+	}
+	engine, err := xorm.NewEngine(driver, url)
+	if err != nil {
+		return nil, err
+	}
+	if driver == DriverSqlite {
+		// sqlite allows only one writer
+		engine.SetMaxOpenConns(1)
+	}
 
 	// engine.ShowSQL(true)
 
@@ -75,5 +339,15 @@ func InitMysqlDb(source string) *xorm.Engine {
 
 	engine.SetColumnMapper(core.SnakeMapper{})
 
+	return engine, nil
+}
+
+// InitMysqlDb init mysql database
+func InitMysqlDb(source string) *xorm.Engine {
+	engine, err := InitDb(DriverMysql, source)
+	if err != nil {
+		dbLog.Error("init mysql failed", logger.Err(err))
+		return nil
+	}
 	return engine
 }
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSqliteStore a store in a temporary sqlite database
+func newSqliteStore(t *testing.T) (*DbMessageStore, func()) {
+	dir, err := ioutil.TempDir("", "wscluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := InitDb(DriverSqlite, filepath.Join(dir, "message.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewDbMessageStore(engine)
+	return store, func() {
+		engine.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestInitDb(t *testing.T) {
+	if _, err := InitDb("oracle", "source"); err == nil {
+		t.Error("InitDb() accepts an unsupported driver")
+	}
+	store, clean := newSqliteStore(t)
+	defer clean()
+	// schema sync is repeatable
+	store = NewDbMessageStore(store.engine)
+	for _, table := range []interface{}{new(ChatMsg), new(GroupMsg), new(GroupAudit)} {
+		if exist, err := store.engine.IsTableExist(table); err != nil || !exist {
+			t.Errorf("table %T is not created: %v", table, err)
+		}
+	}
+	if err := store.Ping(); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+}
+
+func TestDbMessageStore_QueryChatMsg(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	msgs := make([]*ChatMsg, 0)
+	for i := 0; i < 10; i++ {
+		from, to := "alice", "bob"
+		if i%2 == 1 {
+			from, to = to, from
+		}
+		msgs = append(msgs, &ChatMsg{FromDomain: 1, ToDomain: 1, From: from, To: to, Text: "hello",
+			CreateAt: base.Add(time.Duration(i) * time.Minute), MsgID: uint64(100 + i)})
+	}
+	// another conversation
+	msgs = append(msgs, &ChatMsg{FromDomain: 1, ToDomain: 1, From: "alice", To: "carol", CreateAt: base})
+	if err := store.SaveChatMsg(msgs); err != nil {
+		t.Fatal(err)
+	}
+	// saved again by another server the messages crossed, twice in a batch
+	dups := []*ChatMsg{}
+	for _, i := range []int{4, 9, 9} {
+		dup := *msgs[i]
+		dup.ID = 0
+		dups = append(dups, &dup)
+	}
+	if err := store.SaveChatMsg(dups); err != nil {
+		t.Fatal(err)
+	}
+	// saved by another server at the same time, after the check of saved messages
+	dup, fresh := *msgs[3], &ChatMsg{FromDomain: 1, ToDomain: 1, From: "alice", To: "dave", CreateAt: base, MsgID: 200}
+	dup.ID = 0
+	if err := store.insertMsgs(new(ChatMsg), []*ChatMsg{&dup, fresh}, []interface{}{&dup, fresh}); err != nil {
+		t.Fatal(err)
+	}
+	dup.ID = 0
+	if _, err := store.engine.Insert(&dup); err == nil {
+		t.Errorf("a duplicated msg id is inserted, there is no unique index")
+	}
+	if n, err := store.engine.Count(new(ChatMsg)); err != nil || n != 12 {
+		t.Errorf("%v rows are saved, want 12 without duplicates, %v", n, err)
+	}
+
+	tests := []struct {
+		name  string
+		query HistoryQuery
+		want  []uint64 // MsgID
+	}{
+		{"latest", HistoryQuery{Limit: 3}, []uint64{109, 108, 107}},
+		{"before id", HistoryQuery{BeforeID: 8, Limit: 3}, []uint64{106, 105, 104}},
+		{"after id", HistoryQuery{AfterID: 2, Limit: 3}, []uint64{102, 103, 104}},
+		{"before time", HistoryQuery{BeforeTime: base.Add(2 * time.Minute), Limit: 5}, []uint64{101, 100}},
+		{"after time", HistoryQuery{AfterTime: base.Add(7 * time.Minute), Limit: 5}, []uint64{108, 109}},
+		{"between", HistoryQuery{AfterID: 3, BeforeID: 6, Limit: 5}, []uint64{104, 103}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the conversation is the same from both sides
+			for _, side := range [][2]string{{"alice", "bob"}, {"bob", "alice"}} {
+				got, err := store.QueryChatMsg(1, side[0], 1, side[1], &tt.query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(tt.want) {
+					t.Fatalf("QueryChatMsg() returns %v messages, want %v", len(got), len(tt.want))
+				}
+				for i, msg := range got {
+					if msg.MsgID != tt.want[i] {
+						t.Errorf("QueryChatMsg()[%v] = %v, want %v", i, msg.MsgID, tt.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDbMessageStore_QueryGroupMsg(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+
+	msgs := []*GroupMsg{
+		{FromDomain: 1, ToDomain: 1, From: "alice", To: "room", Text: "one", CreateAt: time.Now(), MsgID: 1},
+		{FromDomain: 1, ToDomain: 1, From: "bob", To: "room", Text: "two", CreateAt: time.Now(), MsgID: 2},
+		{FromDomain: 1, ToDomain: 1, From: "bob", To: "hall", Text: "three", CreateAt: time.Now(), MsgID: 3},
+		// saved again by another server
+		{FromDomain: 1, ToDomain: 1, From: "bob", To: "room", Text: "two", CreateAt: time.Now(), MsgID: 2},
+	}
+	if err := store.SaveGroupMsg(msgs); err != nil {
+		t.Fatal(err)
+	}
+	mods := []*MsgModify{
+		{MsgID: 1, FromDomain: 1, From: "alice", Recall: true, ModifyAt: time.Now()},
+		{MsgID: 2, FromDomain: 1, From: "bob", Text: "edited", ModifyAt: time.Now()},
+		// not the sender
+		{MsgID: 2, FromDomain: 1, From: "alice", Text: "hacked", ModifyAt: time.Now()},
+		// an edit replayed after the recall
+		{MsgID: 1, FromDomain: 1, From: "alice", Text: "edited", ModifyAt: time.Now()},
+	}
+	if err := store.ModifyGroupMsg(mods); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, err := store.GetGroupMsg(2); err != nil || msg == nil || msg.From != "bob" || msg.To != "room" {
+		t.Errorf("GetGroupMsg(2) = %+v, %v", msg, err)
+	}
+	if msg, err := store.GetGroupMsg(4); err != nil || msg != nil {
+		t.Errorf("GetGroupMsg(4) = %+v, %v, want none", msg, err)
+	}
+	if msg, err := store.GetChatMsg(2); err != nil || msg != nil {
+		t.Errorf("GetChatMsg(2) = %+v, %v, want none", msg, err)
+	}
+
+	got, err := store.QueryGroupMsg(1, "room", &HistoryQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("QueryGroupMsg() returns %v messages, want 2", len(got))
+	}
+	if got[0].Text != "edited" || got[0].EditAt.IsZero() {
+		t.Errorf("message 2 = %+v, want edited", got[0])
+	}
+	if !got[1].Recalled || got[1].Text != "" {
+		t.Errorf("message 1 = %+v, want recalled", got[1])
+	}
+}
+
+func TestDbMessageStore_SaveGroupAudit(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+
+	audits := []*GroupAudit{
+		{Domain: 1, Client: "alice", GroupDomain: 1, Group: "room", InOut: 1, CreateAt: time.Now()},
+		{Domain: 1, Client: "alice", GroupDomain: 1, Group: "room", InOut: 0, CreateAt: time.Now()},
+	}
+	if err := store.SaveGroupAudit(audits); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]*GroupAudit, 0)
+	if err := store.engine.Where("group_domain = ? AND `group` = ?", 1, "room").Asc("id").Find(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].InOut != 1 || got[1].InOut != 0 {
+		t.Errorf("SaveGroupAudit() saves %+v", got)
+	}
+}
@@ -35,25 +35,68 @@ type Server struct {
 // ChatMsg chat消息
 type ChatMsg struct {
 	ID         uint64 `xorm:"pk autoincr 'id'"`
-	FromDomain uint32
-	ToDomain   uint32
-	From       string
-	To         string
+	FromDomain uint32 `xorm:"index(idx_chat_conversation)"`
+	ToDomain   uint32 `xorm:"index(idx_chat_conversation)"`
+	From       string `xorm:"index(idx_chat_conversation)"`
+	To         string `xorm:"index(idx_chat_conversation)"`
 	Type       uint8  //msg type
-	Text       string `xorm:"varchar(1024)"`
+	Text       string `xorm:"mediumtext"`
 	Extra      string
-	CreateAt   time.Time
+	CreateAt   time.Time `xorm:"index"`
+	MsgID      uint64    `xorm:"index 'msg_id'"` // assigned by server
+	Recalled   bool
+	EditAt     time.Time
 }
 
 // GroupMsg room消息
 type GroupMsg struct {
 	ID         uint64 `xorm:"pk autoincr 'id'"`
 	FromDomain uint32
-	ToDomain   uint32
+	ToDomain   uint32 `xorm:"index(idx_group_timeline)"`
 	From       string
-	To         string
+	To         string `xorm:"index(idx_group_timeline)"`
 	Type       uint8  //msg type
-	Text       string `xorm:"varchar(1024)"`
+	Text       string `xorm:"mediumtext"`
 	Extra      string
-	CreateAt   time.Time
+	CreateAt   time.Time `xorm:"index"`
+	MsgID      uint64    `xorm:"index 'msg_id'"` // assigned by server
+	Recalled   bool
+	EditAt     time.Time
+}
+
+// GroupAudit 群成员变更记录，InOut 1 进入 0 退出
+type GroupAudit struct {
+	ID          uint64 `xorm:"pk autoincr 'id'"`
+	Domain      uint32 `xorm:"index(idx_audit_client)"`
+	Client      string `xorm:"index(idx_audit_client)"`
+	GroupDomain uint32 `xorm:"index(idx_audit_group)"`
+	Group       string `xorm:"index(idx_audit_group)"`
+	InOut       uint8
+	CreateAt    time.Time
+}
+
+// MsgModify recall or edit a message, which is sent by From
+type MsgModify struct {
+	MsgID      uint64
+	FromDomain uint32
+	From       string
+	Recall     bool // recall it, or edit it by Text and Extra
+	Text       string
+	Extra      string
+	ModifyAt   time.Time
+}
+
+// HistoryQuery cursor of messages. Messages are returned from the newest to the oldest,
+// or from the oldest to the newest if AfterID or AfterTime is set without a before cursor.
+type HistoryQuery struct {
+	BeforeID   uint64 // ID < BeforeID, 0 means no limit
+	AfterID    uint64 // ID > AfterID
+	BeforeTime time.Time
+	AfterTime  time.Time
+	Limit      int
+}
+
+// Ascending messages are returned from the oldest to the newest
+func (q *HistoryQuery) Ascending() bool {
+	return (q.AfterID != 0 || !q.AfterTime.IsZero()) && q.BeforeID == 0 && q.BeforeTime.IsZero()
 }
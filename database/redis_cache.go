@@ -3,11 +3,11 @@ package database
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
+	"github.com/ws-cluster/logger"
 )
 
 const (
@@ -148,7 +148,7 @@ func (c *RedisServerCache) Clean() error {
 	for _, serverID := range serverIds {
 		skey := fmt.Sprintf(serverReidsPattern, serverID)
 		if val, _ := c.client.Exists(skey).Result(); val == 0 {
-			log.Printf("clean server %v", serverID)
+			dbLog.Info("clean server", logger.F("server", serverID))
 			c.client.SMove(serversRedis, serversDownRedis, serverID)
 		}
 	}
@@ -165,7 +165,7 @@ func InitRedis(ip string, port int, pass string, db int) (*redis.Client, error)
 	})
 	_, err := redisdb.Ping().Result()
 	if err != nil {
-		log.Println(err)
+		dbLog.Error("init redis failed", logger.Err(err))
 		return nil, err
 	}
 	return redisdb, nil
@@ -0,0 +1,287 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ws-cluster/logger"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+	defaultRetentionBatch    = 1000
+	defaultRetentionPause    = 100 * time.Millisecond
+)
+
+// RetentionConfig domain of a message is its ToDomain, an age of 0 means messages are kept forever
+type RetentionConfig struct {
+	MaxAge       time.Duration            // domains without their own age
+	DomainMaxAge map[uint32]time.Duration // age of each domain
+	Interval     time.Duration            // between purges
+	BatchSize    int                      // rows deleted in one statement
+	BatchPause   time.Duration            // pause between batches, so the tables aren't locked for long
+	ArchiveDir   string                   // purged rows are archived to jsonl.gz files before deleted, empty means no archive
+	Index        *SearchIndex             // purged messages are removed from the index too
+}
+
+// PurgeStats rows purged by a run
+type PurgeStats struct {
+	ChatMsgs  int
+	GroupMsgs int
+	Archives  []string
+}
+
+// Retention purge chat and group messages older than the max age of their domain
+type Retention struct {
+	store     *DbMessageStore
+	config    RetentionConfig
+	quit      chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewRetention new a Retention, it is started by Start
+func NewRetention(store *DbMessageStore, config RetentionConfig) *Retention {
+	if config.Interval <= 0 {
+		config.Interval = defaultRetentionInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultRetentionBatch
+	}
+	if config.BatchPause <= 0 {
+		config.BatchPause = defaultRetentionPause
+	}
+	return &Retention{
+		store:  store,
+		config: config,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start purge in background every Interval
+func (r *Retention) Start() {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.config.Interval)
+		defer ticker.Stop()
+		for {
+			stats, err := r.Run()
+			if err != nil {
+				dbLog.Error("retention failed", logger.Err(err))
+			} else if stats.ChatMsgs > 0 || stats.GroupMsgs > 0 {
+				dbLog.Info("messages are purged by retention", logger.F("chat_msgs", stats.ChatMsgs),
+					logger.F("group_msgs", stats.GroupMsgs), logger.F("archives", stats.Archives))
+			}
+			select {
+			case <-ticker.C:
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Close stop purging after the current batch, it must be called after Start
+func (r *Retention) Close() {
+	r.closeOnce.Do(func() {
+		close(r.quit)
+	})
+	<-r.done
+}
+
+// Run purge once
+func (r *Retention) Run() (*PurgeStats, error) {
+	stats := new(PurgeStats)
+	now := time.Now()
+	if r.store.engine == nil {
+		return stats, nil
+	}
+	tables := []struct {
+		bean  interface{}
+		count *int
+		find  func(where string, args []interface{}, limit int) ([]uint64, []interface{}, error)
+	}{
+		{new(ChatMsg), &stats.ChatMsgs, r.findChatMsg},
+		{new(GroupMsg), &stats.GroupMsgs, r.findGroupMsg},
+	}
+	for _, table := range tables {
+		name := r.store.engine.TableName(table.bean)
+		archive := &archiveFile{dir: r.config.ArchiveDir, name: name, at: now}
+		for _, cond := range r.conditions(now) {
+			n, err := r.purge(table.bean, cond.where, cond.args, table.find, archive)
+			*table.count += n
+			if err != nil {
+				archive.Close()
+				return stats, err
+			}
+		}
+		if err := archive.Close(); err != nil {
+			return stats, err
+		}
+		if archive.path != "" {
+			stats.Archives = append(stats.Archives, archive.path)
+		}
+	}
+	if r.config.Index != nil {
+		for _, cond := range r.conditions(now) {
+			if err := r.config.Index.purge(cond.where, cond.args); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, nil
+}
+
+type purgeCondition struct {
+	where string
+	args  []interface{}
+}
+
+// conditions one condition for each domain with an age, and one for the others
+func (r *Retention) conditions(now time.Time) []purgeCondition {
+	conds := make([]purgeCondition, 0, len(r.config.DomainMaxAge)+1)
+	domains := make([]string, 0, len(r.config.DomainMaxAge))
+	args := make([]interface{}, 0, len(r.config.DomainMaxAge)+1)
+	for domain, age := range r.config.DomainMaxAge {
+		domains = append(domains, "?")
+		args = append(args, domain)
+		if age <= 0 {
+			continue
+		}
+		conds = append(conds, purgeCondition{
+			where: "to_domain = ? AND create_at < ?",
+			args:  []interface{}{domain, formatTime(r.store.engine, now.Add(-age))},
+		})
+	}
+	if r.config.MaxAge > 0 {
+		where := "create_at < ?"
+		if len(domains) > 0 {
+			where = fmt.Sprintf("to_domain NOT IN (%v) AND create_at < ?", strings.Join(domains, ","))
+		}
+		conds = append(conds, purgeCondition{
+			where: where,
+			args:  append(args, formatTime(r.store.engine, now.Add(-r.config.MaxAge))),
+		})
+	}
+	return conds
+}
+
+// purge delete matched rows in batches from the oldest, each batch is archived before deleted
+func (r *Retention) purge(bean interface{}, where string, args []interface{},
+	find func(string, []interface{}, int) ([]uint64, []interface{}, error), archive *archiveFile) (int, error) {
+	purged := 0
+	for {
+		ids, rows, err := find(where, args, r.config.BatchSize)
+		if err != nil || len(ids) == 0 {
+			return purged, err
+		}
+		if err = archive.Write(rows); err != nil {
+			return purged, err
+		}
+		if _, err = r.store.engine.In("id", ids).Delete(bean); err != nil {
+			return purged, err
+		}
+		purged += len(ids)
+		if len(ids) < r.config.BatchSize {
+			return purged, nil
+		}
+		select {
+		case <-time.After(r.config.BatchPause):
+		case <-r.quit:
+			return purged, nil
+		}
+	}
+}
+
+func (r *Retention) findChatMsg(where string, args []interface{}, limit int) ([]uint64, []interface{}, error) {
+	msgs := make([]*ChatMsg, 0, limit)
+	if err := r.store.engine.Where(where, args...).Asc("id").Limit(limit).Find(&msgs); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]uint64, len(msgs))
+	rows := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		ids[i], rows[i] = msg.ID, msg
+	}
+	return ids, rows, nil
+}
+
+func (r *Retention) findGroupMsg(where string, args []interface{}, limit int) ([]uint64, []interface{}, error) {
+	msgs := make([]*GroupMsg, 0, limit)
+	if err := r.store.engine.Where(where, args...).Asc("id").Limit(limit).Find(&msgs); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]uint64, len(msgs))
+	rows := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		ids[i], rows[i] = msg.ID, msg
+	}
+	return ids, rows, nil
+}
+
+// archiveFile <dir>/<table>-<time>.jsonl.gz, created on the first write.
+// It is flushed and synced after each batch, so the rows are on disk before they are deleted.
+type archiveFile struct {
+	dir  string
+	name string
+	at   time.Time
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+func (a *archiveFile) Write(rows []interface{}) error {
+	if a.dir == "" {
+		return nil
+	}
+	if a.file == nil {
+		if err := os.MkdirAll(a.dir, os.ModePerm); err != nil {
+			return err
+		}
+		a.path = filepath.Join(a.dir, fmt.Sprintf("%v-%v.jsonl.gz", a.name, a.at.Format("20060102T150405")))
+		file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		a.file = file
+		a.gz = gzip.NewWriter(file)
+		a.buf = bufio.NewWriter(a.gz)
+	}
+	encoder := json.NewEncoder(a.buf)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+func (a *archiveFile) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	err := a.gz.Close()
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if cerr := a.file.Close(); err == nil {
+		err = cerr
+	}
+	a.file = nil
+	return err
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetention_Run(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-48 * time.Hour)
+	msgs := make([]*ChatMsg, 0)
+	for _, domain := range []uint32{1, 2, 3} {
+		for i := 0; i < 5; i++ {
+			msgs = append(msgs, &ChatMsg{FromDomain: domain, ToDomain: domain, From: "alice", To: "bob", CreateAt: old})
+		}
+		msgs = append(msgs, &ChatMsg{FromDomain: domain, ToDomain: domain, From: "alice", To: "bob", CreateAt: time.Now()})
+	}
+	if err := store.SaveChatMsg(msgs); err != nil {
+		t.Fatal(err)
+	}
+	groupmsgs := []*GroupMsg{
+		{FromDomain: 1, ToDomain: 1, From: "alice", To: "room", CreateAt: old},
+		{FromDomain: 1, ToDomain: 1, From: "alice", To: "room", CreateAt: time.Now()},
+	}
+	if err := store.SaveGroupMsg(groupmsgs); err != nil {
+		t.Fatal(err)
+	}
+
+	// domain 2 is kept forever, domain 3 is kept for 72 hours, the others for 24 hours
+	retention := NewRetention(store, RetentionConfig{
+		MaxAge:       24 * time.Hour,
+		DomainMaxAge: map[uint32]time.Duration{2: 0, 3: 72 * time.Hour},
+		BatchSize:    2,
+		BatchPause:   time.Millisecond,
+		ArchiveDir:   dir,
+	})
+	stats, err := retention.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChatMsgs != 5 || stats.GroupMsgs != 1 || len(stats.Archives) != 2 {
+		t.Fatalf("Run() = %+v", stats)
+	}
+	for domain, want := range map[uint32]int64{1: 1, 2: 6, 3: 6} {
+		count, err := store.engine.Where("to_domain = ?", domain).Count(new(ChatMsg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("domain %v has %v messages, want %v", domain, count, want)
+		}
+	}
+
+	// purged rows are archived
+	file, err := os.Open(stats.Archives[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(gz)
+	archived := 0
+	for scanner.Scan() {
+		msg := new(ChatMsg)
+		if err := json.Unmarshal(scanner.Bytes(), msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ToDomain != 1 {
+			t.Errorf("message of domain %v is archived", msg.ToDomain)
+		}
+		archived++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if archived != 5 {
+		t.Errorf("%v messages are archived, want 5", archived)
+	}
+
+	// nothing more to purge
+	if stats, err = retention.Run(); err != nil || stats.ChatMsgs != 0 || len(stats.Archives) != 0 {
+		t.Errorf("Run() = %+v, %v", stats, err)
+	}
+}
+
+func TestRetention_Index(t *testing.T) {
+	store, clean := newSqliteStore(t)
+	defer clean()
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := NewSearchIndex(filepath.Join(dir, "search.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	msgs := []*SearchMsg{
+		{MsgID: 1, FromDomain: 1, ToDomain: 1, From: "alice", To: "bob", Text: "old order", CreateAt: time.Now().Add(-48 * time.Hour)},
+		{MsgID: 2, FromDomain: 1, ToDomain: 1, From: "alice", To: "bob", Text: "new order", CreateAt: time.Now()},
+	}
+	if err := index.Index(msgs); err != nil {
+		t.Fatal(err)
+	}
+	retention := NewRetention(store, RetentionConfig{MaxAge: 24 * time.Hour, Index: index})
+	if _, err := retention.Run(); err != nil {
+		t.Fatal(err)
+	}
+	hits, err := index.Search(&SearchQuery{Domain: 1, Keyword: "order", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].ChatMsg.MsgID != 2 {
+		t.Errorf("Search() after purge = %v", hits)
+	}
+}
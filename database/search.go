@@ -0,0 +1,332 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-xorm/xorm"
+)
+
+// ErrEmptyKeyword the keyword has nothing to search
+var ErrEmptyKeyword = errors.New("keyword is empty")
+
+const searchFtsTable = "t_search_fts"
+
+// highlight marks of matched terms
+const (
+	highlightBegin = "<em>"
+	highlightEnd   = "</em>"
+)
+
+// SearchMsg a chat or group message in the search index, ID is the id in the index
+type SearchMsg struct {
+	ID         uint64 `xorm:"pk autoincr 'id'"`
+	IsGroup    bool
+	MsgID      uint64 `xorm:"index 'msg_id'"`
+	FromDomain uint32
+	ToDomain   uint32 `xorm:"index(idx_search_domain)"`
+	From       string
+	To         string
+	Type       uint8
+	Text       string
+	Extra      string
+	CreateAt   time.Time `xorm:"index(idx_search_domain)"`
+	EditAt     time.Time
+}
+
+// SearchQuery keyword is matched by words, and by characters for CJK text.
+// Hits are returned from the newest to the oldest, BeforeID is the cursor of next page.
+type SearchQuery struct {
+	Domain     uint32 // of the receiver
+	Keyword    string
+	FromDomain uint32 // of From, 0 is Domain
+	From       string
+	To         string // a client
+	Group      string
+	StartTime  time.Time
+	EndTime    time.Time
+	BeforeID   uint64
+	Limit      int
+}
+
+// SearchHit a matched message, the matched terms of Text are marked in Highlight.
+// ID of the message is the id in the index, MsgID identifies it in the message store
+type SearchHit struct {
+	ID        uint64
+	ChatMsg   *ChatMsg  `json:",omitempty"`
+	GroupMsg  *GroupMsg `json:",omitempty"`
+	Highlight string
+}
+
+// SearchIndex full-text index of messages in a sqlite database with FTS4
+type SearchIndex struct {
+	engine *xorm.Engine
+}
+
+// NewSearchIndex open the index in a sqlite file
+func NewSearchIndex(path string) (*SearchIndex, error) {
+	engine, err := InitDb(DriverSqlite, path)
+	if err != nil {
+		return nil, err
+	}
+	if err = engine.Sync2(new(SearchMsg)); err != nil {
+		engine.Close()
+		return nil, err
+	}
+	// text is tokenized by tokenize, the simple tokenizer only splits the tokens by space
+	if _, err = engine.Exec(fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS %v USING fts4(tokens)", searchFtsTable)); err != nil {
+		engine.Close()
+		return nil, err
+	}
+	return &SearchIndex{engine: engine}, nil
+}
+
+// Close Close
+func (s *SearchIndex) Close() error {
+	return s.engine.Close()
+}
+
+// Index add messages to the index
+func (s *SearchIndex) Index(msgs []*SearchMsg) error {
+	session := s.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if _, err := session.Insert(msg); err != nil {
+			session.Rollback()
+			return err
+		}
+		if _, err := session.Exec(fmt.Sprintf("INSERT INTO %v(docid, tokens) VALUES (?, ?)", searchFtsTable),
+			msg.ID, strings.Join(tokenize(msg.Text, false), " ")); err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+// Modify a recalled message is removed from the index, an edited one is indexed again.
+// A message is only modified by its sender
+func (s *SearchIndex) Modify(mods []*MsgModify) error {
+	session := s.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	for _, mod := range mods {
+		ids := make([]uint64, 0)
+		err := session.Table(new(SearchMsg)).Cols("id").
+			Where("msg_id = ? AND from_domain = ? AND `from` = ?", mod.MsgID, mod.FromDomain, mod.From).Find(&ids)
+		if err == nil && len(ids) > 0 {
+			if mod.Recall {
+				err = s.delete(session, ids)
+			} else {
+				err = s.edit(session, ids, mod)
+			}
+		}
+		if err != nil {
+			session.Rollback()
+			return err
+		}
+	}
+	return session.Commit()
+}
+
+func (s *SearchIndex) delete(session *xorm.Session, ids []uint64) error {
+	for _, id := range ids {
+		if _, err := session.Exec(fmt.Sprintf("DELETE FROM %v WHERE docid = ?", searchFtsTable), id); err != nil {
+			return err
+		}
+	}
+	_, err := session.In("id", ids).Delete(new(SearchMsg))
+	return err
+}
+
+func (s *SearchIndex) edit(session *xorm.Session, ids []uint64, mod *MsgModify) error {
+	_, err := session.Table(new(SearchMsg)).In("id", ids).Cols("text", "extra", "edit_at").
+		Update(map[string]interface{}{"text": mod.Text, "extra": mod.Extra, "edit_at": mod.ModifyAt})
+	if err != nil {
+		return err
+	}
+	tokens := strings.Join(tokenize(mod.Text, false), " ")
+	for _, id := range ids {
+		if _, err := session.Exec(fmt.Sprintf("UPDATE %v SET tokens = ? WHERE docid = ?", searchFtsTable), tokens, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purge remove messages matched by a condition of Retention
+func (s *SearchIndex) purge(where string, args []interface{}) error {
+	session := s.engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	sql := fmt.Sprintf("DELETE FROM %v WHERE docid IN (SELECT id FROM %v WHERE %v)",
+		searchFtsTable, s.engine.TableName(new(SearchMsg)), where)
+	if _, err := session.Exec(append([]interface{}{sql}, args...)...); err != nil {
+		session.Rollback()
+		return err
+	}
+	if _, err := session.Where(where, args...).Delete(new(SearchMsg)); err != nil {
+		session.Rollback()
+		return err
+	}
+	return session.Commit()
+}
+
+// Search search messages of a domain
+func (s *SearchIndex) Search(q *SearchQuery) ([]*SearchHit, error) {
+	terms := tokenize(q.Keyword, true)
+	if len(terms) == 0 {
+		return nil, ErrEmptyKeyword
+	}
+	for i, term := range terms {
+		terms[i] = `"` + term + `"`
+	}
+	session := s.engine.Where(fmt.Sprintf("id IN (SELECT docid FROM %v WHERE tokens MATCH ?)", searchFtsTable),
+		strings.Join(terms, " ")).And("to_domain = ?", q.Domain)
+	if q.From != "" {
+		fromDomain := q.FromDomain
+		if fromDomain == 0 {
+			fromDomain = q.Domain
+		}
+		session = session.And("from_domain = ? AND `from` = ?", fromDomain, q.From)
+	}
+	if q.To != "" {
+		session = session.And("is_group = ? AND `to` = ?", false, q.To)
+	}
+	if q.Group != "" {
+		session = session.And("is_group = ? AND `to` = ?", true, q.Group)
+	}
+	if !q.StartTime.IsZero() {
+		session = session.And("create_at >= ?", formatTime(s.engine, q.StartTime))
+	}
+	if !q.EndTime.IsZero() {
+		session = session.And("create_at < ?", formatTime(s.engine, q.EndTime))
+	}
+	if q.BeforeID != 0 {
+		session = session.And("id < ?", q.BeforeID)
+	}
+	msgs := make([]*SearchMsg, 0)
+	if err := session.Desc("id").Limit(q.Limit).Find(&msgs); err != nil {
+		return nil, err
+	}
+
+	keywords := keywordRunes(q.Keyword)
+	hits := make([]*SearchHit, 0, len(msgs))
+	for _, msg := range msgs {
+		hit := &SearchHit{ID: msg.ID, Highlight: highlight(msg.Text, keywords)}
+		if msg.IsGroup {
+			hit.GroupMsg = &GroupMsg{FromDomain: msg.FromDomain, ToDomain: msg.ToDomain, From: msg.From, To: msg.To,
+				Type: msg.Type, Text: msg.Text, Extra: msg.Extra, CreateAt: msg.CreateAt, MsgID: msg.MsgID, EditAt: msg.EditAt}
+		} else {
+			hit.ChatMsg = &ChatMsg{FromDomain: msg.FromDomain, ToDomain: msg.ToDomain, From: msg.From, To: msg.To,
+				Type: msg.Type, Text: msg.Text, Extra: msg.Extra, CreateAt: msg.CreateAt, MsgID: msg.MsgID, EditAt: msg.EditAt}
+		}
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// tokenize split text to lower case words, and CJK text to characters and pairs of characters.
+// A query only needs the pairs, or the character if there is only one.
+func tokenize(text string, query bool) []string {
+	tokens := make([]string, 0)
+	var word, cjk []rune
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+		for i := range cjk {
+			if !query || len(cjk) == 1 {
+				tokens = append(tokens, string(cjk[i]))
+			}
+			if i > 0 {
+				tokens = append(tokens, string(cjk[i-1:i+1]))
+			}
+		}
+		cjk = cjk[:0]
+	}
+	for _, r := range text {
+		r = unicode.ToLower(r)
+		switch {
+		case isCJK(r):
+			if len(word) > 0 {
+				flush()
+			}
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(cjk) > 0 {
+				flush()
+			}
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// keywordRunes lower case runs of letters and digits in the keyword
+func keywordRunes(keyword string) [][]rune {
+	keywords := make([][]rune, 0)
+	var run []rune
+	for _, r := range keyword {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			run = append(run, unicode.ToLower(r))
+			continue
+		}
+		if len(run) > 0 {
+			keywords = append(keywords, run)
+			run = nil
+		}
+	}
+	if len(run) > 0 {
+		keywords = append(keywords, run)
+	}
+	return keywords
+}
+
+// highlight mark keywords in text case insensitively
+func highlight(text string, keywords [][]rune) string {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	marked := make([]bool, len(runes))
+	for _, keyword := range keywords {
+		for i := 0; i+len(keyword) <= len(lower); i++ {
+			if string(lower[i:i+len(keyword)]) == string(keyword) {
+				for j := i; j < i+len(keyword); j++ {
+					marked[j] = true
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	for i, r := range runes {
+		if marked[i] && (i == 0 || !marked[i-1]) {
+			b.WriteString(highlightBegin)
+		}
+		b.WriteRune(r)
+		if marked[i] && (i == len(runes)-1 || !marked[i+1]) {
+			b.WriteString(highlightEnd)
+		}
+	}
+	return b.String()
+}
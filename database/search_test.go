@@ -0,0 +1,122 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text  string
+		query bool
+		want  []string
+	}{
+		{"Hello, World!", false, []string{"hello", "world"}},
+		{"你好吗", false, []string{"你", "好", "你好", "吗", "好吗"}},
+		{"你好吗", true, []string{"你好", "好吗"}},
+		{"好", true, []string{"好"}},
+		{"go语言v2", false, []string{"go", "语", "言", "语言", "v2"}},
+	}
+	for _, tt := range tests {
+		if got := tokenize(tt.text, tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%v, %v) = %v, want %v", tt.text, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	got := highlight("Hello world, hello 世界", keywordRunes("HELLO 世界"))
+	want := "<em>Hello</em> world, <em>hello</em> <em>世界</em>"
+	if got != want {
+		t.Errorf("highlight() = %v, want %v", got, want)
+	}
+}
+
+func TestSearchIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := NewSearchIndex(filepath.Join(dir, "search.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	base := time.Now().Add(-time.Hour)
+	msgs := []*SearchMsg{
+		{MsgID: 1, FromDomain: 1, ToDomain: 1, From: "alice", To: "bob", Text: "refund my order please", CreateAt: base},
+		{MsgID: 2, FromDomain: 1, ToDomain: 1, From: "bob", To: "alice", Text: "订单已经退款", CreateAt: base.Add(time.Minute)},
+		{MsgID: 3, IsGroup: true, FromDomain: 1, ToDomain: 1, From: "carol", To: "room", Text: "Order shipped", CreateAt: base.Add(2 * time.Minute)},
+		{MsgID: 4, FromDomain: 2, ToDomain: 2, From: "alice", To: "bob", Text: "order of domain 2", CreateAt: base},
+		{MsgID: 5, FromDomain: 2, ToDomain: 1, From: "alice", To: "bob", Text: "order from domain 2", CreateAt: base},
+	}
+	if err := index.Index(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(q SearchQuery) []uint64 {
+		t.Helper()
+		if q.Limit == 0 {
+			q.Limit = 10
+		}
+		hits, err := index.Search(&q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]uint64, 0)
+		for _, hit := range hits {
+			if hit.ChatMsg != nil {
+				ids = append(ids, hit.ChatMsg.MsgID)
+			} else {
+				ids = append(ids, hit.GroupMsg.MsgID)
+			}
+		}
+		return ids
+	}
+	tests := []struct {
+		name  string
+		query SearchQuery
+		want  []uint64
+	}{
+		{"word", SearchQuery{Domain: 1, Keyword: "ORDER"}, []uint64{5, 3, 1}},
+		{"words", SearchQuery{Domain: 1, Keyword: "refund order"}, []uint64{1}},
+		{"cjk", SearchQuery{Domain: 1, Keyword: "退款"}, []uint64{2}},
+		{"cjk not adjacent", SearchQuery{Domain: 1, Keyword: "单退"}, []uint64{}},
+		{"from", SearchQuery{Domain: 1, Keyword: "order", From: "alice"}, []uint64{1}},
+		{"from domain", SearchQuery{Domain: 1, Keyword: "order", FromDomain: 2, From: "alice"}, []uint64{5}},
+		{"to", SearchQuery{Domain: 1, Keyword: "order", To: "bob"}, []uint64{5, 1}},
+		{"group", SearchQuery{Domain: 1, Keyword: "order", Group: "room"}, []uint64{3}},
+		{"time", SearchQuery{Domain: 1, Keyword: "order", StartTime: base.Add(time.Minute)}, []uint64{3}},
+		{"domain", SearchQuery{Domain: 2, Keyword: "order"}, []uint64{4}},
+	}
+	for _, tt := range tests {
+		if got := search(tt.query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: Search() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if _, err := index.Search(&SearchQuery{Domain: 1, Keyword: "!!"}); err != ErrEmptyKeyword {
+		t.Errorf("Search() with empty keyword returns %v", err)
+	}
+
+	// recalled message is removed, edited one is indexed again
+	mods := []*MsgModify{
+		{MsgID: 1, FromDomain: 1, From: "alice", Recall: true},
+		{MsgID: 3, FromDomain: 1, From: "carol", Text: "parcel shipped", ModifyAt: time.Now()},
+	}
+	if err := index.Modify(mods); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(SearchQuery{Domain: 1, Keyword: "order"}); !reflect.DeepEqual(got, []uint64{5}) {
+		t.Errorf("Search() after modify = %v", got)
+	}
+	hits, err := index.Search(&SearchQuery{Domain: 1, Keyword: "parcel", Limit: 10})
+	if err != nil || len(hits) != 1 || hits[0].Highlight != "<em>parcel</em> shipped" {
+		t.Errorf("Search() edited message = %v, %v", hits, err)
+	}
+}
@@ -4,4 +4,18 @@ package database
 type MessageStore interface {
 	SaveChatMsg(msgs []*ChatMsg) error
 	SaveGroupMsg(msgs []*GroupMsg) error
+	ModifyChatMsg(mods []*MsgModify) error
+	ModifyGroupMsg(mods []*MsgModify) error
+	// SaveGroupAudit record membership changes of groups
+	SaveGroupAudit(audits []*GroupAudit) error
+	// QueryChatMsg messages between two clients in both directions
+	QueryChatMsg(domain uint32, addr string, peerDomain uint32, peer string, q *HistoryQuery) ([]*ChatMsg, error)
+	// QueryGroupMsg timeline of a group
+	QueryGroupMsg(domain uint32, group string, q *HistoryQuery) ([]*GroupMsg, error)
+	// GetChatMsg the chat message with the msg id, nil if there is none
+	GetChatMsg(msgID uint64) (*ChatMsg, error)
+	// GetGroupMsg the group message with the msg id, nil if there is none
+	GetGroupMsg(msgID uint64) (*GroupMsg, error)
+	// Ping check the database is reachable
+	Ping() error
 }
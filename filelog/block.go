@@ -0,0 +1,175 @@
+package filelog
+
+import "hash/crc32"
+
+const (
+	blockModeRead  = uint8(1)
+	blockModeWrite = uint8(2)
+)
+
+// A block begins with a uint16 count of records. In the legacy format a record is
+// / 2 byte length / data /
+// Since the v2 format, flagged by the high bit of the count, a record may span blocks,
+// it is written as fragments in consecutive blocks:
+// / 1 byte kind / 4 byte length / data /
+// A block flagged by blockChecksum has a crc32 of the rest of block after the count.
+const (
+	blockFormatV2  = uint16(1 << 15)
+	blockChecksum  = uint16(1 << 14)
+	blockFlags     = blockFormatV2 | blockChecksum
+	blockCrcOffset = 2
+	blockHeadSize  = 6
+
+	fragmentHeaderSize = 5
+
+	fragmentFull   = uint8(1) // a whole record
+	fragmentFirst  = uint8(2)
+	fragmentMiddle = uint8(3)
+	fragmentLast   = uint8(4)
+)
+
+// Block log Block
+type Block struct {
+	buf    []byte //block 数据
+	offset uint16 // 读/写 偏移
+	cap    uint16 // 容量
+	length uint16 //record count
+	mode   uint8  // 1:read 2:write
+	legacy bool   // records in the legacy format
+}
+
+// block 一个 blocke只能读或者写
+func newBlock(b []byte, mode uint8) *Block {
+	if b == nil || len(b) == 0 {
+		return nil
+	}
+	cap := uint16(len(b))
+	length := littleEndian.Uint16(b[0:2])
+	legacy := mode == blockModeRead && length&blockFormatV2 == 0
+	offset := uint16(blockHeadSize)
+	if mode == blockModeRead && length&blockChecksum == 0 {
+		offset = 2
+	}
+
+	return &Block{
+		buf:    b,
+		offset: offset,
+		cap:    cap,
+		length: length &^ blockFlags,
+		mode:   mode,
+		legacy: legacy,
+	}
+}
+
+// checkBlock verify the checksum of a block read from file.
+// a block without checksum is accepted unless it is blank
+func checkBlock(b []byte) bool {
+	length := littleEndian.Uint16(b[0:2])
+	if length == 0 { // never written
+		return false
+	}
+	if length&blockChecksum == 0 {
+		return true
+	}
+	return crc32.ChecksumIEEE(b[blockHeadSize:]) == littleEndian.Uint32(b[blockCrcOffset:])
+}
+
+func (block *Block) writeUint16(val uint16, offset uint16) {
+	bbuf := make([]byte, 2)
+	littleEndian.PutUint16(bbuf, val)
+	copy(block.buf[offset:], bbuf)
+}
+
+func (block *Block) readUint16(offset uint16) uint16 {
+	lbuf := block.buf[offset : offset+2]
+	return littleEndian.Uint16(lbuf)
+}
+
+// write write a fragment of record
+func (block *Block) write(kind uint8, b []byte) error {
+	if block.mode != blockModeWrite {
+		return errBlockWriteOnly
+	}
+	blen := uint16(len(b))
+	if block.free() < int(blen) {
+		return errBlockLackOfSpace
+	}
+	block.buf[block.offset] = kind
+	littleEndian.PutUint32(block.buf[block.offset+1:], uint32(blen))
+	block.offset += fragmentHeaderSize
+
+	copy(block.buf[block.offset:], b)
+	block.offset += blen
+	block.length++
+	block.writeUint16(block.length|blockFlags, 0)
+	return nil
+}
+
+// free bytes of data can be written in a fragment
+func (block *Block) free() int {
+	return int(block.cap) - int(block.offset) - fragmentHeaderSize
+}
+
+// read read a fragment of record
+func (block *Block) read() (uint8, []byte, error) {
+	if block.mode != blockModeRead {
+		return 0, nil, errBlockReadOnly
+	}
+	if block.legacy {
+		buf, err := block.readLegacy()
+		return fragmentFull, buf, err
+	}
+	if int(block.offset)+fragmentHeaderSize > int(block.cap) || block.length == 0 {
+		return 0, nil, errBlockEmpty
+	}
+	kind := block.buf[block.offset]
+	blen := littleEndian.Uint32(block.buf[block.offset+1:])
+	block.offset += fragmentHeaderSize
+	if int(block.offset)+int(blen) > int(block.cap) {
+		return 0, nil, errBlockEmpty
+	}
+	buf := make([]byte, blen)
+	copy(buf, block.buf[block.offset:])
+	block.offset += uint16(blen)
+	block.length--
+
+	return kind, buf, nil
+}
+
+// readLegacy read a record in the legacy format
+func (block *Block) readLegacy() ([]byte, error) {
+	if block.offset >= block.cap || block.length == 0 {
+		return nil, errBlockEmpty
+	}
+
+	blen := block.readUint16(block.offset)
+	block.offset += 2
+
+	if blen == 0 {
+		return nil, errBlockEmpty
+	}
+	buf := make([]byte, blen)
+	copy(buf, block.buf[block.offset:])
+	block.offset += blen
+
+	block.length--
+	block.writeUint16(block.length, 0)
+
+	return buf, nil
+}
+
+// 返回一个block.size 长度的数组，带有校验和
+func (block *Block) bytes() []byte {
+	littleEndian.PutUint32(block.buf[blockCrcOffset:], crc32.ChecksumIEEE(block.buf[blockHeadSize:]))
+	return block.buf
+}
+
+func (block *Block) reset() {
+	block.offset = blockHeadSize
+	block.length = 0
+	block.writeUint16(block.length, 0)
+	// clear stale data, so that the checksum only covers this block
+	for i := blockHeadSize; i < len(block.buf); i++ {
+		block.buf[i] = 0
+	}
+}
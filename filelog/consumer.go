@@ -0,0 +1,369 @@
+package filelog
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ws-cluster/logger"
+)
+
+const (
+	offsetExt     = ".offset"
+	deadLetterExt = ".dead"
+	// DefaultConsumer name of the consumer of Config.SubFunc
+	DefaultConsumer = "default"
+)
+
+// consumer reads the log at its own pace, its offset is persisted in <name>.offset.
+// a consumer loaded from its offset file is inactive until it is subscribed again,
+// the log is retained for it anyway, unless it lags more than ConsumerMaxLag.
+type consumer struct {
+	name       string
+	fn         func(log []*bytes.Buffer) error
+	readblock  int
+	offsetFile *os.File
+	stats      ConsumerStats
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// ConsumerStats consuming state of a consumer
+type ConsumerStats struct {
+	Name          string
+	ReadBlock     int // committed read offset
+	Lag           int // blocks not consumed yet
+	Active        bool
+	Stale         bool // lags more than ConsumerMaxLag, the log isn't retained for it
+	Retries       uint64
+	DeadLetters   uint64 // records written to the dead letter file
+	CorruptBlocks uint64 // blocks failed the checksum, written to the dead letter file as they are
+	LastError     string
+}
+
+func validConsumerName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func openConsumer(dir, name string) (*consumer, error) {
+	// 此处不能设置为 os.O_APPEND 模式，否则在 docker offset 失效
+	f, err := os.OpenFile(filepath.Join(dir, name+offsetExt), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &consumer{
+		name:       name,
+		readblock:  int(readUint64(f, 0)),
+		offsetFile: f,
+	}, nil
+}
+
+// loadConsumers open offset files in dir
+func (flog *FileLog) loadConsumers() error {
+	// the offset file of a single consumer before named consumers
+	legacy := filepath.Join(flog.dir, "offset")
+	if _, err := os.Stat(legacy); err == nil {
+		if err := os.Rename(legacy, filepath.Join(flog.dir, DefaultConsumer+offsetExt)); err != nil {
+			return err
+		}
+	}
+	infos, err := ioutil.ReadDir(flog.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), offsetExt)
+		if info.IsDir() || name == info.Name() || !validConsumerName(name) {
+			continue
+		}
+		c, err := openConsumer(flog.dir, name)
+		if err != nil {
+			return err
+		}
+		flog.consumers[name] = c
+	}
+	return nil
+}
+
+// Subscribe register a consumer named name, records are passed to fn at least once.
+// a new consumer begins from the oldest retained block, a known one from its committed offset.
+// The log is retained until the slowest consumer has passed it, or until the retention forces it out.
+func (flog *FileLog) Subscribe(name string, fn func(log []*bytes.Buffer) error) error {
+	if !validConsumerName(name) {
+		return errInvalidConsumer
+	}
+	if fn == nil {
+		return errNilConsumer
+	}
+	flog.Lock()
+	defer flog.Unlock()
+	select {
+	case <-flog.quit:
+		return errClosed
+	default:
+	}
+	c, has := flog.consumers[name]
+	if has && c.fn != nil {
+		return errConsumerExists
+	}
+	if !has {
+		var err error
+		if c, err = openConsumer(flog.dir, name); err != nil {
+			return err
+		}
+		c.readblock = flog.segments[0].base
+		if err := writeUint64(c.offsetFile, uint64(c.readblock), 0); err != nil {
+			c.offsetFile.Close()
+			return err
+		}
+		flog.consumers[name] = c
+	}
+	c.fn = fn
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	flog.waitGroup.Add(1)
+	go flog.readloop(c)
+	return nil
+}
+
+// Unsubscribe stop a consumer and remove its offset, the log is no longer retained for it
+func (flog *FileLog) Unsubscribe(name string) error {
+	flog.Lock()
+	c, has := flog.consumers[name]
+	flog.Unlock()
+	if !has {
+		return errConsumerNoFound
+	}
+	if c.fn != nil {
+		close(c.quit)
+		<-c.done
+	}
+	flog.Lock()
+	defer flog.Unlock()
+	delete(flog.consumers, name)
+	c.offsetFile.Close()
+	return os.Remove(c.offsetFile.Name())
+}
+
+// commit persist the read offset of a consumer after the blocks before it are consumed
+func (flog *FileLog) commit(c *consumer, readblock int) {
+	flog.Lock()
+	defer flog.Unlock()
+	if readblock <= c.readblock {
+		return
+	}
+	c.readblock = readblock
+	if err := writeUint64(c.offsetFile, uint64(readblock), 0); err != nil {
+		flog.log.Error("commit offset failed", logger.F("consumer", c.name), logger.Err(err))
+	}
+}
+
+// minReadBlock offset of the slowest consumer, it must be called with the lock
+func (flog *FileLog) minReadBlock() (int, bool) {
+	min, has := 0, false
+	for _, c := range flog.consumers {
+		if !has || c.readblock < min {
+			min, has = c.readblock, true
+		}
+	}
+	return min, has
+}
+
+// stale the consumer lags more than maxLagBlocks, it must be called with the lock
+func (flog *FileLog) stale(c *consumer) bool {
+	return flog.maxLagBlocks > 0 && flog.writeblock-c.readblock > flog.maxLagBlocks
+}
+
+// minRetainedBlock offset of the slowest consumer which isn't stale, it must be called with the lock
+func (flog *FileLog) minRetainedBlock() (int, bool) {
+	min, has := 0, false
+	for _, c := range flog.consumers {
+		if flog.stale(c) {
+			continue
+		}
+		if !has || c.readblock < min {
+			min, has = c.readblock, true
+		}
+	}
+	return min, has
+}
+
+// readloop consume blocks at least once: the read offset is committed after the subscriber succeeded,
+// or the records are written to the dead letter file after MaxRetries
+func (flog *FileLog) readloop(c *consumer) {
+	defer flog.waitGroup.Done()
+	defer close(c.done)
+	// a record spanning blocks, and the block it begins in
+	var partial *bytes.Buffer
+	var partialAt int
+
+	flog.Lock()
+	next := c.readblock
+	flog.Unlock()
+	for {
+		blockbuf, err := flog.readBlock(next)
+		if err == errBlockDeleted {
+			flog.Lock()
+			flog.log.Warn("blocks are deleted before consumed", logger.F("from", next), logger.F("to", flog.segments[0].base), logger.F("consumer", c.name))
+			next = flog.segments[0].base
+			flog.Unlock()
+			partial = nil
+			continue
+		}
+		if err != nil {
+			if err != errNoMoreBlock {
+				flog.log.Error("read block failed", logger.F("block", next), logger.Err(err))
+			}
+			if !flog.sleep(c, time.Millisecond*300) {
+				return
+			}
+			continue
+		}
+
+		if !checkBlock(blockbuf) {
+			flog.log.Error("block is corrupted, it is dead", logger.F("block", next), logger.F("consumer", c.name))
+			if err := flog.deadLetter(c, []*bytes.Buffer{bytes.NewBuffer(blockbuf)}); err != nil {
+				flog.log.Error("write dead letters failed", logger.F("consumer", c.name), logger.Err(err))
+			}
+			flog.Lock()
+			c.stats.CorruptBlocks++
+			flog.Unlock()
+			partial = nil // the rest of the record is dropped
+			next++
+			flog.commit(c, next)
+			continue
+		}
+		block := newBlock(blockbuf, blockModeRead)
+
+		blockLength := block.length
+		list := make([]*bytes.Buffer, 0, blockLength)
+
+		for i := uint16(0); i < blockLength; i++ {
+			kind, buf, err := block.read()
+			if err != nil {
+				flog.log.Error("read record failed", logger.F("block", next), logger.Err(err))
+				break
+			}
+			switch kind {
+			case fragmentFull:
+				list = append(list, bytes.NewBuffer(buf))
+			case fragmentFirst:
+				partial = bytes.NewBuffer(buf)
+				partialAt = next
+			case fragmentMiddle, fragmentLast:
+				if partial == nil { // the head of record is lost
+					continue
+				}
+				partial.Write(buf)
+				if kind == fragmentLast {
+					list = append(list, partial)
+					partial = nil
+				}
+			}
+		}
+		if len(list) > 0 && !flog.consume(c, list) {
+			return
+		}
+
+		next++
+		// a record spanning blocks is read again from its first block after restart
+		readblock := next
+		if partial != nil {
+			readblock = partialAt
+		}
+		flog.commit(c, readblock)
+	}
+}
+
+// consume pass records to the subscriber, retry with backoff if it fails.
+// it returns false if the log is closed or the consumer is unsubscribed
+func (flog *FileLog) consume(c *consumer, list []*bytes.Buffer) bool {
+	backoff := flog.retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := c.fn(list)
+		if err == nil {
+			return true
+		}
+		flog.Lock()
+		c.stats.Retries++
+		c.stats.LastError = err.Error()
+		lag := flog.writeblock - c.readblock
+		flog.Unlock()
+		if attempt >= flog.maxRetries {
+			flog.log.Error("consume failed, records are dead", logger.F("consumer", c.name), logger.F("attempts", attempt),
+				logger.F("records", len(list)), logger.Err(err))
+			if err := flog.deadLetter(c, list); err != nil {
+				flog.log.Error("write dead letters failed", logger.F("consumer", c.name), logger.Err(err))
+			}
+			return true
+		}
+		flog.log.Warn("consume failed", logger.F("consumer", c.name), logger.F("attempt", attempt), logger.F("lag", lag),
+			logger.F("retry_in", backoff), logger.Err(err))
+		if !flog.sleep(c, backoff) {
+			return false
+		}
+		backoff *= 2
+		if backoff > flog.maxBackoff {
+			backoff = flog.maxBackoff
+		}
+	}
+}
+
+// deadLetter append records to the dead letter file <name>.dead, every record is
+// / 4 byte length / data /
+func (flog *FileLog) deadLetter(c *consumer, list []*bytes.Buffer) error {
+	f, err := os.OpenFile(filepath.Join(flog.dir, c.name+deadLetterExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, buf := range list {
+		if err := writeRecordTo(f, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	flog.Lock()
+	c.stats.DeadLetters += uint64(len(list))
+	flog.Unlock()
+	return f.Sync()
+}
+
+// consumerStats stats of consumers ordered by name, it must be called with the lock
+func (flog *FileLog) consumerStats() []ConsumerStats {
+	list := make([]ConsumerStats, 0, len(flog.consumers))
+	for _, c := range flog.consumers {
+		stats := c.stats
+		stats.Name = c.name
+		stats.ReadBlock = c.readblock
+		stats.Lag = flog.writeblock - c.readblock
+		stats.Active = c.fn != nil
+		stats.Stale = flog.stale(c)
+		list = append(list, stats)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// sleep return false if the log is closed or the consumer is unsubscribed in the duration
+func (flog *FileLog) sleep(c *consumer, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-flog.quit:
+		return false
+	case <-c.quit:
+		return false
+	}
+}
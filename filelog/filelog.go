@@ -4,15 +4,24 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"log"
+	"io"
 	"os"
+	"sort"
 	"sync"
 	"time"
+
+	"github.com/ws-cluster/logger"
 )
 
 const (
 	// blockSize = 1024
 	blockSize = 4 * 1024
+
+	defaultSegmentSize = 64 * 1024 * 1024
+
+	defaultMaxRetries   = 10
+	defaultRetryBackoff = time.Second
+	defaultMaxBackoff   = time.Minute
 )
 
 var (
@@ -27,290 +36,560 @@ var (
 	errNoMoreBlock      = errors.New("no more block")
 	errBlockWriteOnly   = errors.New("block is write only")
 	errBlockReadOnly    = errors.New("block is read only")
+	errClosed           = errors.New("filelog is closed")
+	errBlockDeleted     = errors.New("block is deleted")
+	errInvalidConsumer  = errors.New("invalid consumer name")
+	errNilConsumer      = errors.New("consumer func is nil")
+	errConsumerExists   = errors.New("consumer is subscribed")
+	errConsumerNoFound  = errors.New("consumer no found")
 )
 
-const (
-	blockModeRead  = uint8(1)
-	blockModeWrite = uint8(2)
-)
+// retainInterval how often segments are checked for deletion
+var retainInterval = 10 * time.Second
 
-// Block log Block
-type Block struct {
-	buf    []byte //block 数据
-	offset uint16 // 读/写 偏移
-	cap    uint16 // 容量
-	length uint16 //record count
-	mode   uint8  // 1:read 2:write
+type writeLog struct {
+	bytes []byte
+	err   chan error
 }
 
-// block 一个 blocke只能读或者写
-func newBlock(b []byte, mode uint8) *Block {
-	if b == nil || len(b) == 0 {
-		return nil
-	}
-	cap := uint16(len(b))
-	length := littleEndian.Uint16(b[0:2])
+// SyncPolicy when the file is synced to disk
+type SyncPolicy uint8
 
-	return &Block{
-		buf:    b,
-		offset: 2,
-		cap:    cap,
-		length: length,
-		mode:   mode,
-	}
-}
+const (
+	// SyncNever leave it to the operating system
+	SyncNever = SyncPolicy(0)
+	// SyncAlways a write returns after it is synced
+	SyncAlways = SyncPolicy(1)
+	// SyncInterval sync in every SyncInterval
+	SyncInterval = SyncPolicy(2)
+)
 
-func (block *Block) writeUint16(val uint16, offset uint16) {
-	bbuf := make([]byte, 2)
-	littleEndian.PutUint16(bbuf, val)
-	copy(block.buf[offset:], bbuf)
+// FileLog 用于记录数据, blocks are written to segment files in Dir
+type FileLog struct {
+	sync.Mutex
+	dir          string
+	writeblock   int
+	segments     []*segment // ordered by base, the last one is written
+	consumers    map[string]*consumer
+	writelog     chan writeLog
+	sync         SyncPolicy
+	syncInterval time.Duration
+
+	segmentBlocks int
+	segmentAge    time.Duration
+	retentionAge  time.Duration
+	retentionSize int64
+	keepConsumed  bool
+	maxLagBlocks  int
+
+	maxRetries   int
+	retryBackoff time.Duration
+	maxBackoff   time.Duration
+
+	log       *logger.Logger
+	quit      chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	waitGroup sync.WaitGroup
 }
 
-func (block *Block) readUint16(offset uint16) uint16 {
-	lbuf := block.buf[offset : offset+2]
-	return littleEndian.Uint16(lbuf)
+// Config Config
+type Config struct {
+	// Dir directory of segment files
+	Dir string
+	// Legacy a single file log written by older versions, its unconsumed blocks
+	// are moved into Dir and then it is removed
+	Legacy string
+	// SubFunc consume records as the consumer DefaultConsumer, more consumers are added by Subscribe
+	SubFunc      func(log []*bytes.Buffer) error
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// SegmentSize a new segment is started if the written one reaches the size
+	SegmentSize int64
+	// SegmentAge a new segment is started if the written one is older, 0 means no limit
+	SegmentAge time.Duration
+	// RetentionAge segments not written in the duration are deleted even if they are not consumed,
+	// 0 means no limit
+	RetentionAge time.Duration
+	// RetentionSize the oldest segments are deleted while the total size exceeds it,
+	// even if they are not consumed, 0 means no limit
+	RetentionSize int64
+	// KeepConsumed consumed segments are retained for replay until RetentionAge or RetentionSize
+	KeepConsumed bool
+	// ConsumerMaxLag the log is no longer retained for a consumer whose unconsumed blocks exceed the size,
+	// so a stalled or abandoned consumer can't fill the disk, 0 means no limit
+	ConsumerMaxLag int64
+	// MaxRetries attempts to consume a block before its records are written to the dead letter file
+	// <consumer>.dead in Dir
+	MaxRetries int
+	// RetryBackoff the first wait after a failed attempt, it is doubled up to MaxBackoff
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// Logger defaults to the logger of subsystem filelog with Dir
+	Logger *logger.Logger
 }
 
-func (block *Block) write(b []byte) error {
-	if block.mode != blockModeWrite {
-		return errBlockWriteOnly
+// NewFileLog 根据目录创建一个 FileLog
+func NewFileLog(config *Config) (*FileLog, error) {
+	if err := os.MkdirAll(config.Dir, os.ModePerm); err != nil {
+		return nil, err
 	}
-	blen := uint16(len(b))
-	if block.cap-block.offset < blen+2 {
-		return errBlockLackOfSpace
+	fl := &FileLog{
+		dir:          config.Dir,
+		consumers:    make(map[string]*consumer),
+		writelog:     make(chan writeLog),
+		sync:         config.Sync,
+		syncInterval: config.SyncInterval,
+
+		segmentBlocks: int(config.SegmentSize / blockSize),
+		segmentAge:    config.SegmentAge,
+		retentionAge:  config.RetentionAge,
+		retentionSize: config.RetentionSize,
+		keepConsumed:  config.KeepConsumed,
+		maxLagBlocks:  int(config.ConsumerMaxLag / blockSize),
+
+		maxRetries:   config.MaxRetries,
+		retryBackoff: config.RetryBackoff,
+		maxBackoff:   config.MaxBackoff,
+
+		log:  config.Logger,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
 	}
-	block.writeUint16(blen, block.offset)
-	block.offset += 2
-
-	copy(block.buf[block.offset:], b)
-	block.offset += blen
-	block.length++
-	block.writeUint16(block.length, 0)
-	return nil
-}
-
-func (block *Block) read() ([]byte, error) {
-	if block.mode != blockModeRead {
-		return nil, errBlockReadOnly
+	if fl.log == nil {
+		fl.log = logger.New("filelog").With(logger.F("dir", config.Dir))
 	}
-	if block.offset >= block.cap || block.length == 0 {
-		return nil, errBlockEmpty
+	if fl.sync == SyncInterval && fl.syncInterval <= 0 {
+		fl.syncInterval = time.Second
 	}
-
-	blen := block.readUint16(block.offset)
-	block.offset += 2
-
-	if blen == 0 {
-		return nil, errBlockEmpty
+	if fl.segmentBlocks <= 0 {
+		fl.segmentBlocks = defaultSegmentSize / blockSize
+	}
+	if fl.maxRetries <= 0 {
+		fl.maxRetries = defaultMaxRetries
+	}
+	if fl.retryBackoff <= 0 {
+		fl.retryBackoff = defaultRetryBackoff
+	}
+	if fl.maxBackoff < fl.retryBackoff {
+		fl.maxBackoff = defaultMaxBackoff
+	}
+	if err := fl.open(config.Legacy); err != nil {
+		fl.closeFiles()
+		return nil, err
+	}
+	fl.waitGroup.Add(1)
+	go fl.retainloop()
+	go fl.writeloop()
+	if config.SubFunc != nil {
+		if err := fl.Subscribe(DefaultConsumer, config.SubFunc); err != nil {
+			fl.Close()
+			return nil, err
+		}
 	}
-	buf := make([]byte, blen)
-	copy(buf, block.buf[block.offset:])
-	block.offset += blen
-
-	block.length--
-	block.writeUint16(block.length, 0)
-
-	return buf, nil
-}
-
-// 返回一个block.size 长度的数组，
-func (block *Block) bytes() []byte {
-	return block.buf
-}
-
-func (block *Block) reset() {
-	block.offset = 2
-	block.length = 0
-	block.writeUint16(block.length, 0)
-}
-
-func (block *Block) hasSpace(space uint16) bool {
-	return block.cap-block.offset >= space
-}
 
-type writeLog struct {
-	bytes []byte
-	err   chan error
+	return fl, nil
 }
 
-// FileLog 用于记录数据
-type FileLog struct {
-	sync.Mutex
-	writeblock int
-	readblock  int
-	file       *os.File
-	writelog   chan writeLog
-	sub        func(log []*bytes.Buffer) error
-	quit       chan struct{}
+// open load consumers and segments, recover the last segment which may be torn by a crash,
+// then import the legacy single file log
+func (flog *FileLog) open(legacy string) error {
+	if err := flog.loadConsumers(); err != nil {
+		return err
+	}
+	segs, err := openSegments(flog.dir, os.O_RDWR)
+	if err != nil {
+		return err
+	}
+	flog.segments = segs
+	if len(segs) == 0 {
+		// continue from the offsets if all segments are deleted
+		base := 0
+		for _, c := range flog.consumers {
+			if c.readblock > base {
+				base = c.readblock
+			}
+		}
+		seg, err := createSegment(flog.dir, base)
+		if err != nil {
+			return err
+		}
+		flog.segments = []*segment{seg}
+	} else if err := segs[len(segs)-1].recover(flog.log); err != nil {
+		return err
+	}
+	flog.writeblock = flog.active().end()
+	if legacy != "" {
+		if err := flog.importLegacy(legacy); err != nil {
+			return err
+		}
+	}
+	first := flog.segments[0].base
+	for _, c := range flog.consumers {
+		if c.readblock > flog.writeblock {
+			c.readblock = flog.writeblock
+		}
+		if c.readblock < first {
+			flog.log.Warn("blocks are deleted before consumed", logger.F("from", c.readblock), logger.F("to", first), logger.F("consumer", c.name))
+			c.readblock = first
+		}
+		if err := writeUint64(c.offsetFile, uint64(c.readblock), 0); err != nil {
+			return err
+		}
+	}
+	return syncDir(flog.dir)
 }
 
-// Config Config
-type Config struct {
-	File    string
-	SubFunc func(log []*bytes.Buffer) error
+func (flog *FileLog) closeFiles() {
+	closeSegments(flog.segments)
+	for _, c := range flog.consumers {
+		c.offsetFile.Close()
+	}
 }
 
-// NewFileLog 根据文件路径创建一个 FileLog
-func NewFileLog(config *Config) (*FileLog, error) {
-	// 此处不能设置为 os.O_APPEND 模式，否则在 docker offset 失效
-	f, err := os.OpenFile(config.File, os.O_CREATE|os.O_RDWR, os.ModePerm)
+// importLegacy move unconsumed blocks of a single file log into segments.
+// the file begins with the read and write block index, then blocks follow
+func (flog *FileLog) importLegacy(file string) error {
+	f, err := os.Open(file)
 	if err != nil {
-		return nil, err
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
 	}
+	readblock := int(readUint32(f, 0))
+	writeblock := int(readUint32(f, 4))
+	buf := make([]byte, blockSize)
+	imported := 0
+	for i := readblock; i < writeblock; i++ {
+		if _, err := f.ReadAt(buf, int64(i*blockSize+8)); err != nil || !checkBlock(buf) {
+			flog.log.Warn("block is corrupted", logger.F("file", file), logger.F("block", i), logger.F("dropped", writeblock-i))
+			break
+		}
+		if err := flog.appendBlock(buf); err != nil {
+			f.Close()
+			return err
+		}
+		imported++
+	}
+	f.Close()
+	if err := flog.active().file.Sync(); err != nil {
+		return err
+	}
+	if imported > 0 {
+		flog.log.Info("blocks are imported", logger.F("file", file), logger.F("blocks", imported))
+	}
+	return os.Remove(file)
+}
 
-	fl := &FileLog{
-		file:       f,
-		writelog:   make(chan writeLog),
-		sub:        config.SubFunc,
-		readblock:  int(readUint32(f, 0)),
-		writeblock: int(readUint32(f, 4)),
-		quit:       make(chan struct{}),
-	}
-	go fl.readloop()
-	go fl.writeloop()
-
-	return fl, nil
+func (flog *FileLog) active() *segment {
+	return flog.segments[len(flog.segments)-1]
 }
 
 // Pub 写一条信息到文件
 func (flog *FileLog) Write(log []byte) error {
-	errchan := make(chan error)
-	flog.writelog <- writeLog{log, errchan}
+	errchan := make(chan error, 1)
+	select {
+	case flog.writelog <- writeLog{log, errchan}:
+	case <-flog.done:
+		return errClosed
+	}
 	return <-errchan
 }
 
 func (flog *FileLog) writeloop() {
 	t := time.NewTicker(time.Second)
-	defer flog.file.Close()
+	defer t.Stop()
+	var syncC <-chan time.Time
+	if flog.sync == SyncInterval {
+		syncTicker := time.NewTicker(flog.syncInterval)
+		defer syncTicker.Stop()
+		syncC = syncTicker.C
+	}
 	block := newBlock(make([]byte, blockSize), blockModeWrite)
 	for {
 		select {
 		case wlog := <-flog.writelog:
-			if !block.hasSpace(uint16(len(wlog.bytes) + 2)) {
-				// log.Println("append block to file, logs ", block.length)
-				err := flog.appendBlock(block.bytes())
-				if err != nil {
-					log.Println(err)
+			if flog.sync != SyncAlways {
+				wlog.err <- flog.writeRecord(block, wlog.bytes)
+				continue
+			}
+			// group commit: write all waiting records, then sync them at once
+			pending := []writeLog{wlog}
+			errs := []error{flog.writeRecord(block, wlog.bytes)}
+		Drain:
+			for {
+				select {
+				case more := <-flog.writelog:
+					pending = append(pending, more)
+					errs = append(errs, flog.writeRecord(block, more.bytes))
+				default:
+					break Drain
 				}
-				block.reset()
 			}
-			err := block.write(wlog.bytes)
-			wlog.err <- err
-		case <-t.C:
-			if block.length > 0 {
-				// log.Println("append block to file, logs ", block.length)
-				err := flog.appendBlock(block.bytes())
-				if err != nil {
-					log.Println(err)
+			err := flog.flushBlock(block)
+			if err == nil {
+				err = flog.syncFile()
+			}
+			for i, wlog := range pending {
+				if errs[i] == nil {
+					errs[i] = err
 				}
-				block.reset()
+				wlog.err <- errs[i]
+			}
+		case <-t.C:
+			if err := flog.flushBlock(block); err != nil {
+				flog.log.Error("flush failed", logger.Err(err))
+			}
+			if err := flog.rotateAged(); err != nil {
+				flog.log.Error("rotate failed", logger.Err(err))
+			}
+		case <-syncC:
+			if err := flog.syncFile(); err != nil {
+				flog.log.Error("sync failed", logger.Err(err))
 			}
-			// log.Println(readUint32(flog.file, 0), readUint32(flog.file, 4))
 		case <-flog.quit:
+			if err := flog.flushBlock(block); err != nil {
+				flog.log.Error("flush failed", logger.Err(err))
+			}
+			if err := flog.syncFile(); err != nil {
+				flog.log.Error("sync failed", logger.Err(err))
+			}
+			// the consumers and the retention may still read segments,
+			// no consumer is subscribed after the lock is released
+			flog.Lock()
+			flog.Unlock()
+			flog.waitGroup.Wait()
+			flog.Lock()
+			flog.closeFiles()
+			flog.Unlock()
+			close(flog.done)
 			return
 		}
 	}
 }
 
-func (flog *FileLog) appendBlock(b []byte) error {
+func (flog *FileLog) syncFile() error {
+	if flog.sync == SyncNever {
+		return nil
+	}
 	flog.Lock()
-	// 文件头8字节用于记录读写偏移量
-	offset := flog.writeblock*blockSize + 8
-	_, err := flog.file.WriteAt(b, int64(offset))
-	if err != nil {
-		flog.Unlock()
-		return err
+	defer flog.Unlock()
+	return flog.active().file.Sync()
+}
+
+// writeRecord write a record to block, a record larger than a block is split into fragments
+// in consecutive blocks
+func (flog *FileLog) writeRecord(block *Block, record []byte) error {
+	rlen := len(record)
+	// don't split a record which fits in an empty block
+	if block.free() < rlen && rlen <= blockSize-blockHeadSize-fragmentHeaderSize || block.free() <= 0 {
+		if err := flog.flushBlock(block); err != nil {
+			return err
+		}
 	}
-	flog.writeblock++
-	err = writeUint32(flog.file, uint32(flog.writeblock), 4)
+	if block.free() >= rlen {
+		return block.write(fragmentFull, record)
+	}
+	for written := 0; written < rlen; {
+		n := block.free()
+		if n > rlen-written {
+			n = rlen - written
+		}
+		kind := fragmentMiddle
+		if written == 0 {
+			kind = fragmentFirst
+		} else if written+n == rlen {
+			kind = fragmentLast
+		}
+		if err := block.write(kind, record[written:written+n]); err != nil {
+			return err
+		}
+		written += n
+		if written < rlen {
+			if err := flog.flushBlock(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	flog.Unlock()
-	if err != nil {
-		return err
+// flushBlock append the block to file and reset it
+func (flog *FileLog) flushBlock(block *Block) error {
+	if block.length == 0 {
+		return nil
 	}
-	// bs, _ := ioutil.ReadFile(flog.file.Name())
-	// fmt.Println(bs)
+	err := flog.appendBlock(block.bytes())
+	block.reset()
+	return err
+}
 
+func (flog *FileLog) appendBlock(b []byte) error {
+	flog.Lock()
+	defer flog.Unlock()
+	if flog.active().blocks >= flog.segmentBlocks {
+		if err := flog.rotate(); err != nil {
+			return err
+		}
+	}
+	if err := flog.active().writeBlock(b); err != nil {
+		return err
+	}
+	flog.writeblock++
 	return nil
 }
 
-func (flog *FileLog) nextBlock() bool {
+// rotateAged start a new segment if the written one is older than segmentAge
+func (flog *FileLog) rotateAged() error {
+	if flog.segmentAge <= 0 {
+		return nil
+	}
 	flog.Lock()
-	if flog.readblock == flog.writeblock {
-		flog.Unlock()
-		return false
+	defer flog.Unlock()
+	seg := flog.active()
+	if seg.blocks == 0 || time.Since(seg.created) < flog.segmentAge {
+		return nil
 	}
-	flog.Unlock()
-	return true
+	return flog.rotate()
 }
 
-func (flog *FileLog) getBlock() ([]byte, error) {
+// rotate seal the written segment and start a new one, it must be called with the lock
+func (flog *FileLog) rotate() error {
+	if flog.sync != SyncNever {
+		if err := flog.active().file.Sync(); err != nil {
+			return err
+		}
+	}
+	seg, err := createSegment(flog.dir, flog.writeblock)
+	if err != nil {
+		return err
+	}
+	flog.segments = append(flog.segments, seg)
+	if flog.sync != SyncNever {
+		return syncDir(flog.dir)
+	}
+	return nil
+}
+
+// readBlock read the block at index, it returns errNoMoreBlock if the block is not written yet,
+// or errBlockDeleted if the segment of it is deleted
+func (flog *FileLog) readBlock(index int) ([]byte, error) {
 	flog.Lock()
-	if flog.readblock == flog.writeblock {
-		flog.Unlock()
+	defer flog.Unlock()
+	if index >= flog.writeblock {
 		return nil, errNoMoreBlock
 	}
+	if index < flog.segments[0].base {
+		return nil, errBlockDeleted
+	}
 	// 从文件中读取一个块
-	offset := flog.readblock*blockSize + 8
-
+	i := sort.Search(len(flog.segments), func(i int) bool { return flog.segments[i].end() > index })
 	buf := make([]byte, blockSize)
-	_, err := flog.file.ReadAt(buf, int64(offset))
-	if err != nil {
+	if err := flog.segments[i].readBlock(index, buf); err != nil {
 		return nil, err
 	}
-
-	// 读取之后无论处理是否成功不再重读，否则可能因为处理失败卡死在某个 block 中
-	flog.readblock++
-	if flog.readblock == flog.writeblock {
-		flog.readblock = 0
-		flog.writeblock = 0
-		writeUint32(flog.file, 0, 4)
-
-		flog.file.Truncate(8)
-		// log.Println("filelog truncate to 8 bytes")
-	}
-	writeUint32(flog.file, uint32(flog.readblock), 0)
-	flog.Unlock()
 	return buf, nil
 }
 
-func (flog *FileLog) readloop() {
+// retainloop delete segments in background
+func (flog *FileLog) retainloop() {
+	defer flog.waitGroup.Done()
+	t := time.NewTicker(retainInterval)
+	defer t.Stop()
 	for {
-		if !flog.nextBlock() {
-			time.Sleep(time.Millisecond * 300)
-			continue
-		}
-		blockbuf, err := flog.getBlock()
-		if err != nil {
-			log.Println(err)
-			time.Sleep(time.Millisecond * 300)
-			continue
+		select {
+		case <-t.C:
+			flog.retain()
+		case <-flog.quit:
+			return
 		}
+	}
+}
 
-		block := newBlock(blockbuf, blockModeRead)
-
-		blockLength := block.length
-		list := make([]*bytes.Buffer, blockLength)
-
-		for i := uint16(0); i < blockLength; i++ {
-			buf, err := block.read()
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			list[i] = bytes.NewBuffer(buf)
+// retain delete the oldest segments which are consumed by all consumers, unless keepConsumed,
+// or are out of the retention. The written segment is never deleted.
+func (flog *FileLog) retain() {
+	flog.Lock()
+	defer flog.Unlock()
+	var total int64
+	for _, seg := range flog.segments {
+		total += seg.size()
+	}
+	minRead, hasConsumer := flog.minReadBlock()
+	minRetained, hasRetained := flog.minRetainedBlock()
+	deleted := 0
+	for len(flog.segments) > 1 {
+		seg := flog.segments[0]
+		// the log isn't retained for stale consumers, even if all of them are stale
+		consumed := hasConsumer && (!hasRetained || seg.end() <= minRetained)
+		expired := flog.retentionAge > 0 && time.Since(seg.modAt) > flog.retentionAge
+		oversize := flog.retentionSize > 0 && total > flog.retentionSize
+		if !(consumed && !flog.keepConsumed) && !expired && !oversize {
+			break
+		}
+		if hasConsumer && seg.end() > minRead {
+			flog.log.Warn("segment is deleted by retention before consumed", logger.F("segment", seg.base))
 		}
-		if err := flog.sub(list); err != nil {
-			log.Println(err)
-			time.Sleep(time.Second)
-			continue
+		if err := seg.remove(); err != nil {
+			flog.log.Error("remove segment failed", logger.F("segment", seg.base), logger.Err(err))
 		}
+		total -= seg.size()
+		flog.segments = flog.segments[1:]
+		deleted++
 	}
+	if deleted == 0 {
+		return
+	}
+	first := flog.segments[0].base
+	for _, c := range flog.consumers {
+		if c.readblock < first {
+			c.readblock = first
+			if err := writeUint64(c.offsetFile, uint64(first), 0); err != nil {
+				flog.log.Error("commit offset failed", logger.F("consumer", c.name), logger.Err(err))
+			}
+		}
+	}
+	if err := syncDir(flog.dir); err != nil {
+		flog.log.Error("sync dir failed", logger.Err(err))
+	}
+}
+
+// Stats state of a FileLog
+type Stats struct {
+	FirstBlock int // the oldest retained block
+	WriteBlock int
+	Lag        int   // blocks not consumed by the slowest consumer
+	Segments   int   // count of segment files
+	Size       int64 // total size of segments
+	Consumers  []ConsumerStats
+}
+
+// Stats return the state of log and consumers
+func (flog *FileLog) Stats() Stats {
+	flog.Lock()
+	defer flog.Unlock()
+	stats := Stats{
+		FirstBlock: flog.segments[0].base,
+		WriteBlock: flog.writeblock,
+		Segments:   len(flog.segments),
+		Consumers:  flog.consumerStats(),
+	}
+	if minRead, has := flog.minReadBlock(); has {
+		stats.Lag = flog.writeblock - minRead
+	}
+	for _, seg := range flog.segments {
+		stats.Size += seg.size()
+	}
+	return stats
 }
 
-// Close Close
+// Close flush pending records, sync and close the file
 func (flog *FileLog) Close() {
-	flog.quit <- struct{}{}
+	flog.closeOnce.Do(func() {
+		close(flog.quit)
+	})
+	<-flog.done
 }
 
 func readUint32(file *os.File, offset int64) uint32 {
@@ -325,6 +604,28 @@ func readUint32(file *os.File, offset int64) uint32 {
 	return 0
 }
 
+func readUint64(file *os.File, offset int64) uint64 {
+	buf := make([]byte, 8)
+	if _, err := file.ReadAt(buf, offset); err != nil {
+		return 0
+	}
+	return littleEndian.Uint64(buf)
+}
+
+func writeUint64(file *os.File, val uint64, offset int64) error {
+	buf := make([]byte, 8)
+	littleEndian.PutUint64(buf, val)
+	_, err := file.WriteAt(buf, offset)
+	return err
+}
+
+func writeRecordTo(w io.Writer, record []byte) error {
+	buf := make([]byte, 4, 4+len(record))
+	littleEndian.PutUint32(buf, uint32(len(record)))
+	_, err := w.Write(append(buf, record...))
+	return err
+}
+
 func writeUint32(file *os.File, val uint32, offset int64) error {
 	buf := make([]byte, 4)
 	littleEndian.PutUint32(buf, val)
@@ -2,19 +2,15 @@ package filelog
 
 import (
 	"bytes"
-	"fmt"
-	"log"
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
 func sub(logs []*bytes.Buffer) error {
-	fmt.Println("sub ", len(logs))
-	// for index := 0; index < len(logs); index++ {
-	// 	fmt.Println(logs[index].Bytes())
-	// }
-	// time.Sleep(time.Millisecond * 300)
 	return nil
 }
 
@@ -22,13 +18,15 @@ func TestNewFileLog(t *testing.T) {
 	quit := make(chan bool)
 	msgCount := 50000
 	recv := 0
-	tempfile := fmt.Sprintf("./%v.log", "test")
-	// tempfile := fmt.Sprintf("./%v.log", time.Now().Unix())
+	tempdir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
 	filelog, err := NewFileLog(&Config{
-		File: tempfile,
+		Dir: tempdir,
 		SubFunc: func(logs []*bytes.Buffer) error {
 			recv += len(logs)
-			log.Println("recv:", recv)
 			if recv == msgCount {
 				quit <- true
 			}
@@ -37,8 +35,9 @@ func TestNewFileLog(t *testing.T) {
 		},
 	})
 	if err != nil {
-		return
+		t.Fatal(err)
 	}
+	defer filelog.Close()
 
 	go func() {
 		for index := 0; index < msgCount; index++ {
@@ -51,10 +50,617 @@ func TestNewFileLog(t *testing.T) {
 	}()
 
 	<-quit
-	// os.Remove(tempfile)
-	// time.Sleep(time.Second * 1)
-	// bbs, _ := ioutil.ReadFile(tempfile)
-	// log.Println(bbs)
-	lfile, _ := os.Open(tempfile)
-	log.Println(readUint32(lfile, 0), readUint32(lfile, 4))
+}
+
+func TestFileLog_LargeRecord(t *testing.T) {
+	tempdir := "./large.log"
+	defer os.RemoveAll(tempdir)
+
+	sizes := []int{10, blockSize - 7, blockSize, 3*blockSize + 100, 20, 64 * 1024}
+	records := make(chan []byte, len(sizes))
+	filelog, err := NewFileLog(&Config{
+		Dir: tempdir,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+
+	for i, size := range sizes {
+		record := bytes.Repeat([]byte{byte(i + 1)}, size)
+		if err := filelog.Write(record); err != nil {
+			t.Fatalf("write record of %v bytes: %v", size, err)
+		}
+	}
+
+	for i, size := range sizes {
+		select {
+		case record := <-records:
+			if !bytes.Equal(record, bytes.Repeat([]byte{byte(i + 1)}, size)) {
+				t.Errorf("record %v: got %v bytes, want %v bytes", i, len(record), size)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("record %v of %v bytes no received", i, size)
+		}
+	}
+}
+
+func TestBlock_ReadLegacy(t *testing.T) {
+	// a block written by an old version
+	buf := make([]byte, blockSize)
+	littleEndian.PutUint16(buf[0:], 2)
+	littleEndian.PutUint16(buf[2:], 3)
+	copy(buf[4:], "abc")
+	littleEndian.PutUint16(buf[7:], 2)
+	copy(buf[9:], "de")
+
+	block := newBlock(buf, blockModeRead)
+	for _, want := range []string{"abc", "de"} {
+		kind, record, err := block.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kind != fragmentFull || string(record) != want {
+			t.Errorf("Block.read() = %v %q, want %q", kind, record, want)
+		}
+	}
+	if _, _, err := block.read(); err != errBlockEmpty {
+		t.Errorf("Block.read() error = %v, want %v", err, errBlockEmpty)
+	}
+}
+
+// writeBlocks write records of 1000 bytes without consuming them, 4 records fill a block
+func writeBlocks(t *testing.T, dir string, records int) {
+	filelog, err := NewFileLog(&Config{Dir: dir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < records; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filelog.Close()
+}
+
+func readAll(t *testing.T, dir string) (*FileLog, [][]byte) {
+	records := make(chan []byte, 100)
+	filelog, err := NewFileLog(&Config{
+		Dir: dir,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]byte
+	for {
+		select {
+		case record := <-records:
+			got = append(got, record)
+		case <-time.After(time.Second):
+			return filelog, got
+		}
+	}
+}
+
+func TestFileLog_RecoverTruncated(t *testing.T) {
+	tempdir := "./truncated.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	writeBlocks(t, tempdir, 3)
+	// every write is synced in its own block, the last block is torn by a crash
+	segfile := segmentName(tempdir, 0)
+	info, _ := os.Stat(segfile)
+	if err := os.Truncate(segfile, info.Size()-100); err != nil {
+		t.Fatal(err)
+	}
+
+	filelog, got := readAll(t, tempdir)
+	defer filelog.Close()
+	if len(got) != 2 {
+		t.Fatalf("recovered %v records, want 2", len(got))
+	}
+	for i, record := range got {
+		if !bytes.Equal(record, bytes.Repeat([]byte{byte(i)}, 1000)) {
+			t.Errorf("record %v is broken", i)
+		}
+	}
+}
+
+func TestFileLog_RecoverCorrupted(t *testing.T) {
+	tempdir := "./corrupted.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	writeBlocks(t, tempdir, 4)
+	// flip a byte in the third block
+	segfile := segmentName(tempdir, 0)
+	f, err := os.OpenFile(segfile, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, 2*blockSize+100)
+	f.Close()
+
+	filelog, got := readAll(t, tempdir)
+	defer filelog.Close()
+	if len(got) != 2 {
+		t.Fatalf("recovered %v records, want 2", len(got))
+	}
+	filelog.Lock()
+	defer filelog.Unlock()
+	if info, _ := os.Stat(segfile); info.Size() > 2*blockSize {
+		t.Errorf("file size %v, the corrupted blocks are not truncated", info.Size())
+	}
+}
+
+func TestFileLog_Retry(t *testing.T) {
+	tempdir := "./retry.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	writeBlocks(t, tempdir, 2)
+	attempts := 0
+	records := make(chan []byte, 10)
+	filelog, err := NewFileLog(&Config{
+		Dir:          tempdir,
+		RetryBackoff: time.Millisecond * 10,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			attempts++
+			if attempts < 3 {
+				return errors.New("database is down")
+			}
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case record := <-records:
+			if !bytes.Equal(record, bytes.Repeat([]byte{byte(i)}, 1000)) {
+				t.Errorf("record %v is broken", i)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("record %v is not consumed", i)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	filelog.Close()
+	stats := filelog.Stats().Consumers[0]
+	if stats.Retries != 2 || stats.Lag != 0 || stats.LastError != "database is down" {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestFileLog_Uncommitted(t *testing.T) {
+	tempdir := "./uncommitted.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	writeBlocks(t, tempdir, 2)
+	// the subscriber never succeeds, the log is closed before records are dead
+	filelog, err := NewFileLog(&Config{
+		Dir:          tempdir,
+		RetryBackoff: time.Millisecond * 10,
+		MaxRetries:   1000,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			return errors.New("database is down")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	filelog.Close()
+
+	filelog, got := readAll(t, tempdir)
+	defer filelog.Close()
+	if len(got) != 2 {
+		t.Fatalf("redelivered %v records, want 2", len(got))
+	}
+}
+
+func TestFileLog_DeadLetter(t *testing.T) {
+	tempdir := "./deadletter.log"
+	deadfile := filepath.Join(tempdir, DefaultConsumer+deadLetterExt)
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	writeBlocks(t, tempdir, 2)
+	filelog, err := NewFileLog(&Config{
+		Dir:          tempdir,
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond * 10,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			return errors.New("bad record")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	filelog.Close()
+	if stats := filelog.Stats().Consumers[0]; stats.DeadLetters != 2 || stats.Lag != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+
+	data, err := ioutil.ReadFile(deadfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if len(data) < 4 {
+			t.Fatalf("dead letter %v is missing", i)
+		}
+		size := littleEndian.Uint32(data)
+		if !bytes.Equal(data[4:4+size], bytes.Repeat([]byte{byte(i)}, 1000)) {
+			t.Errorf("dead letter %v is broken", i)
+		}
+		data = data[4+size:]
+	}
+}
+
+func TestFileLog_Retention(t *testing.T) {
+	tempdir := "./retention.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	records := make(chan []byte, 100)
+	filelog, err := NewFileLog(&Config{
+		Dir:         tempdir,
+		Sync:        SyncAlways,
+		SegmentSize: 2 * blockSize,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	// every record is synced in its own block
+	for i := 0; i < 5; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-records:
+		case <-time.After(time.Second * 3):
+			t.Fatalf("record %v is not consumed", i)
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+	if stats := filelog.Stats(); stats.Segments != 3 {
+		t.Fatalf("Stats() = %+v, want 3 segments", stats)
+	}
+	filelog.retain()
+	stats := filelog.Stats()
+	if stats.Segments != 1 || stats.FirstBlock != 4 || stats.Consumers[0].ReadBlock != 5 {
+		t.Errorf("Stats() = %+v, want the written segment only", stats)
+	}
+	if _, err := os.Stat(segmentName(tempdir, 0)); !os.IsNotExist(err) {
+		t.Errorf("consumed segment is not deleted")
+	}
+}
+
+func TestFileLog_RetentionSize(t *testing.T) {
+	tempdir := "./retentionsize.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	// the consumer is stalled, retention forces out the oldest segments
+	filelog, err := NewFileLog(&Config{
+		Dir:           tempdir,
+		Sync:          SyncAlways,
+		SegmentSize:   2 * blockSize,
+		RetentionSize: 3 * blockSize,
+		MaxRetries:    1000,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			return errors.New("database is down")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filelog.retain()
+	stats := filelog.Stats()
+	filelog.Close()
+	if stats.Segments != 1 || stats.Size != 2*blockSize || stats.Consumers[0].ReadBlock != 4 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+
+	// the offset is moved to the first retained block
+	filelog, got := readAll(t, tempdir)
+	defer filelog.Close()
+	if len(got) != 2 || got[0][0] != 4 {
+		t.Fatalf("read %v records after retention, want 2", len(got))
+	}
+}
+
+func TestFileLog_ConsumerMaxLag(t *testing.T) {
+	tempdir := "./consumermaxlag.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	filelog, err := NewFileLog(&Config{
+		Dir:            tempdir,
+		Sync:           SyncAlways,
+		SegmentSize:    2 * blockSize,
+		ConsumerMaxLag: 3 * blockSize,
+		MaxRetries:     1000,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	// a consumer which never commits
+	if err := filelog.Subscribe("stalled", func(logs []*bytes.Buffer) error {
+		return errors.New("index is broken")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for filelog.Stats().Consumers[0].Lag > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	stats := filelog.Stats()
+	if c := stats.Consumers[1]; c.Name != "stalled" || !c.Stale || c.ReadBlock != 0 {
+		t.Fatalf("stalled consumer %+v", c)
+	}
+	if c := stats.Consumers[0]; c.Stale || c.Lag != 0 {
+		t.Fatalf("default consumer %+v", c)
+	}
+
+	filelog.retain()
+	stats = filelog.Stats()
+	if stats.Segments != 1 || stats.FirstBlock != 4 || stats.Consumers[1].ReadBlock != 4 {
+		t.Errorf("Stats() = %+v, segments consumed by the other consumer are retained for a stale one", stats)
+	}
+}
+
+func TestFileLog_KeepConsumed(t *testing.T) {
+	tempdir := "./keepconsumed.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	records := make(chan []byte, 100)
+	filelog, err := NewFileLog(&Config{
+		Dir:          tempdir,
+		Sync:         SyncAlways,
+		SegmentSize:  blockSize,
+		KeepConsumed: true,
+		RetentionAge: time.Hour,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	for i := 0; i < 3; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		<-records
+	}
+	time.Sleep(time.Millisecond * 100)
+	filelog.retain()
+	if stats := filelog.Stats(); stats.Segments != 3 || stats.Lag != 0 {
+		t.Errorf("Stats() = %+v, consumed segments are not kept", stats)
+	}
+}
+
+func TestFileLog_ImportLegacy(t *testing.T) {
+	tempdir := "./legacy.log"
+	legacy := "./legacy-message.log"
+	defer os.RemoveAll(tempdir)
+	defer os.Remove(legacy)
+	os.RemoveAll(tempdir)
+
+	// a legacy log of 3 blocks, the first one is consumed
+	f, err := os.Create(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		block := newBlock(make([]byte, blockSize), blockModeWrite)
+		block.write(fragmentFull, bytes.Repeat([]byte{byte(i)}, 1000))
+		f.WriteAt(block.bytes(), int64(8+i*blockSize))
+	}
+	writeUint32(f, 1, 0)
+	writeUint32(f, 3, 4)
+	f.Close()
+
+	records := make(chan []byte, 100)
+	filelog, err := NewFileLog(&Config{
+		Dir:    tempdir,
+		Legacy: legacy,
+		SubFunc: func(logs []*bytes.Buffer) error {
+			for _, buf := range logs {
+				records <- buf.Bytes()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	for i := 1; i < 3; i++ {
+		select {
+		case record := <-records:
+			if !bytes.Equal(record, bytes.Repeat([]byte{byte(i)}, 1000)) {
+				t.Errorf("record %v is broken", i)
+			}
+		case <-time.After(time.Second * 3):
+			t.Fatalf("record %v is not imported", i)
+		}
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("legacy file is not removed")
+	}
+}
+
+func TestFileLog_Subscribe(t *testing.T) {
+	tempdir := "./subscribe.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	filelog, err := NewFileLog(&Config{Dir: tempdir, Sync: SyncAlways, SegmentSize: blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := filelog.Subscribe("bad name", sub); err != errInvalidConsumer {
+		t.Errorf("Subscribe() error = %v, want %v", err, errInvalidConsumer)
+	}
+	fast := make(chan []byte, 100)
+	if err := filelog.Subscribe("fast", func(logs []*bytes.Buffer) error {
+		for _, buf := range logs {
+			fast <- buf.Bytes()
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := filelog.Subscribe("fast", sub); err != errConsumerExists {
+		t.Errorf("Subscribe() error = %v, want %v", err, errConsumerExists)
+	}
+	// the slow consumer never succeeds
+	if err := filelog.Subscribe("slow", func(logs []*bytes.Buffer) error {
+		return errors.New("stalled")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+		<-fast
+	}
+	time.Sleep(time.Millisecond * 100)
+	filelog.retain()
+	stats := filelog.Stats()
+	if stats.Segments != 3 || stats.Lag != 3 || len(stats.Consumers) != 2 ||
+		stats.Consumers[0].Name != "fast" || stats.Consumers[0].Lag != 0 {
+		t.Errorf("Stats() = %+v, the log is not retained for the slow consumer", stats)
+	}
+
+	// the segments are deleted once the slow consumer is gone
+	if err := filelog.Unsubscribe("slow"); err != nil {
+		t.Fatal(err)
+	}
+	filelog.retain()
+	if stats := filelog.Stats(); stats.Segments != 1 || stats.Lag != 0 {
+		t.Errorf("Stats() = %+v after unsubscribe", stats)
+	}
+	filelog.Close()
+
+	// the offset of a consumer is kept after restart, it resumes where it was
+	filelog, err = NewFileLog(&Config{Dir: tempdir, Sync: SyncAlways})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer filelog.Close()
+	if err := filelog.Write([]byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := filelog.Subscribe("fast", func(logs []*bytes.Buffer) error {
+		for _, buf := range logs {
+			fast <- buf.Bytes()
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case record := <-fast:
+		if !bytes.Equal(record, []byte{3}) {
+			t.Errorf("resumed at %v, want the record written after restart", record)
+		}
+	case <-time.After(time.Second * 3):
+		t.Fatal("consumer is not resumed")
+	}
+}
+
+func TestFileLog_ConsumeCorrupted(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "filelog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+
+	// a block in each write, two blocks in a segment
+	filelog, err := NewFileLog(&Config{Dir: tempdir, Sync: SyncAlways, SegmentSize: 2 * blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, 1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filelog.Close()
+	// flip a byte in the second block, in the sealed segment which isn't checked on recovering
+	f, err := os.OpenFile(segmentName(tempdir, 0), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt([]byte{0xff}, blockSize+100)
+	f.Close()
+
+	filelog, got := readAll(t, tempdir)
+	stats := filelog.Stats().Consumers[0]
+	filelog.Close()
+	if len(got) != 3 || got[1][0] != 2 {
+		t.Fatalf("consumed %v records, want 3 without the corrupted one", len(got))
+	}
+	if stats.CorruptBlocks != 1 || stats.DeadLetters != 1 || stats.Lag != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(tempdir, DefaultConsumer+deadLetterExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 4+blockSize || littleEndian.Uint32(data) != blockSize {
+		t.Errorf("dead letter has %v bytes, want the block", len(data))
+	}
 }
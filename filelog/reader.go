@@ -0,0 +1,202 @@
+package filelog
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var errNoSegment = errors.New("no segment in directory")
+
+// Reader read blocks and records of a log without consuming them, it is used for inspection.
+// It must not be used with a FileLog opened on the same path.
+type Reader struct {
+	first   int
+	end     int
+	offsets map[string]int
+	legacy  *os.File
+	segs    []*segment
+}
+
+// BlockInfo header of a block
+type BlockInfo struct {
+	Index     int
+	File      string
+	Fragments int
+	Format    string // legacy or v2
+	Checksum  string // ok, none or mismatch
+}
+
+// Record a record and the block it begins in
+type Record struct {
+	Block int
+	Data  []byte
+}
+
+// OpenReader open a segment directory, or a single file log written by older versions
+func OpenReader(path string) (*Reader, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		// the file begins with the read and write block index
+		return &Reader{
+			first:   0,
+			end:     int(readUint32(f, 4)),
+			offsets: map[string]int{"read": int(readUint32(f, 0))},
+			legacy:  f,
+		}, nil
+	}
+
+	segs, err := openSegments(path, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	if len(segs) == 0 {
+		return nil, errNoSegment
+	}
+	r := &Reader{
+		first:   segs[0].base,
+		end:     segs[len(segs)-1].end(),
+		offsets: make(map[string]int),
+		segs:    segs,
+	}
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	for _, info := range infos {
+		name := strings.TrimSuffix(info.Name(), offsetExt)
+		if info.IsDir() || name == info.Name() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(path, info.Name()))
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.offsets[name] = int(readUint64(f, 0))
+		f.Close()
+	}
+	return r, nil
+}
+
+// Range return the index of the first block and the one after the last
+func (r *Reader) Range() (int, int) {
+	return r.first, r.end
+}
+
+// Offsets return the committed offsets of consumers, or the read offset of a legacy file
+func (r *Reader) Offsets() map[string]int {
+	return r.offsets
+}
+
+func (r *Reader) readBlock(index int, buf []byte) (string, error) {
+	if r.legacy != nil {
+		_, err := r.legacy.ReadAt(buf, int64(index*blockSize+8))
+		return r.legacy.Name(), err
+	}
+	i := sort.Search(len(r.segs), func(i int) bool { return r.segs[i].end() > index })
+	seg := r.segs[i]
+	return seg.file.Name(), seg.readBlock(index, buf)
+}
+
+// Scan read blocks in [from, to), a record beginning in the range is passed to onRecord
+// even if it ends after to. Records in a block with mismatched checksum are skipped.
+// onBlock can be nil, to <= 0 means to the end.
+func (r *Reader) Scan(from, to int, onBlock func(BlockInfo) error, onRecord func(Record) error) error {
+	if from < r.first {
+		from = r.first
+	}
+	if to <= 0 || to > r.end {
+		to = r.end
+	}
+	buf := make([]byte, blockSize)
+	var partial *bytes.Buffer
+	var partialAt int
+	for index := from; index < r.end && (index < to || partial != nil); index++ {
+		file, err := r.readBlock(index, buf)
+		if err != nil {
+			return err
+		}
+		block := newBlock(buf, blockModeRead)
+		info := BlockInfo{
+			Index:     index,
+			File:      file,
+			Fragments: int(block.length),
+			Format:    "v2",
+			Checksum:  "none",
+		}
+		if block.legacy {
+			info.Format = "legacy"
+		}
+		flags := littleEndian.Uint16(buf[0:2])
+		if flags&blockChecksum != 0 {
+			info.Checksum = "ok"
+			if crc32.ChecksumIEEE(buf[blockHeadSize:]) != littleEndian.Uint32(buf[blockCrcOffset:]) {
+				info.Checksum = "mismatch"
+			}
+		}
+		if onBlock != nil && index < to {
+			if err := onBlock(info); err != nil {
+				return err
+			}
+		}
+		if info.Checksum == "mismatch" {
+			partial = nil
+			continue
+		}
+		for i := 0; i < info.Fragments; i++ {
+			kind, data, err := block.read()
+			if err != nil {
+				break
+			}
+			switch kind {
+			case fragmentFull:
+				if index >= to {
+					continue
+				}
+				if err := onRecord(Record{Block: index, Data: data}); err != nil {
+					return err
+				}
+			case fragmentFirst:
+				if index >= to {
+					continue
+				}
+				partial = bytes.NewBuffer(data)
+				partialAt = index
+			case fragmentMiddle, fragmentLast:
+				if partial == nil { // it begins before the range
+					continue
+				}
+				partial.Write(data)
+				if kind == fragmentLast {
+					if err := onRecord(Record{Block: partialAt, Data: partial.Bytes()}); err != nil {
+						return err
+					}
+					partial = nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Close close files
+func (r *Reader) Close() {
+	if r.legacy != nil {
+		r.legacy.Close()
+	}
+	closeSegments(r.segs)
+}
@@ -0,0 +1,78 @@
+package filelog
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReader_Scan(t *testing.T) {
+	tempdir := "./reader.log"
+	defer os.RemoveAll(tempdir)
+	os.RemoveAll(tempdir)
+
+	// block 0: record 0 and the head of record 1, block 2: the tail of record 1 and record 2
+	sizes := []int{10, 2*blockSize + 100, 20}
+	filelog, err := NewFileLog(&Config{Dir: tempdir, SegmentSize: 2 * blockSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range sizes {
+		if err := filelog.Write(bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filelog.Close()
+
+	reader, err := OpenReader(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if first, end := reader.Range(); first != 0 || end != 3 {
+		t.Fatalf("Range() = %v, %v, want 0, 3", first, end)
+	}
+
+	tests := []struct {
+		name    string
+		from    int
+		to      int
+		blocks  int
+		records []int // index in sizes
+	}{
+		{"all", 0, 0, 3, []int{0, 1, 2}},
+		{"spanning record is read to its end", 0, 1, 1, []int{0, 1}},
+		{"spanning record begins before from", 1, 0, 2, []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			blocks := 0
+			var records []int
+			err := reader.Scan(tt.from, tt.to, func(info BlockInfo) error {
+				if info.Checksum != "ok" {
+					t.Errorf("block %v checksum %v", info.Index, info.Checksum)
+				}
+				blocks++
+				return nil
+			}, func(record Record) error {
+				i := int(record.Data[0])
+				if !bytes.Equal(record.Data, bytes.Repeat([]byte{byte(i)}, sizes[i])) {
+					t.Errorf("record %v is broken", i)
+				}
+				records = append(records, i)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if blocks != tt.blocks || len(records) != len(tt.records) {
+				t.Fatalf("Scan() %v blocks, records %v, want %v blocks, records %v", blocks, records, tt.blocks, tt.records)
+			}
+			for i := range records {
+				if records[i] != tt.records[i] {
+					t.Errorf("Scan() records %v, want %v", records, tt.records)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package filelog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ws-cluster/logger"
+)
+
+const segmentExt = ".seg"
+
+// segment a file of consecutive blocks, it is named by the index of its first block.
+// blocks are indexed across segments, so an index is never reused after segments are deleted.
+type segment struct {
+	base    int // index of the first block
+	blocks  int
+	file    *os.File
+	created time.Time
+	modAt   time.Time // time of the last block written
+}
+
+func segmentName(dir string, base int) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%v", base, segmentExt))
+}
+
+// end index of the block after the last one
+func (seg *segment) end() int {
+	return seg.base + seg.blocks
+}
+
+func (seg *segment) size() int64 {
+	return int64(seg.blocks) * blockSize
+}
+
+func createSegment(dir string, base int) (*segment, error) {
+	f, err := os.OpenFile(segmentName(dir, base), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &segment{base: base, file: f, created: now, modAt: now}, nil
+}
+
+// openSegments open segments in dir ordered by base, with the file flag
+func openSegments(dir string, flag int) ([]*segment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []*segment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		base, err := strconv.Atoi(strings.TrimSuffix(name, segmentExt))
+		if err != nil {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(dir, name), flag, 0644)
+		if err != nil {
+			closeSegments(segs)
+			return nil, err
+		}
+		segs = append(segs, &segment{
+			base:    base,
+			blocks:  int(info.Size() / blockSize),
+			file:    f,
+			created: info.ModTime(),
+			modAt:   info.ModTime(),
+		})
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].base < segs[j].base })
+	return segs, nil
+}
+
+func closeSegments(segs []*segment) {
+	for _, seg := range segs {
+		seg.file.Close()
+	}
+}
+
+// recover drop blocks torn by a crash: the blocks from the first corrupted one are truncated
+func (seg *segment) recover(log *logger.Logger) error {
+	buf := make([]byte, blockSize)
+	valid := 0
+	for ; valid < seg.blocks; valid++ {
+		if _, err := seg.file.ReadAt(buf, int64(valid)*blockSize); err != nil {
+			break
+		}
+		if !checkBlock(buf) {
+			break
+		}
+	}
+	if valid < seg.blocks {
+		log.Warn("block is corrupted", logger.F("file", seg.file.Name()), logger.F("block", seg.base+valid), logger.F("dropped", seg.blocks-valid))
+	}
+	seg.blocks = valid
+	// a partial block at the end is dropped too
+	if err := seg.file.Truncate(seg.size()); err != nil {
+		return err
+	}
+	return seg.file.Sync()
+}
+
+func (seg *segment) writeBlock(b []byte) error {
+	if _, err := seg.file.WriteAt(b, seg.size()); err != nil {
+		return err
+	}
+	seg.blocks++
+	seg.modAt = time.Now()
+	return nil
+}
+
+func (seg *segment) readBlock(index int, buf []byte) error {
+	_, err := seg.file.ReadAt(buf, int64(index-seg.base)*blockSize)
+	return err
+}
+
+func (seg *segment) remove() error {
+	seg.file.Close()
+	return os.Remove(seg.file.Name())
+}
+
+// syncDir make created or removed files in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/ws-cluster/logger"
+)
+
+// start admin http server for operators, this function must be in a routine
+func adminlisten(hub *Hub, conf *serverConfig) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/admin/search", func(w http.ResponseWriter, r *http.Request) {
+		adminSearchHandler(hub, w, r)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsHandler(hub, w, r)
+	})
+
+	mux.HandleFunc("/admin/messagelog", func(w http.ResponseWriter, r *http.Request) {
+		adminMessageLogHandler(hub, w, r)
+	})
+	mux.HandleFunc("/admin/log/level", adminLogLevelHandler)
+	mux.HandleFunc("/admin/tap", func(w http.ResponseWriter, r *http.Request) {
+		adminTapHandler(hub, w, r)
+	})
+
+	hub.log.Info("admin listen", logger.F("host", conf.AdminListenHost))
+	err := http.ListenAndServe(conf.AdminListenHost, checkAdmin(conf.AdminToken, mux))
+	if err != nil {
+		hub.log.Error("admin listen failed", logger.F("host", conf.AdminListenHost), logger.Err(err))
+		return
+	}
+}
+
+// checkAdmin requests must have header `Authorization: Bearer <token>` if the token is set
+func checkAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 查看和修改日志级别
+// GET /admin/log/level 返回各子系统的级别
+// POST /admin/log/level?subsystem=&level= subsystem 为空时修改默认级别及所有子系统
+func adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		level, err := logger.ParseLevel(r.URL.Query().Get("level"))
+		if err != nil {
+			handleHTTPErr(w, err)
+			return
+		}
+		subsystem := r.URL.Query().Get("subsystem")
+		logger.SetLevel(subsystem, level)
+		hubLog.Info("log level changed", logger.F("target", subsystem), logger.F("level", level))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	levels := make(map[string]string)
+	for name, level := range logger.Levels() {
+		levels[name] = level.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(levels)
+}
+
+// 查询消息日志的消费进度
+// GET /admin/messagelog
+func adminMessageLogHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if hub.messageLog == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hub.messageLog.Stats())
+}
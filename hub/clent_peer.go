@@ -1,12 +1,13 @@
 package hub
 
 import (
-	"log"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
 	"github.com/gorilla/websocket"
+	"github.com/ws-cluster/logger"
 	"github.com/ws-cluster/peer"
+	"github.com/ws-cluster/tracing"
 	"github.com/ws-cluster/wire"
 )
 
@@ -28,11 +29,27 @@ type ClientPeer struct {
 	// you must notice the servers by sending a offline message when you logout
 	Sessions      map[wire.Addr]*Session
 	OfflineNotice uint8
+	Version       uint16 // negotiated protocol version
 	packet        chan<- *Packet
+	signalLimiter *rateLimiter
+	tracer        *tracing.Tracer
 }
 
 // OnMessage 接收消息
 func (p *ClientPeer) OnMessage(message *wire.Message) error {
+	message.Header.Trace = nil // a trace is started here, clients don't propagate theirs
+	span := p.tracer.Start(spanClientReceive, tracing.KindServer)
+	defer span.End()
+	setMessageAttrs(span, message.Header)
+	setTrace(message.Header, span)
+
+	if wire.IsEphemeral(message.Header.Command) {
+		// no ack for ephemeral message, drop it silently if the client sends too fast
+		if p.signalLimiter.Allow() {
+			p.packet <- &Packet{from: p.Addr, use: useForRelayMessage, content: message}
+		}
+		return nil
+	}
 	respchan := make(chan *Resp)
 
 	if message.Header.Dest.IsEmpty() { // is command message
@@ -41,29 +58,60 @@ func (p *ClientPeer) OnMessage(message *wire.Message) error {
 	p.packet <- &Packet{from: p.Addr, use: useForRelayMessage, content: message, resp: respchan}
 
 	resp := <-respchan
+	span.SetError(resp.Err)
 	respMessage := wire.MakeEmptyRespMessage(message.Header, resp.Status)
+	if ack, ok := resp.Body.(*wire.MsgChatAck); ok && p.Version >= wire.ProtocolVersion3 {
+		respMessage.Header.Command = wire.MsgTypeChatAck
+		respMessage.Body = ack
+	} else if history, ok := resp.Body.(*wire.MsgHistoryResp); ok {
+		respMessage.Header.Command = wire.MsgTypeHistoryResp
+		respMessage.Body = history
+	} else if convs, ok := resp.Body.(*wire.MsgConversationsResp); ok {
+		respMessage.Header.Command = wire.MsgTypeConversationsResp
+		respMessage.Body = convs
+	}
 	p.PushMessage(respMessage, nil)
 	// log.Println("message", message.Header.String(), "resp status:", respMessage.Header.Status)
 
 	return nil
 }
 
+// canDecode a client below ProtocolVersion2 can't decode addresses in the long format
+func (p *ClientPeer) canDecode(message *wire.Message) bool {
+	return p.Version >= wire.ProtocolVersion2 || message.IsLegacy()
+}
+
+// PushMessage a message the client can't decode is never written, done gets ErrAddrUnsupported
+func (p *ClientPeer) PushMessage(message *wire.Message, done chan error) {
+	if !p.canDecode(message) {
+		p.Logger().Debug("message with long address refused", logger.F(logger.KeyCommand, message.Header.Command))
+		if done != nil {
+			done <- ErrAddrUnsupported
+		}
+		return
+	}
+	p.Peer.PushMessage(message, done)
+}
+
 // OnDisconnect 接连断开
 func (p *ClientPeer) OnDisconnect() error {
 	respchan := make(chan *Resp)
 	p.packet <- &Packet{from: p.Addr, use: useForDelClientPeer, content: p, resp: respchan}
 	<-respchan
-	log.Printf("client %v@%v disconnected", p.Addr.String(), p.RemoteAddr)
+	p.Logger().Info("client disconnected")
 	return nil
 }
 
-func newClientPeer(addr wire.Addr, remoteAddr string, offlineNotice uint8, h *Hub, conn *websocket.Conn) (*ClientPeer, error) {
+func newClientPeer(addr wire.Addr, remoteAddr string, offlineNotice uint8, version uint16, h *Hub, conn *websocket.Conn) (*ClientPeer, error) {
 	clientPeer := &ClientPeer{
 		packet:        h.packetQueue,
 		Server:        h.Server,
 		OfflineNotice: offlineNotice,
+		Version:       version,
 		Groups:        mapset.NewThreadUnsafeSet(),
 		Sessions:      make(map[wire.Addr]*Session, 0),
+		signalLimiter: newRateLimiter(h.config.live().SignalRate, h.config.live().SignalBurst),
+		tracer:        h.tracer,
 	}
 	peer := peer.NewPeer(addr, remoteAddr, &peer.Config{
 		Listeners: &peer.MessageListeners{
@@ -71,6 +119,7 @@ func newClientPeer(addr wire.Addr, remoteAddr string, offlineNotice uint8, h *Hu
 			OnDisconnect: clientPeer.OnDisconnect,
 		},
 		MaxMessageSize: h.config.cpc.MaxMessageSize,
+		Logger:         h.peerLogger(addr, remoteAddr),
 	})
 
 	clientPeer.Peer = peer
@@ -4,22 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/ksuid"
 	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/filelog"
+	"github.com/ws-cluster/logger"
 )
 
 const (
-	// defaultConfigName  = "conf.ini"
 	defaultIDName      = "id.lock"
-	defaultMessageName = "message.log"
+	defaultMessageName = "message.log" // legacy single file message log
+	defaultMessageDir  = "messagelog"
+	defaultSqliteName  = "message.db"
+	defaultArchiveDir  = "archive"
 )
 
 const (
@@ -39,18 +44,42 @@ const (
 var (
 	// configDir = "./"
 	defaultDataDir         = "./data"
-	defaultDbDriver        = "mysql"
+	defaultDbDriver        = database.DriverMysql
 	defaultWebsocketScheme = "ws"
 	defaultListenIP        = "0.0.0.0"
 	defaultListenPort      = 8380
+	defaultAdminListenHost = "127.0.0.1:8381"
 	defaultGroupBufferSize = 10
-	// defaultConfigFile   = filepath.Join(configDir, defaultConfigName)
+	defaultTransferWindow  = 8
+	defaultTransferTimeout = time.Minute
+	defaultSignalRate      = 5.0
+	defaultSignalBurst     = 10
+	defaultRecallWindow    = 2 * time.Minute
+	defaultLogSync         = "interval"
+	defaultLogSyncInterval = time.Second
+	defaultLogRetries      = 10
+	defaultLogRetryBackoff = time.Second
+	defaultLogMaxBackoff   = time.Minute
+	defaultSegmentSize     = int64(64 * 1024 * 1024)
+	defaultConsumerMaxLag  = int64(1024 * 1024 * 1024)
+	defaultSegmentAge      = time.Hour
+	defaultRetainInterval  = time.Hour
+	defaultRetainBatch     = 1000
+	defaultTokenOverlap    = 10 * time.Minute
+	defaultDrainTimeout    = 30 * time.Second
+	defaultLogLevel        = "info"
+	defaultLogFormat       = "text"
+	defaultTraceSample     = 0.01
+	defaultTapRate         = 50.0
+	defaultTapMax          = 8
 )
 
 type serverConfig struct {
 	ID                 string `description:"server logic addr"`
 	AcceptDomains      []int
 	ListenHost         string
+	AdminListenHost    string
+	AdminToken         string
 	AdvertiseClientURL *url.URL
 	AdvertiseServerURL *url.URL
 	ClientToken        string
@@ -58,11 +87,35 @@ type serverConfig struct {
 	ClusterSeedURL     string
 	Origins            string
 	MessageFile        string
+	MessageDir         string
+	SegmentSize        int64
+	SegmentAge         time.Duration
+	RetentionAge       time.Duration
+	RetentionSize      int64
+	ConsumerMaxLag     int64
+	KeepConsumed       bool
+	MessageLogSync     filelog.SyncPolicy
+	MessageLogInterval time.Duration
+	MessageLogRetries  int
+	MessageLogBackoff  time.Duration
+	MessageLogMaxWait  time.Duration
 	GroupBufferSize    int
+	TransferWindow     int
+	TransferTimeout    time.Duration
+	SignalRate         float64
+	SignalBurst        int
+	RecallWindow       time.Duration
+	DrainTimeout       time.Duration
+	DrainURLs          []string
+	TraceFile          string  // empty means tracing is disabled
+	TraceSample        float64 // ratio of client messages which are traced
+	TapRate            float64 // events per second of a tap at most
+	TapMax             int     // taps opened on this server at most
 }
 
 type peerConfig struct {
 	MaxMessageSize int
+	Compression    bool
 	WriteWait      time.Duration
 	PongWait       time.Duration
 	PingPeriod     time.Duration
@@ -78,56 +131,167 @@ type Config struct {
 	// server
 	sc serverConfig
 	dc *databaseConfig
+	rc *database.RetentionConfig
 	//client peer config
 	cpc     peerConfig
 	dataDir string
 	// Cache        Cache
-	ms database.MessageStore
+	ms         database.MessageStore
+	retention  *database.Retention
+	persist    *persistPolicy
+	searchPath string // empty means search is disabled
+	index      *database.SearchIndex
+	// conversation index is enabled by -conversations
+	enableConversations bool
+	conversations       *database.ConversationIndex
+	// file of -config, empty means options are not read from a file
+	configPath string
+	// levels of subsystems like "info,peer=debug", and text or json
+	logLevel  string
+	logFormat string
+	// options parsed, the reloadable ones are copied to live
+	flags     *flag.FlagSet
+	liveValue atomic.Value // *liveConfig
 }
 
 // LoadConfig LoadConfig
 func LoadConfig() (*Config, error) {
+	conf, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+	conf.applyLogging()
+	if conf.configPath != "" {
+		hubLog.Info("config file loaded", logger.F("path", conf.configPath))
+	}
+	hubLog.Info("tokens", logger.F("client-token", conf.sc.ClientToken), logger.F("server-token", conf.sc.ServerToken))
+	hubLog.Info("advertise urls", logger.F("client", conf.sc.AdvertiseClientURL.String()), logger.F("server", conf.sc.AdvertiseServerURL.String()))
+	if conf.dc != nil {
+		hubLog.Info("database", logger.F("driver", conf.dc.DbDriver), logger.F("source", conf.dc.DbSource))
+	}
+	return conf, nil
+}
+
+// applyLogging set levels and format of all loggers, they are validated by loadConfig
+func (conf *Config) applyLogging() {
+	logger.SetLevels(conf.logLevel)
+	logger.SetJSON(conf.logFormat == "json")
+}
+
+// loadConfig define options in fs and parse args, environment variables and the config file
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
 	var conf Config
 
 	conf.sc = serverConfig{}
-	flag.StringVar(&conf.sc.ID, "server-id", "", "server id")
-	flag.StringVar(&conf.sc.ListenHost, "listen-host", fmt.Sprintf("%v:%v", defaultListenIP, defaultListenPort), "listen host,format ip:port")
-	flag.StringVar(&conf.sc.Origins, "origins", "*", "allowed origins from client")
-	flag.StringVar(&conf.sc.ClientToken, "client-token", ksuid.New().String(), "token for client")
-	flag.StringVar(&conf.sc.ServerToken, "server-token", ksuid.New().String(), "token for server")
-	flag.StringVar(&conf.sc.ClusterSeedURL, "cluster-seed-url", "", "request a server for downloading a list of servers")
-	flag.IntVar(&conf.sc.GroupBufferSize, "group-buffer-size", defaultGroupBufferSize, "group channal size of relying message")
+	fs.StringVar(&conf.sc.ID, "server-id", "", "server id")
+	fs.StringVar(&conf.sc.ListenHost, "listen-host", fmt.Sprintf("%v:%v", defaultListenIP, defaultListenPort), "listen host,format ip:port")
+	fs.StringVar(&conf.sc.AdminListenHost, "admin-listen-host", defaultAdminListenHost, "listen host of admin api, format ip:port, empty means disabled")
+	fs.StringVar(&conf.sc.AdminToken, "admin-token", "", "token of admin api, requests must have header 'Authorization: Bearer <token>' if it is set")
+	fs.StringVar(&conf.sc.Origins, "origins", "*", "allowed origins from client")
+	fs.StringVar(&conf.sc.ClientToken, "client-token", ksuid.New().String(), "token for client")
+	fs.StringVar(&conf.sc.ServerToken, "server-token", ksuid.New().String(), "token for server")
+	fs.StringVar(&conf.sc.ClusterSeedURL, "cluster-seed-url", "", "request a server for downloading a list of servers")
+	fs.IntVar(&conf.sc.GroupBufferSize, "group-buffer-size", defaultGroupBufferSize, "group channal size of relying message")
+	fs.IntVar(&conf.sc.TransferWindow, "transfer-window", defaultTransferWindow, "maximum unacknowledged chunks of a file transfer")
+	fs.Float64Var(&conf.sc.SignalRate, "signal-rate", defaultSignalRate, "signals allowed per second from a client, 0 means no limit")
+	fs.IntVar(&conf.sc.SignalBurst, "signal-burst", defaultSignalBurst, "burst of signals allowed from a client")
+	fs.DurationVar(&conf.sc.RecallWindow, "recall-window", defaultRecallWindow, "a chat message can be recalled or edited by its sender in this duration, 0 disables it")
+	fs.DurationVar(&conf.sc.TransferTimeout, "transfer-timeout", defaultTransferTimeout, "a file transfer is dropped if no chunk is received in this duration")
+
+	fs.DurationVar(&conf.sc.DrainTimeout, "drain-timeout", defaultDrainTimeout, "on SIGTERM, wait clients to reconnect to other servers in this duration before closing")
+	var drainURLs string
+	fs.StringVar(&drainURLs, "drain-urls", "", "client urls of other servers separated by ',' sent to clients on SIGTERM, defaults to the servers in cluster")
 
 	var clientURL, serverURL string
-	flag.StringVar(&clientURL, "advertise-client-url", "", "the url is to listen on for client traffic")
-	flag.StringVar(&serverURL, "advertise-server-url", "", "use for server connecting")
+	fs.StringVar(&clientURL, "advertise-client-url", "", "the url is to listen on for client traffic")
+	fs.StringVar(&serverURL, "advertise-server-url", "", "use for server connecting")
 
 	conf.cpc = peerConfig{}
-	flag.IntVar(&conf.cpc.MaxMessageSize, "client-max-msg-size", defaultMaxMessageSize, "Maximum message size allowed from client.")
-	flag.DurationVar(&conf.cpc.WriteWait, "client-write-wait", defaultWriteWait, "Time allowed to write a message to the client")
-	flag.DurationVar(&conf.cpc.PingPeriod, "client-ping-period", defaultWriteWait, "Send pings to client with this period. Must be less than pongWait")
-	flag.DurationVar(&conf.cpc.PongWait, "client-pong-wait", defaultWriteWait, "Time allowed to read the next pong message from the client")
+	fs.IntVar(&conf.cpc.MaxMessageSize, "client-max-msg-size", defaultMaxMessageSize, "Maximum message size allowed from client.")
+	fs.DurationVar(&conf.cpc.WriteWait, "client-write-wait", defaultWriteWait, "Time allowed to write a message to the client")
+	fs.DurationVar(&conf.cpc.PingPeriod, "client-ping-period", defaultWriteWait, "Send pings to client with this period. Must be less than pongWait")
+	fs.DurationVar(&conf.cpc.PongWait, "client-pong-wait", defaultWriteWait, "Time allowed to read the next pong message from the client")
+	fs.BoolVar(&conf.cpc.Compression, "client-compression", false, "negotiate websocket per-message compression with client")
 
-	dbsource := *flag.String("db-source", "", "database source, just support mysql,eg: user:password@tcp(ip:port)/dbname")
+	var dc databaseConfig
+	fs.StringVar(&dc.DbDriver, "db-driver", defaultDbDriver, "database dirver, mysql or sqlite3")
+	fs.StringVar(&dc.DbSource, "db-source", "", "database source, eg: user:password@tcp(ip:port)/dbname for mysql, a file path for sqlite3 which defaults to message.db in data-dir")
 
 	// datadir
-	flag.StringVar(&conf.dataDir, "data-dir", defaultDataDir, "data directory")
-
-	flag.Usage = func() {
+	var rc database.RetentionConfig
+	var retainDomains string
+	var archive bool
+	fs.DurationVar(&rc.MaxAge, "db-retention", 0, "chat and group messages in database older than it are purged, 0 means they are kept forever")
+	fs.StringVar(&retainDomains, "db-retention-domains", "", "max age of messages in each domain, eg: 1=720h,3=0 (forever), the other domains use -db-retention")
+	fs.DurationVar(&rc.Interval, "db-retention-interval", defaultRetainInterval, "interval of purging messages in database")
+	fs.IntVar(&rc.BatchSize, "db-retention-batch", defaultRetainBatch, "messages deleted in one statement while purging")
+	fs.BoolVar(&archive, "db-retention-archive", false, "archive purged messages to jsonl.gz files in the archive directory of data-dir before deleting them")
+	fs.StringVar(&conf.dataDir, "data-dir", defaultDataDir, "data directory")
+	var search bool
+	fs.BoolVar(&search, "search", false, "index chat messages for searching by admin api, the index is search.db in data-dir")
+	fs.BoolVar(&conf.enableConversations, "conversations", false, "keep conversations and unread counts of clients in database")
+	var persist string
+	fs.StringVar(&persist, "persist-policy", defaultPersistPolicy, "rules of logging and saving messages separated by ';', a rule is command:dest:domains:action, the first matched rule is applied and unmatched messages are skipped")
+	var logSync string
+	fs.StringVar(&logSync, "message-log-sync", defaultLogSync, "when message log is synced to disk: always, interval or never")
+	fs.DurationVar(&conf.sc.MessageLogInterval, "message-log-sync-interval", defaultLogSyncInterval, "sync interval of message log")
+	fs.IntVar(&conf.sc.MessageLogRetries, "message-log-retries", defaultLogRetries, "attempts to save messages to database before they are written to the dead letter file")
+	fs.DurationVar(&conf.sc.MessageLogBackoff, "message-log-retry-backoff", defaultLogRetryBackoff, "wait after the first failed attempt to save messages, doubled on each retry")
+	fs.Int64Var(&conf.sc.SegmentSize, "message-log-segment-size", defaultSegmentSize, "a new segment of message log is started if the written one reaches the size in bytes")
+	fs.DurationVar(&conf.sc.SegmentAge, "message-log-segment-age", defaultSegmentAge, "a new segment of message log is started if the written one is older, 0 means no limit")
+	fs.DurationVar(&conf.sc.RetentionAge, "message-log-retention-age", 0, "segments of message log older than it are deleted even if they are not saved, 0 means no limit")
+	fs.Int64Var(&conf.sc.RetentionSize, "message-log-retention-size", 0, "the oldest segments of message log are deleted while the total size exceeds it even if they are not saved, 0 means no limit")
+	fs.Int64Var(&conf.sc.ConsumerMaxLag, "message-log-consumer-max-lag", defaultConsumerMaxLag, "message log is no longer retained for a consumer whose unconsumed data exceeds the size in bytes, so a stalled consumer can't fill the disk, 0 means no limit")
+	fs.BoolVar(&conf.sc.KeepConsumed, "message-log-keep", false, "keep saved segments of message log for replay until the retention")
+	fs.DurationVar(&conf.sc.MessageLogMaxWait, "message-log-max-backoff", defaultLogMaxBackoff, "maximum wait between attempts to save messages")
+
+	var tokenOverlap time.Duration
+	fs.DurationVar(&tokenOverlap, "token-rotation-overlap", defaultTokenOverlap, "the previous -client-token and -server-token are still accepted in this duration after they are changed by reloading")
+	fs.StringVar(&conf.logLevel, "log-level", defaultLogLevel, "log level debug, info, warn or error, levels of subsystems can follow it, eg: info,peer=debug,filelog=warn")
+	fs.StringVar(&conf.logFormat, "log-format", defaultLogFormat, "log format, text or json")
+	fs.StringVar(&conf.sc.TraceFile, "trace-file", "", "append spans of traced messages to the file in OTLP json, empty means tracing is disabled")
+	fs.Float64Var(&conf.sc.TraceSample, "trace-sample", defaultTraceSample, "ratio of client messages which start a trace, 0-1, messages from other servers are traced if their senders traced them")
+	fs.Float64Var(&conf.sc.TapRate, "tap-rate", defaultTapRate, "events per second sent by a message tap of admin api at most, from each server, the rate asked by a tap can only be lower")
+	fs.IntVar(&conf.sc.TapMax, "tap-max", defaultTapMax, "message taps opened on the admin api of this server at most")
+	fs.StringVar(&conf.configPath, configFlag, "", "toml config file whose keys are the names of options, options are also read from WSCLUSTER_<NAME> environment variables, eg: WSCLUSTER_DB_SOURCE, the precedence is command line > environment > config file > default")
+
+	fs.Usage = func() {
 		fmt.Println("Usage of wscluster:")
-		flag.PrintDefaults()
+		fs.PrintDefaults()
 	}
 
-	flag.Parse()
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := applyConfigSources(fs, os.Environ()); err != nil {
+		return nil, err
+	}
+	for _, u := range strings.Split(drainURLs, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			if _, err := url.Parse(u); err != nil {
+				return nil, fmt.Errorf("invalid -drain-urls %v", u)
+			}
+			conf.sc.DrainURLs = append(conf.sc.DrainURLs, u)
+		}
+	}
+	if err := conf.validate(&dc, &rc); err != nil {
+		return nil, err
+	}
+	if tokenOverlap < 0 {
+		return nil, fmt.Errorf("invalid -token-rotation-overlap %v", tokenOverlap)
+	}
+	conf.flags = fs
+	conf.liveValue.Store(newLiveConfig(&conf.sc, tokenOverlap))
 
-	listenPort := strings.Split(conf.sc.ListenHost, ":")[1]
-	var err error
+	_, listenPort, err := net.SplitHostPort(conf.sc.ListenHost)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -listen-host %v", conf.sc.ListenHost)
+	}
 	if clientURL != "" {
 		conf.sc.AdvertiseClientURL, err = url.Parse(clientURL)
 		if err != nil {
 			return nil, err
 		}
-		log.Println("-advertise-client-url", conf.sc.AdvertiseClientURL.String())
 	} else {
 		conf.sc.AdvertiseClientURL = &url.URL{Scheme: defaultWebsocketScheme, Host: fmt.Sprintf("%v:%v", GetOutboundIP().String(), listenPort)}
 	}
@@ -137,16 +301,28 @@ func LoadConfig() (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
-		log.Println("-advertise-server-url", conf.sc.AdvertiseServerURL.String())
 	} else {
 		conf.sc.AdvertiseServerURL = &url.URL{Scheme: defaultWebsocketScheme, Host: fmt.Sprintf("%v:%v", GetOutboundIP().String(), listenPort)}
 	}
 
 	conf.sc.MessageFile = filepath.Join(conf.dataDir, defaultMessageName)
+	conf.sc.MessageDir = filepath.Join(conf.dataDir, defaultMessageDir)
+	switch logSync {
+	case "always":
+		conf.sc.MessageLogSync = filelog.SyncAlways
+	case "interval":
+		conf.sc.MessageLogSync = filelog.SyncInterval
+	case "never":
+		conf.sc.MessageLogSync = filelog.SyncNever
+	default:
+		return nil, fmt.Errorf("invalid -message-log-sync %v", logSync)
+	}
+	if conf.persist, err = parsePersistPolicy(persist); err != nil {
+		return nil, err
+	}
 	if _, err := os.Stat(conf.dataDir); err != nil {
 		err = os.MkdirAll(conf.dataDir, os.ModePerm)
 		if err != nil {
-			fmt.Println(err)
 			return nil, err
 		}
 	}
@@ -155,23 +331,134 @@ func LoadConfig() (*Config, error) {
 		conf.sc.ID = fmt.Sprintf("%d", time.Now().Unix())
 	}
 
-	if dbsource != "" {
-		conf.dc = new(databaseConfig)
-		flag.StringVar(&conf.dc.DbDriver, "db-driver", defaultDbDriver, "database dirver, just support mysql")
-		conf.dc.DbSource = dbsource
-
-		log.Println("-db-source", conf.dc.DbSource)
+	switch dc.DbDriver {
+	case database.DriverMysql:
+	case database.DriverSqlite:
+		// embedded database for single node
+		if dc.DbSource == "" {
+			dc.DbSource = filepath.Join(conf.dataDir, defaultSqliteName)
+		}
+	default:
+		return nil, fmt.Errorf("invalid -db-driver %v", dc.DbDriver)
+	}
+	if dc.DbSource != "" {
+		conf.dc = &dc
+	}
+	if search {
+		conf.searchPath = filepath.Join(conf.dataDir, defaultSearchName)
+	}
+	if conf.enableConversations && conf.dc == nil {
+		return nil, fmt.Errorf("-conversations needs a database, set -db-source")
+	}
+	if rc.DomainMaxAge, err = parseDomainAges(retainDomains); err != nil {
+		return nil, err
+	}
+	if conf.dc != nil && (rc.MaxAge > 0 || len(rc.DomainMaxAge) > 0) {
+		if archive {
+			rc.ArchiveDir = filepath.Join(conf.dataDir, defaultArchiveDir)
+		}
+		conf.rc = &rc
 	}
 
 	// if err != nil {
 	// 	return nil, err
 	// }
-	log.Println("-client-token", conf.sc.ClientToken)
-	log.Println("-server-token", conf.sc.ServerToken)
 
 	return &conf, nil
 }
 
+// validate values of options which are invalid in any case
+func (conf *Config) validate(dc *databaseConfig, rc *database.RetentionConfig) error {
+	if conf.sc.AdminListenHost != "" {
+		if _, _, err := net.SplitHostPort(conf.sc.AdminListenHost); err != nil {
+			return fmt.Errorf("invalid -admin-listen-host %v", conf.sc.AdminListenHost)
+		}
+	}
+	if conf.sc.ClientToken == "" || conf.sc.ServerToken == "" {
+		return fmt.Errorf("-client-token and -server-token can't be empty")
+	}
+	if conf.sc.GroupBufferSize < 0 {
+		return fmt.Errorf("invalid -group-buffer-size %v", conf.sc.GroupBufferSize)
+	}
+	if conf.sc.TransferWindow <= 0 {
+		return fmt.Errorf("invalid -transfer-window %v", conf.sc.TransferWindow)
+	}
+	if conf.sc.SignalRate < 0 || conf.sc.SignalBurst < 0 {
+		return fmt.Errorf("invalid -signal-rate %v or -signal-burst %v", conf.sc.SignalRate, conf.sc.SignalBurst)
+	}
+	if conf.sc.MessageLogRetries < 0 || conf.sc.SegmentSize <= 0 {
+		return fmt.Errorf("invalid -message-log-retries %v or -message-log-segment-size %v", conf.sc.MessageLogRetries, conf.sc.SegmentSize)
+	}
+	if conf.cpc.MaxMessageSize <= 0 {
+		return fmt.Errorf("invalid -client-max-msg-size %v", conf.cpc.MaxMessageSize)
+	}
+	if conf.cpc.WriteWait <= 0 || conf.cpc.PingPeriod <= 0 || conf.cpc.PongWait <= 0 {
+		return fmt.Errorf("-client-write-wait, -client-ping-period and -client-pong-wait must be positive")
+	}
+	durations := map[string]time.Duration{
+		"recall-window":             conf.sc.RecallWindow,
+		"drain-timeout":             conf.sc.DrainTimeout,
+		"transfer-timeout":          conf.sc.TransferTimeout,
+		"message-log-sync-interval": conf.sc.MessageLogInterval,
+		"message-log-segment-age":   conf.sc.SegmentAge,
+		"message-log-retention-age": conf.sc.RetentionAge,
+		"message-log-retry-backoff": conf.sc.MessageLogBackoff,
+		"message-log-max-backoff":   conf.sc.MessageLogMaxWait,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("invalid -%v %v", name, d)
+		}
+	}
+	if conf.sc.RetentionSize < 0 || conf.sc.ConsumerMaxLag < 0 {
+		return fmt.Errorf("invalid -message-log-retention-size %v or -message-log-consumer-max-lag %v", conf.sc.RetentionSize, conf.sc.ConsumerMaxLag)
+	}
+	if rc.BatchSize <= 0 || rc.Interval <= 0 || rc.MaxAge < 0 {
+		return fmt.Errorf("invalid -db-retention-batch %v, -db-retention-interval %v or -db-retention %v", rc.BatchSize, rc.Interval, rc.MaxAge)
+	}
+	if dc.DbDriver != database.DriverMysql && dc.DbDriver != database.DriverSqlite {
+		return fmt.Errorf("invalid -db-driver %v", dc.DbDriver)
+	}
+	if _, err := logger.ParseLevels(conf.logLevel); err != nil {
+		return fmt.Errorf("invalid -log-level %v", conf.logLevel)
+	}
+	if conf.logFormat != "text" && conf.logFormat != "json" {
+		return fmt.Errorf("invalid -log-format %v", conf.logFormat)
+	}
+	if conf.sc.TraceSample < 0 || conf.sc.TraceSample > 1 {
+		return fmt.Errorf("invalid -trace-sample %v", conf.sc.TraceSample)
+	}
+	if conf.sc.TapRate <= 0 || conf.sc.TapMax < 0 {
+		return fmt.Errorf("invalid -tap-rate %v or -tap-max %v", conf.sc.TapRate, conf.sc.TapMax)
+	}
+	return nil
+}
+
+// parseDomainAges parse domain=duration separated by ','
+func parseDomainAges(s string) (map[uint32]time.Duration, error) {
+	ages := make(map[uint32]time.Duration)
+	for _, text := range strings.Split(s, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		pair := strings.Split(text, "=")
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid -db-retention-domains %v", text)
+		}
+		domain, err := strconv.ParseUint(strings.TrimSpace(pair[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain in -db-retention-domains %v", text)
+		}
+		age, err := time.ParseDuration(strings.TrimSpace(pair[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age in -db-retention-domains %v", text)
+		}
+		ages[uint32(domain)] = age
+	}
+	return ages, nil
+}
+
 // BuildServerID build a serverID
 func BuildServerID(dataDir string) (string, error) {
 	defaultIDConfigFile := filepath.Join(dataDir, defaultIDName)
@@ -188,11 +475,12 @@ func BuildServerID(dataDir string) (string, error) {
 	return string(fb), nil
 }
 
-//GetOutboundIP Get preferred outbound ip of this machine
+// GetOutboundIP Get preferred outbound ip of this machine, the loopback ip if there is no route
 func GetOutboundIP() net.IP {
 	conn, err := net.Dial("udp", "8.8.8.8:80")
 	if err != nil {
-		log.Println(err)
+		hubLog.Error("get outbound ip failed", logger.Err(err))
+		return net.IPv4(127, 0, 0, 1)
 	}
 	defer conn.Close()
 
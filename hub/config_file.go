@@ -0,0 +1,97 @@
+package hub
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	// envPrefix environment variables are named by options, eg: WSCLUSTER_DB_SOURCE for -db-source
+	envPrefix = "WSCLUSTER_"
+	// configFlag option of the config file
+	configFlag = "config"
+)
+
+// applyConfigSources set options which aren't on the command line from environment variables,
+// then from the config file. The precedence is command line > environment > config file > default.
+// Unknown options and invalid values are errors.
+func applyConfigSources(fs *flag.FlagSet, environ []string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, envPrefix) {
+			continue
+		}
+		pair := strings.SplitN(kv, "=", 2)
+		name := strings.Replace(strings.ToLower(strings.TrimPrefix(pair[0], envPrefix)), "_", "-", -1)
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown environment variable %v", pair[0])
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, pair[1]); err != nil {
+			return fmt.Errorf("invalid environment variable %v: %v", pair[0], err)
+		}
+		set[name] = true
+	}
+
+	path := fs.Lookup(configFlag).Value.String()
+	if path == "" {
+		return nil
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == configFlag || fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %v in %v", name, path)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, values[name]); err != nil {
+			return fmt.Errorf("invalid option %v in %v: %v", name, path, err)
+		}
+	}
+	return nil
+}
+
+// readConfigFile read a toml file, keys are the names of options, eg: db-driver = "sqlite3",
+// durations are strings like "720h"
+func readConfigFile(path string) (map[string]string, error) {
+	raw := make(map[string]interface{})
+	if _, err := toml.DecodeFile(path, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[name] = v
+		case int64:
+			values[name] = strconv.FormatInt(v, 10)
+		case float64:
+			values[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[name] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("invalid option %v in %v: %T is not supported", name, path, value)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,148 @@
+package hub
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFlagSet a flag set with options of each type, the config file is at path
+func testFlagSet(path string) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.String(configFlag, path, "")
+	fs.String("db-driver", "sqlite3", "")
+	fs.String("db-source", "", "")
+	fs.Int("group-buffer-size", 100, "")
+	fs.Float64("signal-rate", 20, "")
+	fs.Bool("search", false, "")
+	fs.Duration("recall-window", 2*time.Minute, "")
+	return fs
+}
+
+func TestApplyConfigSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		args    []string
+		environ []string
+		file    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "default",
+			want: map[string]string{"db-driver": "sqlite3", "group-buffer-size": "100", "search": "false"},
+		},
+		{
+			name: "file over default",
+			file: "db-driver = \"mysql\"\ngroup-buffer-size = 200\nsignal-rate = 0.5\nsearch = true\nrecall-window = \"1h\"\n",
+			want: map[string]string{"db-driver": "mysql", "group-buffer-size": "200", "signal-rate": "0.5",
+				"search": "true", "recall-window": "1h0m0s"},
+		},
+		{
+			name:    "environment over file",
+			environ: []string{"HOME=/root", "WSCLUSTER_DB_DRIVER=postgres", "WSCLUSTER_RECALL_WINDOW=5m"},
+			file:    "db-driver = \"mysql\"\ndb-source = \"message.db\"\n",
+			want:    map[string]string{"db-driver": "postgres", "db-source": "message.db", "recall-window": "5m0s"},
+		},
+		{
+			name:    "command line over environment and file",
+			args:    []string{"-db-driver", "sqlite3", "-group-buffer-size", "10"},
+			environ: []string{"WSCLUSTER_DB_DRIVER=postgres"},
+			file:    "db-driver = \"mysql\"\ngroup-buffer-size = 200\n",
+			want:    map[string]string{"db-driver": "sqlite3", "group-buffer-size": "10"},
+		},
+		{
+			name:    "environment value may contain '='",
+			environ: []string{"WSCLUSTER_DB_SOURCE=user:pass@tcp(db)/ws?a=b"},
+			want:    map[string]string{"db-source": "user:pass@tcp(db)/ws?a=b"},
+		},
+		{name: "unknown environment variable", environ: []string{"WSCLUSTER_NO_SUCH=1"}, wantErr: true},
+		{name: "invalid environment variable", environ: []string{"WSCLUSTER_GROUP_BUFFER_SIZE=many"}, wantErr: true},
+		{name: "unknown key", file: "no-such = 1\n", wantErr: true},
+		{name: "config in config file", file: "config = \"other.toml\"\n", wantErr: true},
+		{name: "invalid value", file: "recall-window = \"soon\"\n", wantErr: true},
+		{name: "invalid type", file: "search = \"maybe\"\n", wantErr: true},
+		{name: "unsupported type", file: "db-driver = [\"mysql\"]\n", wantErr: true},
+		{name: "table", file: "[db]\ndriver = \"mysql\"\n", wantErr: true},
+		{name: "invalid toml", file: "db-driver = \n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(dir, tt.name+".toml")
+				if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fs := testFlagSet(path)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			err := applyConfigSources(fs, tt.environ)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyConfigSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for name, want := range tt.want {
+				if got := fs.Lookup(name).Value.String(); got != want {
+					t.Errorf("%v = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		file    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"string", "db-driver = \"mysql\"\n", map[string]string{"db-driver": "mysql"}, false},
+		{"integer", "group-buffer-size = 200\n", map[string]string{"group-buffer-size": "200"}, false},
+		{"float", "signal-rate = 2.5\n", map[string]string{"signal-rate": "2.5"}, false},
+		{"bool", "search = true\n", map[string]string{"search": "true"}, false},
+		{"array", "drain-urls = [\"ws://a\", \"ws://b\"]\n", nil, true},
+		{"table", "[db]\ndriver = \"mysql\"\n", nil, true},
+		{"datetime", "recall-window = 2019-10-20T00:00:00Z\n", nil, true},
+		{"invalid toml", "db-driver = \n", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".toml")
+			if err := ioutil.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readConfigFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readConfigFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readConfigFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readConfigFile(filepath.Join(dir, "missing.toml")); err == nil {
+		t.Errorf("readConfigFile() of a missing file succeeded")
+	}
+}
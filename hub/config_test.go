@@ -0,0 +1,9 @@
+package hub
+
+import "testing"
+
+func TestGetOutboundIP(t *testing.T) {
+	if ip := GetOutboundIP(); ip == nil {
+		t.Errorf("GetOutboundIP() = nil")
+	}
+}
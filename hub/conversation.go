@@ -0,0 +1,196 @@
+package hub
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+const (
+	// conversationConsumer name of the message log consumer updating the conversation index
+	conversationConsumer     = "conversation"
+	defaultConversationLimit = 20
+	maxConversationLimit     = 100
+)
+
+// devices of a client, a client logins with one address on each device
+var devices = []byte{wire.DeviceNone, wire.DevicePhone, wire.DevicePad, wire.DevicePc}
+
+// isReadReceipt a client has read the conversation with the dest of the message
+func isReadReceipt(message *wire.Message) bool {
+	switch message.Header.Command {
+	case wire.MsgTypeMarkRead:
+		return true
+	case wire.MsgTypeChatResp:
+		return message.Body.(*wire.MsgChatResp).State == wire.AckRead
+	}
+	return false
+}
+
+// logForConversation read receipts and membership changes are logged for the conversation index
+// even if the persist policy skips them, only by the server the client sent them to
+func (h *Hub) logForConversation(from wire.Addr, message *wire.Message) bool {
+	return h.config.conversations != nil && from.Type() == wire.AddrClient &&
+		(isReadReceipt(message) || message.Header.Command == wire.MsgTypeGroupInOut)
+}
+
+// syncRead tell the other devices of the reader that the conversation with peer is read,
+// only the devices connected to this server or located on another one, and speaking ProtocolVersion4.
+// the copies are never broadcast, and not logged by the server relaying them
+func (h *Hub) syncRead(reader, peer wire.Addr) {
+	for _, device := range devices {
+		if device == reader.Device() {
+			continue
+		}
+		dest, err := wire.NewAddr(wire.AddrClient, reader.Domain(), device, reader.Address())
+		if err != nil {
+			continue
+		}
+		message := wire.MakeEmptyHeaderMessage(wire.MsgTypeMarkRead, &wire.MsgMarkRead{Peer: peer})
+		message.Header.Source = reader
+		message.Header.Dest = *dest
+		if cpeer, ok := h.clientPeers[*dest]; ok {
+			if cpeer.Version >= wire.CommandVersion(wire.MsgTypeMarkRead) {
+				cpeer.PushMessage(message, nil)
+			}
+			continue
+		}
+		if serverAddr, has := h.location[*dest]; has {
+			if speer, ok := h.serverPeers[serverAddr]; ok {
+				speer.PushMessage(message, nil)
+			}
+		}
+	}
+}
+
+// handleConversationsPacket query conversations of a client in a new routine, like history
+func (h *Hub) handleConversationsPacket(from wire.Addr, message *wire.Message, resp chan<- *Resp) {
+	query := message.Body.(*wire.MsgConversations)
+	if _, has := h.clientPeers[from]; !has {
+		respond(resp, wire.MsgStatusForbidden)
+		return
+	}
+	if h.config.conversations == nil {
+		respond(resp, wire.MsgStatusException)
+		return
+	}
+	go func() {
+		body, err := queryConversations(h.config.conversations, from, query)
+		if resp == nil {
+			return
+		}
+		if err != nil {
+			resp <- &Resp{Status: wire.MsgStatusException, Err: err}
+			return
+		}
+		resp <- &Resp{Status: wire.MsgStatusOk, Body: body}
+	}()
+}
+
+// queryConversations conversations of addr on any device
+func queryConversations(index *database.ConversationIndex, addr wire.Addr, query *wire.MsgConversations) (*wire.MsgConversationsResp, error) {
+	limit := int(query.Limit)
+	if limit <= 0 {
+		limit = defaultConversationLimit
+	} else if limit > maxConversationLimit {
+		limit = maxConversationLimit
+	}
+	var before time.Time
+	if query.BeforeTime != 0 {
+		before = millisToTime(query.BeforeTime)
+	}
+	convs, err := index.Conversations(addr.Domain(), addr.Address(), before, limit+1) // one more to tell if there is next page
+	if err != nil {
+		return nil, err
+	}
+	resp := &wire.MsgConversationsResp{Conversations: make([]wire.Conversation, 0, len(convs))}
+	if len(convs) > limit {
+		convs = convs[:limit]
+		resp.More = true
+	}
+	for _, conv := range convs {
+		peerType := wire.AddrClient
+		lastDest := addr
+		if conv.IsGroup {
+			peerType = wire.AddrGroup
+		}
+		peer, err := wire.NewAddr(peerType, conv.PeerDomain, wire.DeviceNone, conv.Peer)
+		if err != nil {
+			continue
+		}
+		if conv.IsGroup || conv.LastFromDomain != peer.Domain() || conv.LastFrom != peer.Address() {
+			lastDest = *peer // the last message is sent to peer
+		}
+		last := historyMsg(lastDest.Type(), 0, conv.LastMsgID, conv.LastFromDomain, conv.LastFrom,
+			lastDest.Domain(), lastDest.Address(), conv.LastType, conv.LastText, conv.LastExtra, conv.LastAt, time.Time{}, false)
+		unread := conv.Unread()
+		if unread > uint64(^uint32(0)) {
+			unread = uint64(^uint32(0))
+		}
+		resp.Conversations = append(resp.Conversations, wire.Conversation{
+			Peer:      *peer,
+			Last:      last,
+			Unread:    uint32(unread),
+			ReadMsgID: conv.ReadMsgID,
+		})
+	}
+	return resp, nil
+}
+
+// updateConversations update the conversation index by logged chat messages saved by the persist policy,
+// read receipts and membership changes
+func updateConversations(index *database.ConversationIndex, policy *persistPolicy, bufs []*bytes.Buffer) error {
+	for _, buf := range bufs {
+		packet := new(wire.Message)
+		if err := packet.Decode(buf); err != nil {
+			hubLog.Error("decode logged message failed", logger.Err(err))
+			continue
+		}
+		header := packet.Header
+		source, dest := header.Source, header.Dest
+		var err error
+		switch header.Command {
+		case wire.MsgTypeChat:
+			body := packet.Body.(*wire.Msgchat)
+			if body.MsgID == 0 || policy.action(header) != persistSave {
+				continue
+			}
+			createAt := msgIDTime(body.MsgID)
+			if dest.Type() == wire.AddrClient {
+				err = index.AddChatMsg(&database.ChatMsg{FromDomain: source.Domain(), From: source.Address(), ToDomain: dest.Domain(),
+					To: dest.Address(), Type: body.Type, Text: body.Text, Extra: body.Extra, CreateAt: createAt, MsgID: body.MsgID})
+			} else if dest.Type() == wire.AddrGroup {
+				err = index.AddGroupMsg(&database.GroupMsg{FromDomain: source.Domain(), From: source.Address(), ToDomain: dest.Domain(),
+					To: dest.Address(), Type: body.Type, Text: body.Text, Extra: body.Extra, CreateAt: createAt, MsgID: body.MsgID})
+			}
+		case wire.MsgTypeChatResp:
+			if isReadReceipt(packet) && dest.Type() == wire.AddrClient {
+				err = index.MarkRead(source.Domain(), source.Address(), false, dest.Domain(), dest.Address())
+			}
+		case wire.MsgTypeMarkRead:
+			peer := packet.Body.(*wire.MsgMarkRead).Peer
+			if peer.Type() == wire.AddrClient || peer.Type() == wire.AddrGroup {
+				err = index.MarkRead(source.Domain(), source.Address(), peer.Type() == wire.AddrGroup, peer.Domain(), peer.Address())
+			}
+		case wire.MsgTypeGroupInOut:
+			body := packet.Body.(*wire.MsgGroupInOut)
+			for _, group := range body.Groups {
+				if body.InOut == wire.GroupIn {
+					err = index.JoinGroup(source.Domain(), source.Address(), group.Domain(), group.Address())
+				} else {
+					err = index.LeaveGroup(source.Domain(), source.Address(), group.Domain(), group.Address())
+				}
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
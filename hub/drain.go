@@ -0,0 +1,91 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+const (
+	// drainCheckInterval interval of checking if all clients have left while draining
+	drainCheckInterval = 100 * time.Millisecond
+	// closeTimeout peers are waited this long to be closed on closing hub
+	closeTimeout = 10 * time.Second
+)
+
+// closingPeers done channels of the peers closed by handleClosePacket
+type closingPeers struct {
+	done []<-chan struct{}
+}
+
+// Drain stop accepting clients and tell connected clients to reconnect to other servers,
+// then close the hub when all of them have left or the drain timeout is reached
+func (h *Hub) Drain() {
+	if !atomic.CompareAndSwapInt32(&h.draining, 0, 1) {
+		return
+	}
+	deadline := time.Now().Add(h.config.live().DrainTimeout)
+	resp := make(chan *Resp, 1)
+	h.packetQueue <- &Packet{from: h.Server.Addr, use: useForDrain, content: deadline, resp: resp}
+	<-resp
+	h.log.Info("draining", logger.F("clients", atomic.LoadInt32(&h.clientCount)), logger.F("deadline", deadline.Format(time.RFC3339)))
+
+	ticker := time.NewTicker(drainCheckInterval)
+	for atomic.LoadInt32(&h.clientCount) > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+	ticker.Stop()
+	h.log.Info("drained", logger.F("clients", atomic.LoadInt32(&h.clientCount)))
+	h.Close()
+}
+
+// isDraining new clients are refused while draining
+func (h *Hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// handleDrainPacket send MsgDrain to all clients speaking ProtocolVersion5,
+// the older ones only get the close frame at the deadline
+func (h *Hub) handleDrainPacket(deadline time.Time, resp chan<- *Resp) {
+	body := &wire.MsgDrain{URLs: h.drainURLs(), Deadline: uint64(deadline.UnixNano() / 1000000)}
+	for addr, cpeer := range h.clientPeers {
+		if cpeer.Version < wire.CommandVersion(wire.MsgTypeDrain) {
+			continue
+		}
+		// a message is sent once, the header is changed when it is written
+		message := wire.MakeEmptyHeaderMessage(wire.MsgTypeDrain, body)
+		message.Header.Source = h.Server.Addr
+		message.Header.Dest = addr
+		cpeer.PushMessage(message, nil)
+	}
+	respond(resp, wire.MsgStatusOk)
+}
+
+// handleClosePacket close all peers, queued messages are written before the close frame
+func (h *Hub) handleClosePacket(closing *closingPeers, resp chan<- *Resp) {
+	for _, speer := range h.serverPeers {
+		closing.done = append(closing.done, speer.Done())
+		speer.Close()
+	}
+	for _, cpeer := range h.clientPeers {
+		closing.done = append(closing.done, cpeer.Done())
+		cpeer.Close()
+	}
+	respond(resp, wire.MsgStatusOk)
+}
+
+// drainURLs -drain-urls, or client urls of the other servers in cluster
+func (h *Hub) drainURLs() []string {
+	if urls := h.config.live().DrainURLs; len(urls) > 0 {
+		return urls
+	}
+	urls := make([]string, 0, len(h.serverPeers))
+	for _, speer := range h.serverPeers {
+		if speer.Server.AdvertiseClientURL != nil {
+			urls = append(urls, speer.Server.AdvertiseClientURL.String())
+		}
+	}
+	return urls
+}
@@ -0,0 +1,180 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/filelog"
+	"github.com/ws-cluster/wire"
+)
+
+const replayBatchSize = 100
+
+// messageView readable form of a wire.Message
+type messageView struct {
+	Command uint8
+	Source  string
+	Dest    string
+	Seq     uint32
+	AckSeq  uint32
+	Status  uint8
+	Body    wire.Protocol
+}
+
+// recordView a record of filelog, Message is nil if it can't be decoded
+type recordView struct {
+	Block   int
+	Message *messageView `json:",omitempty"`
+	Error   string       `json:",omitempty"`
+	Raw     []byte       `json:",omitempty"`
+}
+
+// filelogMain run `wscluster filelog dump|replay`
+func filelogMain(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: wscluster filelog dump|replay [options]")
+	}
+	fs := flag.NewFlagSet("filelog "+args[0], flag.ExitOnError)
+	path := fs.String("path", filepath.Join(defaultDataDir, defaultMessageDir), "segment directory of message log, or a legacy single file log such as data/message.log")
+	from := fs.Int("from", 0, "index of the first block")
+	to := fs.Int("to", 0, "index of the block after the last one, 0 means to the end")
+	switch args[0] {
+	case "dump":
+		blocks := fs.Bool("blocks", false, "print block headers")
+		fs.Parse(args[1:])
+		return dumpFileLog(os.Stdout, *path, *from, *to, *blocks)
+	case "replay":
+		driver := fs.String("db-driver", defaultDbDriver, "database dirver, mysql or sqlite3")
+		source := fs.String("db-source", "", "database source, eg: user:password@tcp(ip:port)/dbname for mysql, a file path for sqlite3")
+		persist := fs.String("persist-policy", defaultPersistPolicy, "rules of saving messages, see the option of server")
+		fs.Parse(args[1:])
+		if *source == "" {
+			return errors.New("-db-source is required")
+		}
+		policy, err := parsePersistPolicy(*persist)
+		if err != nil {
+			return err
+		}
+		engine, err := database.InitDb(*driver, *source)
+		if err != nil {
+			return err
+		}
+		return replayFileLog(*path, *from, *to, database.NewDbMessageStore(engine), policy)
+	default:
+		return fmt.Errorf("unknown filelog command %v", args[0])
+	}
+}
+
+// dumpFileLog print offsets, then blocks and records as json lines
+func dumpFileLog(w io.Writer, path string, from, to int, blocks bool) error {
+	reader, err := filelog.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	encoder := json.NewEncoder(w)
+	first, end := reader.Range()
+	header := struct {
+		Path       string
+		FirstBlock int
+		WriteBlock int
+		Offsets    map[string]int
+	}{path, first, end, reader.Offsets()}
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	var onBlock func(filelog.BlockInfo) error
+	if blocks {
+		onBlock = func(info filelog.BlockInfo) error {
+			return encoder.Encode(struct{ Header filelog.BlockInfo }{info})
+		}
+	}
+	return reader.Scan(from, to, onBlock, func(record filelog.Record) error {
+		return encoder.Encode(decodeRecord(record))
+	})
+}
+
+func decodeRecord(record filelog.Record) *recordView {
+	view := &recordView{Block: record.Block}
+	message := new(wire.Message)
+	if err := message.Decode(bytes.NewReader(record.Data)); err != nil {
+		view.Error = err.Error()
+		view.Raw = record.Data
+		return view
+	}
+	header := message.Header
+	view.Message = &messageView{
+		Command: header.Command,
+		Source:  header.Source.String(),
+		Dest:    header.Dest.String(),
+		Seq:     header.Seq,
+		AckSeq:  header.AckSeq,
+		Status:  header.Status,
+		Body:    message.Body,
+	}
+	return view
+}
+
+// replayable a record is replayed if saving it again changes nothing: a chat message with msg id is
+// skipped by the store if it is saved, recalls and edits are idempotent. Chat messages without msg id
+// and group audits can't be told from saved ones, they are skipped.
+func replayable(data []byte) bool {
+	message := new(wire.Message)
+	if err := message.Decode(bytes.NewReader(data)); err != nil {
+		return false
+	}
+	switch message.Header.Command {
+	case wire.MsgTypeChat:
+		return message.Body.(*wire.Msgchat).MsgID != 0
+	case wire.MsgTypeRecall, wire.MsgTypeEdit:
+		return true
+	}
+	return false
+}
+
+// replayFileLog save records in the range to the store again, messages already saved are skipped
+func replayFileLog(path string, from, to int, ms database.MessageStore, policy *persistPolicy) error {
+	reader, err := filelog.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	batch := make([]*bytes.Buffer, 0, replayBatchSize)
+	replayed, skipped := 0, 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := saveMessagesToDb(ms, policy, batch); err != nil {
+			return err
+		}
+		replayed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	err = reader.Scan(from, to, nil, func(record filelog.Record) error {
+		if !replayable(record.Data) {
+			skipped++
+			return nil
+		}
+		batch = append(batch, bytes.NewBuffer(record.Data))
+		if len(batch) < replayBatchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil {
+		err = flush()
+	}
+	fmt.Fprintf(os.Stderr, "%v records are replayed, %v are skipped\n", replayed, skipped)
+	return err
+}
@@ -0,0 +1,35 @@
+package hub
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ws-cluster/wire"
+)
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		name    string
+		command uint8
+		body    wire.Protocol
+		want    bool
+	}{
+		{"chat", wire.MsgTypeChat, &wire.Msgchat{Type: 1, Text: "hi", MsgID: 1}, true},
+		{"chat without msg id", wire.MsgTypeChat, &wire.Msgchat{Type: 1, Text: "hi"}, false},
+		{"recall", wire.MsgTypeRecall, &wire.MsgRecall{MsgID: 1}, true},
+		{"edit", wire.MsgTypeEdit, &wire.MsgEdit{MsgID: 1, Text: "hey"}, true},
+		{"group audit", wire.MsgTypeGroupInOut, &wire.MsgGroupInOut{InOut: wire.GroupIn, Groups: []wire.Addr{}}, false},
+	}
+	for _, tt := range tests {
+		buf := &bytes.Buffer{}
+		if err := wire.MakeEmptyHeaderMessage(tt.command, tt.body).Encode(buf); err != nil {
+			t.Fatal(err)
+		}
+		if got := replayable(buf.Bytes()); got != tt.want {
+			t.Errorf("%v: replayable() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if replayable([]byte{1, 2, 3}) {
+		t.Errorf("replayable() = true for a broken record")
+	}
+}
@@ -1,6 +1,12 @@
 package hub
 
-import "github.com/ws-cluster/wire"
+import (
+	"sync/atomic"
+
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/tracing"
+	"github.com/ws-cluster/wire"
+)
 
 const (
 	useForJoin    = uint8(1)
@@ -8,6 +14,8 @@ const (
 	useForMessage = uint8(5)
 )
 
+var groupLog = logger.New("group")
+
 // GroupPacket use for Join Leave message
 type GroupPacket struct {
 	use     uint8
@@ -18,18 +26,22 @@ type GroupPacket struct {
 type Group struct {
 	Addr     wire.Addr
 	Members  map[wire.Addr]*ClientPeer
-	MemCount int
+	MemCount int32 // changed in loop, read by Size
 	packet   chan *GroupPacket
 	exit     chan struct{}
+	log      *logger.Logger
+	tracer   *tracing.Tracer
 }
 
 // NewGroup NewGroup
-func NewGroup(addr wire.Addr, buf int) *Group {
+func NewGroup(addr wire.Addr, buf int, tracer *tracing.Tracer) *Group {
 	group := &Group{
 		Addr:    addr,
 		Members: make(map[wire.Addr]*ClientPeer),
 		packet:  make(chan *GroupPacket, buf),
 		exit:    make(chan struct{}, 1),
+		log:     groupLog.With(logger.F("group", addr.String())),
+		tracer:  tracer,
 	}
 	go group.loop()
 
@@ -42,17 +54,22 @@ func (g *Group) loop() {
 		case packet := <-g.packet:
 			if packet.use == useForMessage {
 				message := packet.content.(*wire.Message)
+				span := g.tracer.StartChild(traceParent(message.Header), spanGroupDeliver, tracing.KindConsumer,
+					tracing.Attr("wscluster.members", len(g.Members)))
 				for _, peer := range g.Members {
 					peer.PushMessage(message, nil)
 				}
+				span.End()
 			} else {
 				peer := packet.content.(*ClientPeer)
 				if packet.use == useForJoin {
 					g.Members[peer.Addr] = peer
-					g.MemCount++
+					atomic.AddInt32(&g.MemCount, 1)
+					g.log.Debug("member joined", logger.F(logger.KeyPeer, peer.Addr.String()), logger.F("members", len(g.Members)))
 				} else {
 					delete(g.Members, peer.Addr)
-					g.MemCount--
+					atomic.AddInt32(&g.MemCount, -1)
+					g.log.Debug("member left", logger.F(logger.KeyPeer, peer.Addr.String()), logger.F("members", len(g.Members)))
 				}
 			}
 		case <-g.exit:
@@ -61,6 +78,11 @@ func (g *Group) loop() {
 	}
 }
 
+// Size count of members
+func (g *Group) Size() int {
+	return int(atomic.LoadInt32(&g.MemCount))
+}
+
 // Exit stop group loop
 func (g *Group) Exit() {
 	g.exit <- struct{}{}
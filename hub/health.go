@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ws-cluster/wire"
+)
+
+// defaultHealthTimeout checks of health and readiness fail if they take longer
+const defaultHealthTimeout = 2 * time.Second
+
+// 存活检查，hub 的处理循环在超时内响应即为存活
+// /healthz
+func healthzHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if _, err := hub.probe(defaultHealthTimeout); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// 就绪检查，启动中、drain 中、与集群断开或数据库不可用时返回 503 及原因
+// /readyz
+func readyzHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	reasons := hub.notReady()
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(reasons, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// notReady reasons why the node shouldn't receive clients
+func (h *Hub) notReady() []string {
+	reasons := make([]string, 0)
+	if atomic.LoadInt32(&h.started) == 0 {
+		return append(reasons, "starting")
+	}
+	if h.isDraining() {
+		reasons = append(reasons, "draining")
+	}
+	snapshot, err := h.probe(defaultHealthTimeout)
+	if err != nil {
+		reasons = append(reasons, err.Error())
+	} else if h.partitioned(snapshot) {
+		reasons = append(reasons, "cluster partitioned")
+	}
+	if h.config.ms != nil {
+		if err := h.pingStore(defaultHealthTimeout); err != nil {
+			reasons = append(reasons, "message store: "+err.Error())
+		}
+	}
+	return reasons
+}
+
+// partitioned no other server is connected, while the cluster seed knows some or is unreachable
+func (h *Hub) partitioned(snapshot *hubSnapshot) bool {
+	if h.config.sc.ClusterSeedURL == "" {
+		return false
+	}
+	for _, connected := range snapshot.servers {
+		if connected {
+			return false
+		}
+	}
+	client := &http.Client{Timeout: defaultHealthTimeout}
+	resp, err := client.Get(fmt.Sprintf("%v/q/servers", h.config.sc.ClusterSeedURL))
+	if err != nil {
+		return true
+	}
+	defer resp.Body.Close()
+	var servers []wire.Server
+	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
+		return true
+	}
+	for _, server := range servers {
+		if server.Addr != h.Server.Addr.String() {
+			return true
+		}
+	}
+	return false // a single node
+}
+
+// pingStore ping the message store with a timeout
+func (h *Hub) pingStore(timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.config.ms.Ping()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("ping timeout")
+	}
+}
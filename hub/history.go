@@ -0,0 +1,134 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/wire"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// handleHistoryPacket query history for a client, a client can only read its own conversations
+// and the groups it joined. The query runs in a new routine, so the hub is never blocked by database.
+func (h *Hub) handleHistoryPacket(from wire.Addr, message *wire.Message, resp chan<- *Resp) {
+	query := message.Body.(*wire.MsgHistory)
+	cpeer, has := h.clientPeers[from]
+	if !has {
+		respond(resp, wire.MsgStatusForbidden)
+		return
+	}
+	if query.Peer.Type() == wire.AddrGroup && !cpeer.Groups.Contains(query.Peer) {
+		respond(resp, wire.MsgStatusForbidden)
+		return
+	}
+	if h.config.ms == nil {
+		respond(resp, wire.MsgStatusException)
+		return
+	}
+	go func() {
+		body, err := queryHistory(h.config.ms, from, query)
+		if resp == nil {
+			return
+		}
+		if err != nil {
+			resp <- &Resp{Status: wire.MsgStatusException, Err: err}
+			return
+		}
+		resp <- &Resp{Status: wire.MsgStatusOk, Body: body}
+	}()
+}
+
+// queryHistory query the conversation between addr and query.Peer, or the timeline of group query.Peer
+func queryHistory(ms database.MessageStore, addr wire.Addr, query *wire.MsgHistory) (*wire.MsgHistoryResp, error) {
+	limit := int(query.Limit)
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	} else if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	q := &database.HistoryQuery{
+		BeforeID: query.BeforeID,
+		AfterID:  query.AfterID,
+		Limit:    limit + 1, // one more to tell if there is next page
+	}
+	if query.BeforeTime != 0 {
+		q.BeforeTime = millisToTime(query.BeforeTime)
+	}
+	if query.AfterTime != 0 {
+		q.AfterTime = millisToTime(query.AfterTime)
+	}
+
+	resp := &wire.MsgHistoryResp{Messages: make([]wire.HistoryMsg, 0, limit)}
+	peer := query.Peer
+	switch peer.Type() {
+	case wire.AddrClient:
+		msgs, err := ms.QueryChatMsg(addr.Domain(), addr.Address(), peer.Domain(), peer.Address(), q)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			resp.Messages = append(resp.Messages, historyMsg(wire.AddrClient, msg.ID, msg.MsgID, msg.FromDomain, msg.From,
+				msg.ToDomain, msg.To, msg.Type, msg.Text, msg.Extra, msg.CreateAt, msg.EditAt, msg.Recalled))
+		}
+	case wire.AddrGroup:
+		msgs, err := ms.QueryGroupMsg(peer.Domain(), peer.Address(), q)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			resp.Messages = append(resp.Messages, historyMsg(wire.AddrGroup, msg.ID, msg.MsgID, msg.FromDomain, msg.From,
+				msg.ToDomain, msg.To, msg.Type, msg.Text, msg.Extra, msg.CreateAt, msg.EditAt, msg.Recalled))
+		}
+	default:
+		return nil, wire.ErrInvaildAddress
+	}
+	if len(resp.Messages) > limit {
+		resp.Messages = resp.Messages[:limit]
+		resp.More = true
+	}
+	return resp, nil
+}
+
+func historyMsg(destType byte, id, msgID uint64, fromDomain uint32, from string, toDomain uint32, to string,
+	typ uint8, text, extra string, createAt, editAt time.Time, recalled bool) wire.HistoryMsg {
+	// the device isn't saved
+	source, _ := wire.NewAddr(wire.AddrClient, fromDomain, wire.DeviceNone, from)
+	dest, _ := wire.NewAddr(destType, toDomain, wire.DeviceNone, to)
+	msg := wire.HistoryMsg{
+		ID:       id,
+		MsgID:    msgID,
+		Type:     typ,
+		Text:     text,
+		Extra:    extra,
+		CreateAt: timeToMillis(createAt),
+		EditAt:   timeToMillis(editAt),
+		Recalled: recalled,
+	}
+	if source != nil {
+		msg.Source = *source
+	}
+	if dest != nil {
+		msg.Dest = *dest
+	}
+	return msg
+}
+
+func skipMessageLog(command uint8) bool {
+	return command == wire.MsgTypeFileChunk || command == wire.MsgTypeHistory ||
+		command == wire.MsgTypeTap || command == wire.MsgTypeTapEvent
+}
+
+func millisToTime(ms uint64) time.Time {
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+func timeToMillis(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano() / int64(time.Millisecond))
+}
@@ -6,12 +6,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/ws-cluster/logger"
 	"github.com/ws-cluster/wire"
 )
 
@@ -35,20 +36,40 @@ func httplisten(hub *Hub, conf *serverConfig) {
 		httpQueryClientOnlineHandler(hub, w, r)
 	})
 
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthzHandler(hub, w, r)
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		readyzHandler(hub, w, r)
+	})
+
 	http.HandleFunc("/q/servers", func(w http.ResponseWriter, r *http.Request) {
 		httpQueryServersHandler(hub, w, r)
 	})
 
-	log.Println("listen on ", conf.ListenHost)
+	http.HandleFunc("/q/history", func(w http.ResponseWriter, r *http.Request) {
+		httpQueryHistoryHandler(hub, w, r)
+	})
+
+	http.HandleFunc("/q/conversations", func(w http.ResponseWriter, r *http.Request) {
+		httpQueryConversationsHandler(hub, w, r)
+	})
+
+	hub.log.Info("listen", logger.F("host", conf.ListenHost))
 	err := http.ListenAndServe(conf.ListenHost, nil)
 	if err != nil {
-		log.Println("ListenAndServe: ", err)
+		hub.log.Error("listen failed", logger.F("host", conf.ListenHost), logger.Err(err))
 		return
 	}
 }
 
 // 处理来自客户端节点的连接
 func handleClientWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if hub.isDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	q := r.URL.Query()
 	addr := q.Get("addr") //  /p/domain/1/id
 	nonce := q.Get("nonce")
@@ -57,6 +78,13 @@ func handleClientWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	if q.Get("notice") == "1" {
 		offlineNotice = uint8(1)
 	}
+	// protocol version declared by client, legacy client doesn't send it
+	ver := q.Get("ver")
+	var declared uint64
+	var verErr error
+	if ver != "" {
+		declared, verErr = strconv.ParseUint(ver, 10, 16)
+	}
 
 	if addr == "" || nonce == "" || digest == "" {
 		// 错误处理，断开
@@ -64,13 +92,12 @@ func handleClientWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// 校验digest及数据完整性
-	if !checkDigest(hub.config.sc.ClientToken, fmt.Sprintf("%v%v", addr, nonce), digest) {
+	if !hub.config.live().checkClientDigest(fmt.Sprintf("%v%v", addr, nonce), digest) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	peerAddr, err := wire.ParseClientAddr(addr)
 	if err != nil {
-		log.Println("address error", addr)
 		handleHTTPErr(w, err)
 		return
 	}
@@ -82,7 +109,22 @@ func handleClientWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientPeer, err := newClientPeer(*peerAddr, r.RemoteAddr, offlineNotice, hub, conn)
+	version, err := wire.NegotiateVersion(uint16(declared))
+	if verErr != nil { // a malformed version isn't taken as legacy
+		err = fmt.Errorf("invalid protocol version %q", ver)
+	}
+	if err == nil && !peerAddr.IsLegacy() && version < wire.ProtocolVersion2 {
+		err = fmt.Errorf("address longer than 26 bytes requires protocol version %d", wire.ProtocolVersion2)
+	}
+	if err != nil {
+		// close with a clear code, so that client knows it must upgrade
+		hub.log.Warn("client refused", logger.F(logger.KeyPeer, addr), logger.F(logger.KeyRemote, r.RemoteAddr), logger.Err(err))
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(wire.CloseUnsupportedVersion, err.Error()), time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	clientPeer, err := newClientPeer(*peerAddr, r.RemoteAddr, offlineNotice, version, hub, conn)
 
 	if err != nil {
 		handleHTTPErr(w, err)
@@ -96,10 +138,15 @@ func handleClientWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		handleHTTPErr(w, err)
 		return
 	}
-	log.Printf("client %v@%v connected", addr, r.RemoteAddr)
+	clientPeer.Logger().Info("client connected", logger.F("version", version))
 	ack := wire.MakeEmptyHeaderMessage(wire.MsgTypeLoginAck, &wire.MsgLoginAck{
-		RemoteAddr: r.RemoteAddr,
-		LoginAt:    uint64(time.Now().UnixNano() / 1000000),
+		RemoteAddr:     r.RemoteAddr,
+		LoginAt:        uint64(time.Now().UnixNano() / 1000000),
+		Version:        version,
+		MinVersion:     wire.ProtocolVersionMin,
+		MaxVersion:     wire.ProtocolVersionMax,
+		Features:       hub.features(),
+		MaxMessageSize: uint32(hub.config.cpc.MaxMessageSize),
 	})
 	clientPeer.PushMessage(ack, nil)
 }
@@ -130,25 +177,27 @@ func handleServerWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// 校验digest及数据完整性
-	if !checkDigest(hub.config.sc.ServerToken, addrstr, digest) {
+	if !hub.config.live().checkServerDigest(addrstr, digest) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	conn, err := supgrader.Upgrade(w, r, nil)
+	features := http.Header{}
+	features.Set("features", strconv.FormatUint(uint64(serverFeatures), 10))
+	conn, err := supgrader.Upgrade(w, r, features)
 	if err != nil {
-		log.Println(err)
+		hub.log.Warn("upgrade failed", logger.F(logger.KeyPeer, addrstr), logger.F(logger.KeyRemote, r.RemoteAddr), logger.Err(err))
 		return
 	}
 
 	serverPeer, err := bindServerPeer(hub, conn, &Server{
 		Addr:               *serverAddr,
-		Token:              hub.config.sc.ServerToken,
+		Token:              hub.config.live().ServerToken,
 		AdvertiseClientURL: clientURL,
 		AdvertiseServerURL: serverURL,
-	}, r.RemoteAddr)
+	}, r.RemoteAddr, remoteFeatures(r.Header))
 	if err != nil {
-		log.Println(err)
+		hub.log.Warn("bind server failed", logger.F(logger.KeyPeer, addrstr), logger.F(logger.KeyRemote, r.RemoteAddr), logger.Err(err))
 		return
 	}
 
@@ -161,7 +210,7 @@ func handleServerWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		handleHTTPErr(w, err)
 		return
 	}
-	log.Printf("server %v connected", serverAddr.String())
+	serverPeer.Logger().Info("server connected")
 }
 
 // MsgBody MsgBody
@@ -181,7 +230,7 @@ func httpSendMsgHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Println("httpSendMsg ", r.RemoteAddr, body.Dest)
+	hub.log.Debug("http send message", logger.F(logger.KeyRemote, r.RemoteAddr), logger.F("source", body.Source), logger.F("dest", body.Dest))
 
 	msg := wire.MakeEmptyHeaderMessage(wire.MsgTypeChat, &wire.Msgchat{
 		Text:  body.Text,
@@ -249,6 +298,146 @@ func httpQueryServersHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	res.Encode(w)
 }
 
+// historyView json form of wire.HistoryMsg
+type historyView struct {
+	ID       uint64
+	MsgID    uint64
+	Source   string
+	Dest     string
+	Type     uint8
+	Text     string
+	Extra    string
+	CreateAt uint64
+	EditAt   uint64
+	Recalled bool
+}
+
+// 查询单聊历史消息, addr 是查询者，签名方式与客户端登录相同。
+// 群成员只记录在连接上，这里无法检查，群历史消息只能通过 websocket 查询
+// /q/history?addr=&nonce=&digest=&peer=&before_id=&after_id=&before=&after=&limit=
+func httpQueryHistoryHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	addr, nonce, digest := q.Get("addr"), q.Get("nonce"), q.Get("digest")
+	if !hub.config.live().checkClientDigest(fmt.Sprintf("%v%v", addr, nonce), digest) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	client, err := wire.ParseClientAddr(addr)
+	if err != nil {
+		handleHTTPErr(w, err)
+		return
+	}
+	peer, err := wire.ParseAddr(q.Get("peer"))
+	if err != nil {
+		handleHTTPErr(w, err)
+		return
+	}
+	if peer.Type() == wire.AddrGroup {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if hub.config.ms == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := &wire.MsgHistory{Peer: *peer}
+	query.BeforeID, _ = strconv.ParseUint(q.Get("before_id"), 10, 64)
+	query.AfterID, _ = strconv.ParseUint(q.Get("after_id"), 10, 64)
+	query.BeforeTime, _ = strconv.ParseUint(q.Get("before"), 10, 64)
+	query.AfterTime, _ = strconv.ParseUint(q.Get("after"), 10, 64)
+	limit, _ := strconv.ParseUint(q.Get("limit"), 10, 16)
+	query.Limit = uint16(limit)
+
+	history, err := queryHistory(hub.config.ms, *client, query)
+	if err != nil {
+		hub.log.Error("query failed", logger.F("path", r.URL.Path), logger.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Messages []historyView
+		More     bool
+	}{make([]historyView, 0, len(history.Messages)), history.More}
+	for _, msg := range history.Messages {
+		res.Messages = append(res.Messages, historyView{
+			ID:       msg.ID,
+			MsgID:    msg.MsgID,
+			Source:   msg.Source.String(),
+			Dest:     msg.Dest.String(),
+			Type:     msg.Type,
+			Text:     msg.Text,
+			Extra:    msg.Extra,
+			CreateAt: msg.CreateAt,
+			EditAt:   msg.EditAt,
+			Recalled: msg.Recalled,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// conversationView json form of wire.Conversation
+type conversationView struct {
+	Peer      string
+	Last      historyView
+	Unread    uint32
+	ReadMsgID uint64
+}
+
+// 查询会话列表, addr 是查询者，签名方式与客户端登录相同
+// /q/conversations?addr=&nonce=&digest=&before=&limit=
+func httpQueryConversationsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	addr, nonce, digest := q.Get("addr"), q.Get("nonce"), q.Get("digest")
+	if !hub.config.live().checkClientDigest(fmt.Sprintf("%v%v", addr, nonce), digest) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	client, err := wire.ParseClientAddr(addr)
+	if err != nil {
+		handleHTTPErr(w, err)
+		return
+	}
+	if hub.config.conversations == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := new(wire.MsgConversations)
+	query.BeforeTime, _ = strconv.ParseUint(q.Get("before"), 10, 64)
+	limit, _ := strconv.ParseUint(q.Get("limit"), 10, 16)
+	query.Limit = uint16(limit)
+
+	convs, err := queryConversations(hub.config.conversations, *client, query)
+	if err != nil {
+		hub.log.Error("query failed", logger.F("path", r.URL.Path), logger.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Conversations []conversationView
+		More          bool
+	}{make([]conversationView, 0, len(convs.Conversations)), convs.More}
+	for _, conv := range convs.Conversations {
+		last := conv.Last
+		res.Conversations = append(res.Conversations, conversationView{
+			Peer: conv.Peer.String(),
+			Last: historyView{
+				MsgID:    last.MsgID,
+				Source:   last.Source.String(),
+				Dest:     last.Dest.String(),
+				Type:     last.Type,
+				Text:     last.Text,
+				Extra:    last.Extra,
+				CreateAt: last.CreateAt,
+			},
+			Unread:    conv.Unread,
+			ReadMsgID: conv.ReadMsgID,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
 func checkDigest(secret, text, digest string) bool {
 	h := md5.New()
 	io.WriteString(h, text)
@@ -259,6 +448,6 @@ func checkDigest(secret, text, digest string) bool {
 func handleHTTPErr(w http.ResponseWriter, err error) {
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
+		hubLog.Warn("bad request", logger.Err(err))
 	}
-	log.Println(err)
 }
@@ -6,10 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,6 +17,8 @@ import (
 	// cmap "github.com/orcaman/concurrent-map"
 	"github.com/ws-cluster/database"
 	"github.com/ws-cluster/filelog"
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/tracing"
 	"github.com/ws-cluster/wire"
 )
 
@@ -28,11 +30,27 @@ const (
 	useForAddServerPeer = uint8(3)
 	useForDelServerPeer = uint8(4)
 	useForRelayMessage  = uint8(5)
+	useForDrain         = uint8(6)
+	useForProbe         = uint8(7)
+	useForAddTap        = uint8(8)
+	useForDelTap        = uint8(9)
+	useForModify        = uint8(10)
+	useForClose         = uint8(11)
+
+	// ephemeral messages are dropped when there are more pending messages than this
+	ephemeralDropLen = 64
 )
 
 var (
 	// ErrPeerNoFound peer is not in this server
 	ErrPeerNoFound = errors.New("peer is not in this server")
+	// ErrAddrUnsupported the dest client speaks a protocol version which can't decode an address of the message
+	ErrAddrUnsupported = errors.New("address is not supported by the protocol version of dest client")
+)
+
+var (
+	hubLog  = logger.New("hub")
+	peerLog = logger.New("peer")
 )
 
 // Resp Resp
@@ -48,6 +66,7 @@ type Packet struct {
 	use     uint8
 	content interface{}
 	resp    chan *Resp
+	queued  *tracing.Span // hub.queue span of a traced message, ended by packetHandler
 }
 
 // Server 服务器对象
@@ -69,45 +88,100 @@ type Hub struct {
 	serverPeers map[wire.Addr]*ServerPeer
 	groups      map[wire.Addr]*Group
 	location    map[wire.Addr]wire.Addr // client location in server
+	transfers   map[transferKey]*transfer
+	recent      map[uint64]*recentMsg // chat messages in recall window
+	msgIDs      *idGenerator
 
 	messageLog *filelog.FileLog
+	metrics    *hubMetrics
+	log        *logger.Logger
+	tracer     *tracing.Tracer // nil if tracing is disabled
+
+	taps         map[tapKey]*tap // taps opened on this server and the other servers
+	tapSeq       uint64          // id of the last tap opened on this server
+	tapRefreshed time.Time
 
 	packetQueue     chan *Packet
 	packetRelay     chan *Packet
 	packetRelayDone chan *Packet
 	quit            chan struct{}
+	closeOnce       sync.Once
+	draining        int32 // set by Drain
+	started         int32 // set by Run when handlers are started
+	clientCount     int32 // len(clientPeers), it is read while draining
 }
 
 // NewHub 创建一个 Server 对象，并初始化
 func NewHub(conf *Config) (*Hub, error) {
 	var upgrader = &websocket.Upgrader{
-		ReadBufferSize:  conf.cpc.MaxMessageSize,
-		WriteBufferSize: conf.cpc.MaxMessageSize,
+		ReadBufferSize:    conf.cpc.MaxMessageSize,
+		WriteBufferSize:   conf.cpc.MaxMessageSize,
+		EnableCompression: conf.cpc.Compression,
 		CheckOrigin: func(r *http.Request) bool {
-			if conf.sc.Origins == "*" {
-				return true
-			}
 			rOrigin := r.Header.Get("Origin")
-			if strings.Contains(conf.sc.Origins, rOrigin) {
+			if conf.live().checkOrigin(rOrigin) {
 				return true
 			}
-			log.Println("refuse", rOrigin)
+			hubLog.Warn("origin refused", logger.F("origin", rOrigin), logger.F(logger.KeyRemote, r.RemoteAddr))
 			return false
 		},
 	}
 
+	metrics := newHubMetrics()
 	var messageLog *filelog.FileLog
-	if conf.ms != nil {
+	if conf.ms != nil || conf.index != nil {
 		messageLogConfig := &filelog.Config{
-			File: conf.sc.MessageFile,
-			SubFunc: func(msgs []*bytes.Buffer) error {
-				return saveMessagesToDb(conf.ms, msgs)
-			},
+			Dir:            conf.sc.MessageDir,
+			Legacy:         conf.sc.MessageFile,
+			Sync:           conf.sc.MessageLogSync,
+			SyncInterval:   conf.sc.MessageLogInterval,
+			MaxRetries:     conf.sc.MessageLogRetries,
+			RetryBackoff:   conf.sc.MessageLogBackoff,
+			MaxBackoff:     conf.sc.MessageLogMaxWait,
+			SegmentSize:    conf.sc.SegmentSize,
+			SegmentAge:     conf.sc.SegmentAge,
+			RetentionAge:   conf.sc.RetentionAge,
+			RetentionSize:  conf.sc.RetentionSize,
+			ConsumerMaxLag: conf.sc.ConsumerMaxLag,
+			KeepConsumed:   conf.sc.KeepConsumed,
+			Logger:         logger.New("filelog").With(logger.F("dir", conf.sc.MessageDir)),
+		}
+		if conf.ms != nil {
+			messageLogConfig.SubFunc = func(msgs []*bytes.Buffer) error {
+				start := time.Now()
+				err := saveMessagesToDb(conf.ms, conf.persist, msgs)
+				metrics.storeLatency.Observe(time.Since(start).Seconds())
+				return err
+			}
+		}
+		var err error
+		messageLog, err = filelog.NewFileLog(messageLogConfig)
+		if err != nil {
+			return nil, err
+		}
+		if conf.index != nil {
+			err = messageLog.Subscribe(searchConsumer, func(msgs []*bytes.Buffer) error {
+				return indexMessages(conf.index, conf.persist, msgs)
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+		if conf.conversations != nil {
+			err = messageLog.Subscribe(conversationConsumer, func(msgs []*bytes.Buffer) error {
+				return updateConversations(conf.conversations, conf.persist, msgs)
+			})
+			if err != nil {
+				return nil, err
+			}
 		}
-		messageLog, _ = filelog.NewFileLog(messageLogConfig)
 	}
 
 	serverAddr, _ := wire.NewServerAddr(0, conf.sc.ID)
+	tracer, err := newTracer(&conf.sc, *serverAddr)
+	if err != nil {
+		return nil, err
+	}
 
 	hub := &Hub{
 		upgrader:        upgrader,
@@ -116,10 +190,18 @@ func NewHub(conf *Config) (*Hub, error) {
 		serverPeers:     make(map[wire.Addr]*ServerPeer, 10),
 		location:        make(map[wire.Addr]wire.Addr, 10000),
 		groups:          make(map[wire.Addr]*Group, 100),
+		transfers:       make(map[transferKey]*transfer),
+		recent:          make(map[uint64]*recentMsg, 10000),
+		taps:            make(map[tapKey]*tap),
+		tapSeq:          uint64(time.Now().UnixNano()), // ids aren't reused after restarting
+		msgIDs:          newIDGenerator(conf.sc.ID),
 		packetQueue:     make(chan *Packet, 1),
 		packetRelay:     make(chan *Packet, 1),
 		packetRelayDone: make(chan *Packet, 1),
 		messageLog:      messageLog,
+		metrics:         metrics,
+		log:             hubLog.With(logger.F(logger.KeyServer, serverAddr.String())),
+		tracer:          tracer,
 		quit:            make(chan struct{}),
 		Server: &Server{
 			Addr:               *serverAddr,
@@ -130,8 +212,11 @@ func NewHub(conf *Config) (*Hub, error) {
 	}
 
 	go httplisten(hub, &conf.sc)
+	if conf.sc.AdminListenHost != "" {
+		go adminlisten(hub, &conf.sc)
+	}
 
-	log.Printf("server[%v] start up", serverAddr.String())
+	hub.log.Info("server start up")
 
 	return hub, nil
 }
@@ -140,20 +225,39 @@ func NewHub(conf *Config) (*Hub, error) {
 func (h *Hub) Run() {
 	err := h.startCluster()
 	if err != nil {
-		log.Println(err)
+		h.log.Error("start cluster failed", logger.Err(err))
 	}
 	go h.packetHandler()
 	go h.packetQueueHandler()
+	if h.config.retention != nil {
+		h.config.retention.Start()
+	}
+	atomic.StoreInt32(&h.started, 1)
 
 	<-h.quit
 }
 
+// peerLogger logger of a client or server peer connected to this server
+func (h *Hub) peerLogger(addr wire.Addr, remoteAddr string) *logger.Logger {
+	return peerLog.With(logger.F(logger.KeyServer, h.Server.Addr.String()),
+		logger.F(logger.KeyPeer, addr.String()), logger.F(logger.KeyRemote, remoteAddr))
+}
+
+// features enabled features reported to client on login
+func (h *Hub) features() uint32 {
+	features := wire.FeatureCodecBinary | wire.FeatureFileTransfer
+	if h.config.cpc.Compression {
+		features |= wire.FeatureCompression
+	}
+	return features
+}
+
 // 与其它服务器节点建立长连接
 func (h *Hub) startCluster() error {
 	if h.config.sc.ClusterSeedURL == "" {
 		return nil
 	}
-	log.Println("start outPeerhandler")
+	h.log.Info("joining cluster", logger.F("seed", h.config.sc.ClusterSeedURL))
 
 	resp, err := http.Get(fmt.Sprintf("%v/q/servers", h.config.sc.ClusterSeedURL))
 	if err != nil {
@@ -178,21 +282,19 @@ func (h *Hub) startCluster() error {
 			AdvertiseServerURL: surl,
 		})
 		if err != nil {
-			log.Println(err)
+			h.log.Warn("connect to server failed", logger.F(logger.KeyPeer, server.Addr), logger.Err(err))
 			continue
 		}
 
 		h.serverPeers[serverPeer.Addr] = serverPeer
-		log.Println("connected to server", server)
+		serverPeer.Logger().Info("server connected")
 	}
 
-	log.Println("end outPeerhandler")
 	return nil
 }
 
 // 处理消息queue
 func (h *Hub) packetQueueHandler() {
-	log.Println("start packetQueueHandler")
 	pendingMsgs := list.New()
 
 	// We keep the waiting flag so that we know if we have a pending message
@@ -212,12 +314,36 @@ func (h *Hub) packetQueueHandler() {
 	for {
 		select {
 		case packet := <-h.packetQueue:
-			if h.messageLog != nil && packet.use == useForRelayMessage {
+			if packet.use == useForRelayMessage && wire.IsEphemeral(packet.content.(*wire.Message).Header.Command) {
+				// ephemeral messages are dropped first under back-pressure and never logged
+				if waiting && pendingMsgs.Len() >= ephemeralDropLen {
+					h.metrics.countMessage(resultDropped, packet.content.(*wire.Message).Header.Command)
+					continue
+				}
+				packet.queued = h.tracer.StartChild(traceParent(packet.content.(*wire.Message).Header), spanQueue, tracing.KindInternal)
+				waiting = queuePacket(packet, pendingMsgs, waiting)
+				continue
+			}
+			if packet.use == useForRelayMessage {
+				h.assignMsgID(packet.from, packet.content.(*wire.Message))
+				packet.queued = h.tracer.StartChild(traceParent(packet.content.(*wire.Message).Header), spanQueue, tracing.KindInternal)
+			}
+			// file chunks are relayed only and history queries read only, they are never logged.
+			// messages skipped by the persist policy aren't logged either
+			if h.messageLog != nil && packet.use == useForRelayMessage &&
+				!skipMessageLog(packet.content.(*wire.Message).Header.Command) &&
+				(h.config.persist.action(packet.content.(*wire.Message).Header) != persistSkip ||
+					h.logForConversation(packet.from, packet.content.(*wire.Message))) {
 				message := packet.content.(*wire.Message)
+				span := h.tracer.StartChild(traceParent(message.Header), spanMessageLog, tracing.KindInternal)
 				buf := &bytes.Buffer{}
-				message.Encode(buf)
+				message.WithoutTrace().Encode(buf)
 				err := h.messageLog.Write(buf.Bytes())
+				span.SetError(err)
+				span.End()
 				if err != nil {
+					packet.queued.SetError(err)
+					packet.queued.End()
 					packet.resp <- &Resp{
 						Status: wire.MsgStatusException,
 						Err:    err,
@@ -226,6 +352,7 @@ func (h *Hub) packetQueueHandler() {
 				}
 			}
 			waiting = queuePacket(packet, pendingMsgs, waiting)
+			atomic.StoreInt64(&h.metrics.queueDepth, int64(pendingMsgs.Len()))
 		case <-h.packetRelayDone:
 			// log.Printf("message %v relayed \n", ID)
 			next := pendingMsgs.Front()
@@ -234,16 +361,23 @@ func (h *Hub) packetQueueHandler() {
 				continue
 			}
 			val := pendingMsgs.Remove(next)
+			atomic.StoreInt64(&h.metrics.queueDepth, int64(pendingMsgs.Len()))
 			h.packetRelay <- val.(*Packet)
 		}
 	}
 }
 
 func (h *Hub) packetHandler() {
-	log.Println("start packetHandler")
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
 	for {
 		select {
+		case now := <-ticker.C:
+			h.cleanTransfers()
+			h.cleanRecent()
+			h.refreshTaps(now)
 		case packet := <-h.packetRelay:
+			start := time.Now()
 			switch packet.use {
 			case useForAddClientPeer:
 				h.handleClientPeerRegistPacket(packet.from, packet.content.(*ClientPeer), packet.resp)
@@ -253,25 +387,73 @@ func (h *Hub) packetHandler() {
 				h.handleServerPeerRegistPacket(packet.from, packet.content.(*ServerPeer), packet.resp)
 			case useForDelServerPeer:
 				h.handleServerPeerUnregistPacket(packet.from, packet.content.(*ServerPeer), packet.resp)
+			case useForDrain:
+				h.handleDrainPacket(packet.content.(time.Time), packet.resp)
+			case useForProbe:
+				h.handleProbePacket(packet.content.(*hubSnapshot), packet.resp)
+			case useForAddTap:
+				h.handleTapAddPacket(packet.content.(*tap), packet.resp)
+			case useForDelTap:
+				h.handleTapDelPacket(packet.content.(tapKey), packet.resp)
+			case useForModify:
+				h.handleModifyLookupPacket(packet.from, packet.content.(*modifyLookup), packet.resp)
+			case useForClose:
+				h.handleClosePacket(packet.content.(*closingPeers), packet.resp)
 			case useForRelayMessage:
 				message := packet.content.(*wire.Message)
 				header := message.Header
+				packet.queued.End()
+				span := h.tracer.StartChild(traceParent(header), spanRelay, tracing.KindInternal)
+				setTrace(header, span)
+				if len(h.taps) > 0 {
+					h.tapMessage(packet.from, message)
+				}
 				h.recordSession(packet.from, header)
 				if packet.from.Type() == wire.AddrServer && header.Source.Type() == wire.AddrClient { //如果是转发过来的消息，就记录发送者的定位
 					h.recordLocation(packet.from, message)
 				}
-				if header.Dest == h.Server.Addr { // if dest address is self
+				if header.Command == wire.MsgTypeChat {
+					h.recordRecent(message)
+				}
+				if header.Command == wire.MsgTypeHistory {
+					h.handleHistoryPacket(packet.from, message, packet.resp)
+				} else if header.Command == wire.MsgTypeConversations {
+					h.handleConversationsPacket(packet.from, message, packet.resp)
+				} else if header.Dest == h.Server.Addr { // if dest address is self
 					h.handleLogicPacket(packet.from, message, packet.resp)
+				} else if isTransferCommand(header.Command) && packet.from.Type() == wire.AddrClient {
+					h.handleTransferPacket(packet.from, message, packet.resp)
+				} else if isModifyCommand(header.Command) && packet.from.Type() == wire.AddrClient {
+					h.handleModifyPacket(packet.from, message, packet.resp)
 				} else {
 					h.handleRelayPacket(packet.from, message, packet.resp)
 				}
+				// a read receipt from a client is synced to its other devices
+				if header.Command == wire.MsgTypeChatResp && packet.from.Type() == wire.AddrClient && isReadReceipt(message) {
+					h.syncRead(header.Source, header.Dest)
+				}
+				span.End()
 			}
+			h.metrics.packetLatency.Observe(time.Since(start).Seconds())
 
 			h.packetRelayDone <- packet
 		}
 	}
 }
 
+// assignMsgID a chat message gets its id in the server the sender logined in,
+// an id sent by a client is always replaced, only ids from other servers are kept
+func (h *Hub) assignMsgID(from wire.Addr, message *wire.Message) {
+	if message.Header.Command != wire.MsgTypeChat {
+		return
+	}
+	body := message.Body.(*wire.Msgchat)
+	if from.Type() == wire.AddrServer && from != h.Server.Addr && body.MsgID != 0 {
+		return
+	}
+	body.MsgID = h.msgIDs.Next()
+}
+
 func (h *Hub) recordSession(from wire.Addr, header *wire.Header) {
 	if header.Source.Type() == wire.AddrClient {
 		if speer, has := h.clientPeers[header.Source]; has {
@@ -327,6 +509,7 @@ func (h *Hub) handleClientPeerRegistPacket(from wire.Addr, peer *ClientPeer, res
 	h.broadcast(packet) // 广播此消息到其它服务器节点
 
 	h.clientPeers[peer.Addr] = peer
+	atomic.StoreInt32(&h.clientCount, int32(len(h.clientPeers)))
 
 	if resp != nil {
 		resp <- &Resp{Status: wire.MsgStatusOk}
@@ -341,6 +524,8 @@ func (h *Hub) handleClientPeerUnregistPacket(from wire.Addr, peer *ClientPeer, r
 			return
 		}
 		delete(h.clientPeers, peer.Addr)
+		atomic.StoreInt32(&h.clientCount, int32(len(h.clientPeers)))
+		h.dropTransfers(peer.Addr)
 
 		// leave groups
 		alivePeer.Groups.Each(func(elem interface{}) bool {
@@ -382,6 +567,11 @@ func (h *Hub) handleClientPeerUnregistPacket(from wire.Addr, peer *ClientPeer, r
 
 func (h *Hub) handleServerPeerRegistPacket(from wire.Addr, peer *ServerPeer, resp chan<- *Resp) {
 	h.serverPeers[peer.Addr] = peer
+	for key, t := range h.taps {
+		if key.server == h.Server.Addr {
+			h.sendTap(peer, t.filter)
+		}
+	}
 	if resp != nil {
 		resp <- &Resp{Status: wire.MsgStatusOk}
 	}
@@ -390,6 +580,7 @@ func (h *Hub) handleServerPeerRegistPacket(from wire.Addr, peer *ServerPeer, res
 
 func (h *Hub) handleServerPeerUnregistPacket(from wire.Addr, peer *ServerPeer, resp chan<- *Resp) {
 	delete(h.serverPeers, peer.Addr)
+	h.dropServerTaps(peer.Addr)
 	if resp != nil {
 		resp <- &Resp{Status: wire.MsgStatusOk}
 	}
@@ -402,6 +593,9 @@ func (h *Hub) handleRelayPacket(from wire.Addr, message *wire.Message, resp chan
 	var response = Resp{
 		Status: wire.MsgStatusOk,
 	}
+	if header.Command == wire.MsgTypeChat {
+		response.Body = &wire.MsgChatAck{MsgID: message.Body.(*wire.Msgchat).MsgID}
+	}
 	defer func() {
 		if resp != nil {
 			resp <- &response
@@ -410,11 +604,24 @@ func (h *Hub) handleRelayPacket(from wire.Addr, message *wire.Message, resp chan
 	if dest.Type() == wire.AddrClient {
 		// 在当前服务器节点中找到了目标客户端
 		if cpeer, ok := h.clientPeers[dest]; ok {
+			if cpeer.Version < wire.CommandVersion(header.Command) {
+				// pushed by the server only, the client never negotiated the command
+				h.metrics.countMessage(resultDropped, header.Command)
+				return
+			}
+			if !cpeer.canDecode(message) {
+				response.Status = wire.MsgStatusAddrUnsupported
+				response.Err = ErrAddrUnsupported
+				h.metrics.countMessage(resultDropped, header.Command)
+				return
+			}
 			cpeer.PushMessage(message, nil) //errchan pass to peer
+			h.metrics.countMessage(resultRelayed, header.Command)
 			return
 		}
 		if from.Type() == wire.AddrServer { //dest no found in this server .then throw out message
 			response.Err = ErrPeerNoFound
+			h.metrics.countMessage(resultNotFound, header.Command)
 			return
 		}
 		// message sent from client directly
@@ -424,6 +631,9 @@ func (h *Hub) handleRelayPacket(from wire.Addr, message *wire.Message, resp chan
 		} else {
 			if speer, ok := h.serverPeers[serverAddr]; ok {
 				speer.PushMessage(message, nil)
+				h.metrics.countMessage(resultRelayed, header.Command)
+			} else {
+				h.metrics.countMessage(resultNotFound, header.Command)
 			}
 		}
 		response.Err = ErrPeerNoFound
@@ -436,11 +646,22 @@ func (h *Hub) handleRelayPacket(from wire.Addr, message *wire.Message, resp chan
 		if dest.Type() == wire.AddrGroup {
 			// 消息异步发送到群中所有用户
 			if group, has := h.groups[dest]; has {
-				group.packet <- &GroupPacket{useForMessage, message}
+				if wire.IsEphemeral(header.Command) {
+					select { // never wait for a busy group
+					case group.packet <- &GroupPacket{useForMessage, message}:
+						h.metrics.countMessage(resultRelayed, header.Command)
+					default:
+						h.metrics.countMessage(resultDropped, header.Command)
+					}
+				} else {
+					group.packet <- &GroupPacket{useForMessage, message}
+					h.metrics.countMessage(resultRelayed, header.Command)
+				}
 			}
 		} else if dest.Type() == wire.AddrBroadcast {
 			// 消息异步发送到群中所有用户
 			h.sendToDomain(dest, message)
+			h.metrics.countMessage(resultRelayed, header.Command)
 		}
 	}
 }
@@ -470,7 +691,7 @@ func (h *Hub) handleLogicPacket(from wire.Addr, message *wire.Message, resp chan
 			case wire.GroupIn:
 				peer.Groups.Add(group) //record to peer
 				if _, ok := h.groups[group]; !ok {
-					h.groups[group] = NewGroup(group, h.config.sc.GroupBufferSize)
+					h.groups[group] = NewGroup(group, h.config.live().GroupBufferSize, h.tracer)
 				}
 				h.groups[group].packet <- &GroupPacket{useForJoin, peer}
 			case wire.GroupOut:
@@ -478,7 +699,7 @@ func (h *Hub) handleLogicPacket(from wire.Addr, message *wire.Message, resp chan
 				if g, has := h.groups[group]; has {
 					g.packet <- &GroupPacket{useForLeave, peer}
 
-					if g.MemCount == 0 {
+					if g.Size() == 0 {
 						if len(h.groups) > 1000 { // clean group
 							g.Exit() //stop
 							delete(h.groups, group)
@@ -488,12 +709,30 @@ func (h *Hub) handleLogicPacket(from wire.Addr, message *wire.Message, resp chan
 
 			}
 		}
+	case wire.MsgTypeMarkRead:
+		if from.Type() != wire.AddrClient {
+			response.Err = ErrPeerNoFound
+			return
+		}
+		h.syncRead(header.Source, body.(*wire.MsgMarkRead).Peer)
 	case wire.MsgTypeLoc: //handle location message
 		msgLoc := body.(*wire.MsgLoc)
 		h.location[msgLoc.Peer] = msgLoc.In
 		//  regist a server to peer whether it is successful
 		peer := h.clientPeers[msgLoc.Target]
 		peer.AddSession(msgLoc.Peer, msgLoc.In)
+	case wire.MsgTypeTap:
+		if from.Type() != wire.AddrServer || from == h.Server.Addr {
+			response.Status = wire.MsgStatusForbidden
+			return
+		}
+		h.handleRemoteTap(from, body.(*wire.MsgTap))
+	case wire.MsgTypeTapEvent:
+		if from.Type() != wire.AddrServer || from == h.Server.Addr {
+			response.Status = wire.MsgStatusForbidden
+			return
+		}
+		h.handleTapEvent(body.(*wire.MsgTapEvent))
 	case wire.MsgTypeOffline: //handle offline message
 		msgOffline := body.(*wire.MsgOffline)
 		delete(h.location, msgOffline.Peer)
@@ -556,21 +795,70 @@ func (h *Hub) sendToDomain(dest wire.Addr, message *wire.Message) {
 
 // broadcast message to all server
 func (h *Hub) broadcast(message *wire.Message) {
+	h.metrics.countMessage(resultBroadcast, message.Header.Command)
+	span := h.tracer.StartChild(traceParent(message.Header), spanBroadcast, tracing.KindProducer,
+		tracing.Attr("wscluster.servers", len(h.serverPeers)))
+	// other servers continue the trace from the broadcast, local delivery from the relay
+	message = withTrace(message, span)
 	for _, speer := range h.serverPeers {
 		speer.PushMessage(message, nil)
 	}
+	span.End()
 }
 
-func saveMessagesToDb(messageStore database.MessageStore, bufs []*bytes.Buffer) error {
+// saveMessagesToDb save logged messages by the persist policy,
+// the policy is applied again since the log may be written by an older policy
+func saveMessagesToDb(messageStore database.MessageStore, policy *persistPolicy, bufs []*bytes.Buffer) error {
 	chatmsgs := make([]*database.ChatMsg, 0)
 	groupmsgs := make([]*database.GroupMsg, 0)
+	chatmods := make([]*database.MsgModify, 0)
+	groupmods := make([]*database.MsgModify, 0)
+	audits := make([]*database.GroupAudit, 0)
 	for _, buf := range bufs {
 		packet := new(wire.Message)
 		if err := packet.Decode(buf); err != nil {
-			fmt.Println(err)
+			hubLog.Error("decode logged message failed", logger.Err(err))
 			continue
 		}
 		header := packet.Header
+		action := policy.action(header)
+		if action == persistAudit && header.Command == wire.MsgTypeGroupInOut {
+			body := packet.Body.(*wire.MsgGroupInOut)
+			for _, group := range body.Groups {
+				audits = append(audits, &database.GroupAudit{
+					Domain:      header.Source.Domain(),
+					Client:      header.Source.Address(),
+					GroupDomain: group.Domain(),
+					Group:       group.Address(),
+					InOut:       body.InOut,
+					CreateAt:    time.Now(),
+				})
+			}
+			continue
+		}
+		if action != persistSave {
+			continue
+		}
+		if isModifyCommand(header.Command) {
+			mod := &database.MsgModify{
+				FromDomain: header.Source.Domain(),
+				From:       header.Source.Address(),
+				ModifyAt:   time.Now(),
+			}
+			if header.Command == wire.MsgTypeRecall {
+				mod.MsgID = packet.Body.(*wire.MsgRecall).MsgID
+				mod.Recall = true
+			} else {
+				body := packet.Body.(*wire.MsgEdit)
+				mod.MsgID, mod.Text, mod.Extra = body.MsgID, body.Text, body.Extra
+			}
+			if header.Dest.Type() == wire.AddrClient {
+				chatmods = append(chatmods, mod)
+			} else if header.Dest.Type() == wire.AddrGroup {
+				groupmods = append(groupmods, mod)
+			}
+			continue
+		}
 		if header.Command != wire.MsgTypeChat {
 			continue
 		}
@@ -585,6 +873,7 @@ func saveMessagesToDb(messageStore database.MessageStore, bufs []*bytes.Buffer)
 				Text:       body.Text,
 				Extra:      body.Extra,
 				CreateAt:   time.Now(),
+				MsgID:      body.MsgID,
 			}
 			chatmsgs = append(chatmsgs, dbmsg)
 		} else if header.Dest.Type() == wire.AddrGroup {
@@ -597,6 +886,7 @@ func saveMessagesToDb(messageStore database.MessageStore, bufs []*bytes.Buffer)
 				Text:       body.Text,
 				Extra:      body.Extra,
 				CreateAt:   time.Now(),
+				MsgID:      body.MsgID,
 			}
 			groupmsgs = append(groupmsgs, dbmsg)
 		}
@@ -613,28 +903,71 @@ func saveMessagesToDb(messageStore database.MessageStore, bufs []*bytes.Buffer)
 			return err
 		}
 	}
+	if len(audits) > 0 {
+		if err := messageStore.SaveGroupAudit(audits); err != nil {
+			return err
+		}
+	}
+	// modify after saving, the message may be in the same batch
+	if len(chatmods) > 0 {
+		if err := messageStore.ModifyChatMsg(chatmods); err != nil {
+			return err
+		}
+	}
+	if len(groupmods) > 0 {
+		if err := messageStore.ModifyGroupMsg(groupmods); err != nil {
+			return err
+		}
+	}
 
 	// log.Printf("save messages : %v ", len(messages))
 	return nil
 }
 
-// Close close hub
+// Close close hub, pending records of message log are flushed
 func (h *Hub) Close() {
-	h.clean()
+	h.closeOnce.Do(func() {
+		h.clean()
+		if h.config.retention != nil {
+			h.config.retention.Close()
+		}
+		if h.messageLog != nil {
+			h.messageLog.Close()
+		}
+		if err := h.tracer.Close(); err != nil {
+			h.log.Error("close tracer failed", logger.Err(err))
+		}
 
-	h.quit <- struct{}{}
+		h.quit <- struct{}{}
+	})
 }
 
-// clean clean hub
+// clean close all peers in the hub loop, and wait until their connections are closed,
+// so no message is logged after the message log is closed
 func (h *Hub) clean() {
-
-	for _, speer := range h.serverPeers {
-		speer.Close()
+	atomic.StoreInt32(&h.draining, 1) // new clients are refused
+	closing := new(closingPeers)
+	resp := make(chan *Resp, 1)
+	timer := time.NewTimer(closeTimeout)
+	defer timer.Stop()
+	select {
+	case h.packetQueue <- &Packet{from: h.Server.Addr, use: useForClose, content: closing, resp: resp}:
+	case <-timer.C:
+		h.log.Warn("hub loop doesn't close peers in time")
+		return
 	}
-
-	for _, cpeer := range h.clientPeers {
-		cpeer.Close()
+	select {
+	case <-resp:
+	case <-timer.C:
+		h.log.Warn("hub loop doesn't close peers in time")
+		return
+	}
+	for i, done := range closing.done {
+		select {
+		case <-done:
+		case <-timer.C:
+			h.log.Warn("peers aren't closed in time", logger.F("peers", len(closing.done)-i))
+			return
+		}
 	}
-
-	time.Sleep(time.Second)
 }
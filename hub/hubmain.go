@@ -1,35 +1,77 @@
 package hub
 
 import (
-	"log"
 	"os"
 	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/logger"
 )
 
 func handleInterrupt(hub *Hub, sc chan os.Signal) {
-	select {
-	case <-sc:
-		hub.Close()
+	for sig := range sc {
+		switch sig {
+		case syscall.SIGHUP:
+			if err := hub.Reload(); err != nil {
+				hub.log.Error("reload failed", logger.Err(err))
+			}
+		case syscall.SIGTERM:
+			go hub.Drain() // close at once on another interrupt
+		default:
+			hub.Close()
+			return
+		}
 	}
 }
 
+// fatal log the error and exit
+func fatal(msg string, err error) {
+	hubLog.Error(msg, logger.Err(err))
+	os.Exit(1)
+}
+
 // Main Run Main
 func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "filelog" {
+		if err := filelogMain(os.Args[2:]); err != nil {
+			fatal("filelog command failed", err)
+		}
+		return
+	}
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	// read config
 	conf, err := LoadConfig()
 	if err != nil {
-		log.Panicln(err)
+		fatal("invalid config", err)
 	}
 
+	if conf.searchPath != "" {
+		conf.index, err = database.NewSearchIndex(conf.searchPath)
+		if err != nil {
+			fatal("open search index failed", err)
+		}
+	}
 	// build a client instance of redis
 	if conf.dc != nil {
-		engine := database.InitMysqlDb(conf.dc.DbSource)
-		conf.ms = database.NewDbMessageStore(engine)
+		engine, err := database.InitDb(conf.dc.DbDriver, conf.dc.DbSource)
+		if err != nil {
+			fatal("open database failed", err)
+		}
+		store := database.NewDbMessageStore(engine)
+		conf.ms = store
+		if conf.enableConversations {
+			conf.conversations, err = database.NewConversationIndex(store)
+			if err != nil {
+				fatal("open conversation index failed", err)
+			}
+		}
+		if conf.rc != nil {
+			conf.rc.Index = conf.index
+			conf.retention = database.NewRetention(store, *conf.rc)
+		}
 	}
 
 	// var cache config.Cache
@@ -59,11 +101,11 @@ func Main() {
 	// new server
 	hub, err := NewHub(conf)
 	if err != nil {
-		log.Panicln(err)
+		fatal("start server failed", err)
 	}
 	// listen sys.exit
 	sc := make(chan os.Signal, 1)
-	signal.Notify(sc, os.Interrupt)
+	signal.Notify(sc, os.Interrupt, syscall.SIGHUP, syscall.SIGTERM)
 
 	go handleInterrupt(hub, sc)
 
@@ -0,0 +1,44 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter a token bucket, it is safe for concurrent use
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // tokens per second, 0 means no limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow take a token if there is one
+func (l *rateLimiter) Allow() bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
@@ -0,0 +1,336 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ws-cluster/wire"
+)
+
+// results of relaying a message
+const (
+	resultRelayed = iota
+	resultBroadcast
+	resultDropped
+	resultNotFound
+	resultCount
+)
+
+const (
+	metricsNamespace = "wscluster"
+	// defaultProbeTimeout a probe fails if the hub doesn't handle it in this duration
+	defaultProbeTimeout = 3 * time.Second
+)
+
+var (
+	// ErrProbeTimeout the hub doesn't handle a probe in time
+	ErrProbeTimeout = errors.New("hub is not responsive")
+
+	resultNames = [resultCount]string{"relayed", "broadcast", "dropped", "not_found"}
+
+	commandNames = map[uint8]string{
+		wire.MsgTypeLoginAck:          "loginack",
+		wire.MsgTypeChat:              "chat",
+		wire.MsgTypeChatResp:          "chatresp",
+		wire.MsgTypeGroupInOut:        "groupinout",
+		wire.MsgTypeKill:              "kill",
+		wire.MsgTypeLoc:               "loc",
+		wire.MsgTypeOffline:           "offline",
+		wire.MsgTypeOfflineNotice:     "offlinenotice",
+		wire.MsgTypeQueryClient:       "queryclient",
+		wire.MsgTypeQueryServers:      "queryservers",
+		wire.MsgTypeBinary:            "binary",
+		wire.MsgTypeFileBegin:         "filebegin",
+		wire.MsgTypeFileChunk:         "filechunk",
+		wire.MsgTypeFileEnd:           "fileend",
+		wire.MsgTypeSignal:            "signal",
+		wire.MsgTypeRecall:            "recall",
+		wire.MsgTypeEdit:              "edit",
+		wire.MsgTypeChatAck:           "chatack",
+		wire.MsgTypeHistory:           "history",
+		wire.MsgTypeHistoryResp:       "historyresp",
+		wire.MsgTypeConversations:     "conversations",
+		wire.MsgTypeConversationsResp: "conversationsresp",
+		wire.MsgTypeMarkRead:          "markread",
+		wire.MsgTypeDrain:             "drain",
+		wire.MsgTypeTap:               "tap",
+		wire.MsgTypeTapEvent:          "tapevent",
+		wire.MsgTypeEmpty:             "empty",
+	}
+
+	latencyBuckets   = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	storeBuckets     = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+	groupSizeBuckets = []float64{1, 10, 100, 1000, 10000}
+)
+
+func commandName(command uint8) string {
+	if name, ok := commandNames[command]; ok {
+		return name
+	}
+	return strconv.Itoa(int(command))
+}
+
+// hubMetrics metrics updated by the hub, they are safe for concurrent use
+type hubMetrics struct {
+	messages      [resultCount][256]uint64
+	queueDepth    int64 // packets pending in packetQueueHandler
+	packetLatency *histogram
+	storeLatency  *histogram
+}
+
+func newHubMetrics() *hubMetrics {
+	return &hubMetrics{
+		packetLatency: newHistogram(latencyBuckets),
+		storeLatency:  newHistogram(storeBuckets),
+	}
+}
+
+func (m *hubMetrics) countMessage(result int, command uint8) {
+	atomic.AddUint64(&m.messages[result][command], 1)
+}
+
+// histogram cumulative buckets of observed values
+type histogram struct {
+	sync.Mutex
+	bounds []float64
+	counts []uint64 // counts[i] is the count of values <= bounds[i], the last one is +Inf
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe add a value
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.Unlock()
+}
+
+// hubSnapshot state of the hub taken in the hub loop
+type hubSnapshot struct {
+	clients        map[[2]uint32]int // domain and device
+	clientQueueSum int
+	clientQueueMax int
+	servers        map[string]bool // addr and connected
+	serverQueues   map[string]int
+	groupSizes     []int
+	latency        time.Duration // from sending the probe to handling it
+}
+
+// probe take a snapshot in the hub loop, the hub is not responsive if it times out
+func (h *Hub) probe(timeout time.Duration) (*hubSnapshot, error) {
+	snapshot := &hubSnapshot{
+		clients:      make(map[[2]uint32]int),
+		servers:      make(map[string]bool),
+		serverQueues: make(map[string]int),
+	}
+	resp := make(chan *Resp, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	start := time.Now()
+	select {
+	case h.packetQueue <- &Packet{from: h.Server.Addr, use: useForProbe, content: snapshot, resp: resp}:
+	case <-timer.C:
+		return nil, ErrProbeTimeout
+	}
+	select {
+	case <-resp:
+	case <-timer.C:
+		return nil, ErrProbeTimeout
+	}
+	snapshot.latency = time.Since(start)
+	return snapshot, nil
+}
+
+// handleProbePacket fill the snapshot
+func (h *Hub) handleProbePacket(snapshot *hubSnapshot, resp chan<- *Resp) {
+	for addr, cpeer := range h.clientPeers {
+		snapshot.clients[[2]uint32{addr.Domain(), uint32(addr.Device())}]++
+		n := cpeer.QueueLen()
+		snapshot.clientQueueSum += n
+		if n > snapshot.clientQueueMax {
+			snapshot.clientQueueMax = n
+		}
+	}
+	for addr, speer := range h.serverPeers {
+		snapshot.servers[addr.String()] = speer.IsConnected()
+		snapshot.serverQueues[addr.String()] = speer.QueueLen()
+	}
+	snapshot.groupSizes = make([]int, 0, len(h.groups))
+	for _, group := range h.groups {
+		snapshot.groupSizes = append(snapshot.groupSizes, group.Size())
+	}
+	respond(resp, wire.MsgStatusOk)
+}
+
+// 以 Prometheus 文本格式输出指标
+// /metrics
+func metricsHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	m := &metricWriter{w: buf}
+
+	snapshot, err := hub.probe(defaultProbeTimeout)
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	m.header("hub_up", "gauge", "1 if the hub loop handled the probe in time")
+	m.sample("hub_up", nil, up)
+	if snapshot != nil {
+		m.header("hub_loop_latency_seconds", "gauge", "time from sending the probe to the hub loop handling it")
+		m.sample("hub_loop_latency_seconds", nil, snapshot.latency.Seconds())
+
+		m.header("clients", "gauge", "connected clients by domain and device")
+		keys := make([][2]uint32, 0, len(snapshot.clients))
+		for key := range snapshot.clients {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+		})
+		for _, key := range keys {
+			m.sample("clients", []string{"domain", strconv.Itoa(int(key[0])), "device", strconv.Itoa(int(key[1]))}, float64(snapshot.clients[key]))
+		}
+
+		m.header("server_peer_up", "gauge", "1 if the link to the server is connected")
+		servers := make([]string, 0, len(snapshot.servers))
+		for addr := range snapshot.servers {
+			servers = append(servers, addr)
+		}
+		sort.Strings(servers)
+		for _, addr := range servers {
+			state := 0.0
+			if snapshot.servers[addr] {
+				state = 1
+			}
+			m.sample("server_peer_up", []string{"server", addr}, state)
+		}
+		m.header("server_peer_queue_depth", "gauge", "messages waiting to be written to the server")
+		for _, addr := range servers {
+			m.sample("server_peer_queue_depth", []string{"server", addr}, float64(snapshot.serverQueues[addr]))
+		}
+		m.header("client_peer_queue_depth", "gauge", "messages waiting to be written to all clients")
+		m.sample("client_peer_queue_depth", nil, float64(snapshot.clientQueueSum))
+		m.header("client_peer_queue_depth_max", "gauge", "messages waiting to be written to the slowest client")
+		m.sample("client_peer_queue_depth_max", nil, float64(snapshot.clientQueueMax))
+
+		m.header("groups", "gauge", "groups which have members in this server")
+		m.sample("groups", nil, float64(len(snapshot.groupSizes)))
+		sizes := newHistogram(groupSizeBuckets)
+		for _, size := range snapshot.groupSizes {
+			sizes.Observe(float64(size))
+		}
+		m.histogram("group_members", "members of groups in this server", sizes)
+	}
+
+	metrics := hub.metrics
+	m.header("packet_queue_depth", "gauge", "packets waiting for the hub loop")
+	m.sample("packet_queue_depth", nil, float64(atomic.LoadInt64(&metrics.queueDepth)))
+	m.histogram("hub_packet_seconds", "time of handling a packet in the hub loop", metrics.packetLatency)
+
+	m.header("messages_total", "counter", "messages by result and command")
+	for result := 0; result < resultCount; result++ {
+		for command := 0; command < 256; command++ {
+			if n := atomic.LoadUint64(&metrics.messages[result][command]); n > 0 {
+				m.sample("messages_total", []string{"result", resultNames[result], "command", commandName(uint8(command))}, float64(n))
+			}
+		}
+	}
+
+	if hub.messageLog != nil {
+		stats := hub.messageLog.Stats()
+		m.header("filelog_write_block", "gauge", "the block being written in message log")
+		m.sample("filelog_write_block", nil, float64(stats.WriteBlock))
+		m.header("filelog_first_block", "gauge", "the oldest retained block in message log")
+		m.sample("filelog_first_block", nil, float64(stats.FirstBlock))
+		m.header("filelog_segments", "gauge", "segment files of message log")
+		m.sample("filelog_segments", nil, float64(stats.Segments))
+		m.header("filelog_size_bytes", "gauge", "total size of message log")
+		m.sample("filelog_size_bytes", nil, float64(stats.Size))
+		m.header("filelog_consumer_read_block", "gauge", "committed read block of a consumer")
+		for _, c := range stats.Consumers {
+			m.sample("filelog_consumer_read_block", []string{"consumer", c.Name}, float64(c.ReadBlock))
+		}
+		m.header("filelog_consumer_lag_blocks", "gauge", "blocks not consumed by a consumer")
+		for _, c := range stats.Consumers {
+			m.sample("filelog_consumer_lag_blocks", []string{"consumer", c.Name}, float64(c.Lag))
+		}
+		m.header("filelog_consumer_stale", "gauge", "1 if a consumer lags more than -message-log-consumer-max-lag, message log isn't retained for it")
+		for _, c := range stats.Consumers {
+			stale := 0.0
+			if c.Stale {
+				stale = 1
+			}
+			m.sample("filelog_consumer_stale", []string{"consumer", c.Name}, stale)
+		}
+		m.header("filelog_consumer_dead_letters_total", "counter", "records written to the dead letter file")
+		for _, c := range stats.Consumers {
+			m.sample("filelog_consumer_dead_letters_total", []string{"consumer", c.Name}, float64(c.DeadLetters))
+		}
+		m.header("filelog_consumer_corrupt_blocks_total", "counter", "blocks failed the checksum on consuming, written to the dead letter file")
+		for _, c := range stats.Consumers {
+			m.sample("filelog_consumer_corrupt_blocks_total", []string{"consumer", c.Name}, float64(c.CorruptBlocks))
+		}
+	}
+	if hub.config.ms != nil {
+		m.histogram("message_store_batch_seconds", "time of saving a batch of message log to database", metrics.storeLatency)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// metricWriter write metrics in the text format of Prometheus
+type metricWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (m *metricWriter) header(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %v_%v %v\n# TYPE %v_%v %v\n", metricsNamespace, name, help, metricsNamespace, name, typ)
+}
+
+// sample labels are pairs of name and value
+func (m *metricWriter) sample(name string, labels []string, value float64) {
+	fmt.Fprintf(m.w, "%v_%v", metricsNamespace, name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], labelEscaper.Replace(labels[i+1])))
+		}
+		fmt.Fprintf(m.w, "{%v}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(m.w, " %v\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricWriter) histogram(name, help string, h *histogram) {
+	h.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum := h.sum
+	h.Unlock()
+
+	m.header(name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		m.sample(name+"_bucket", []string{"le", strconv.FormatFloat(bound, 'g', -1, 64)}, float64(cumulative))
+	}
+	cumulative += counts[len(h.bounds)]
+	m.sample(name+"_bucket", []string{"le", "+Inf"}, float64(cumulative))
+	m.sample(name+"_sum", nil, sum)
+	m.sample(name+"_count", nil, float64(cumulative))
+}
@@ -0,0 +1,194 @@
+package hub
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+// message id layout, ordered by time
+// / 41 bit         / 10 bit / 12 bit   /
+// / ms since epoch / server / sequence /
+const (
+	msgIDServerBits = 10
+	msgIDSeqBits    = 12
+)
+
+// msgIDEpoch 2019-01-01 00:00:00 UTC
+var msgIDEpoch = time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// idGenerator generate unique message ids in the cluster
+type idGenerator struct {
+	sync.Mutex
+	server uint64
+	last   int64 // ms since epoch
+	seq    uint64
+}
+
+func newIDGenerator(serverID string) *idGenerator {
+	h := fnv.New32a()
+	h.Write([]byte(serverID))
+	return &idGenerator{
+		server: uint64(h.Sum32()) & (1<<msgIDServerBits - 1),
+	}
+}
+
+// Next return next message id
+func (g *idGenerator) Next() uint64 {
+	g.Lock()
+	defer g.Unlock()
+	now := int64(time.Since(msgIDEpoch) / time.Millisecond)
+	if now < g.last { // clock moved backwards, keep ids increasing
+		now = g.last
+	}
+	if now == g.last {
+		g.seq = (g.seq + 1) & (1<<msgIDSeqBits - 1)
+		if g.seq == 0 { // sequence exhausted, borrow from next millisecond
+			now++
+		}
+	} else {
+		g.seq = 0
+	}
+	g.last = now
+	return uint64(now)<<(msgIDServerBits+msgIDSeqBits) | g.server<<msgIDSeqBits | g.seq
+}
+
+// msgIDTime the time a message id was generated
+func msgIDTime(id uint64) time.Time {
+	ms := int64(id >> (msgIDServerBits + msgIDSeqBits))
+	return msgIDEpoch.Add(time.Duration(ms) * time.Millisecond)
+}
+
+// recentMsg a chat message which may be recalled or edited
+type recentMsg struct {
+	source wire.Addr
+	dest   wire.Addr
+}
+
+// recordRecent remember a relayed chat message until the recall window passed
+func (h *Hub) recordRecent(message *wire.Message) {
+	if h.config.live().RecallWindow <= 0 {
+		return
+	}
+	body := message.Body.(*wire.Msgchat)
+	if body.MsgID == 0 {
+		return
+	}
+	h.recent[body.MsgID] = &recentMsg{
+		source: message.Header.Source,
+		dest:   message.Header.Dest,
+	}
+}
+
+// cleanRecent forget messages out of the recall window
+func (h *Hub) cleanRecent() {
+	deadline := time.Now().Add(-h.config.live().RecallWindow)
+	for id := range h.recent {
+		if msgIDTime(id).Before(deadline) {
+			delete(h.recent, id)
+		}
+	}
+}
+
+// modifyLookup a recall or edit whose message isn't in recent, and its origin found in the message store
+type modifyLookup struct {
+	message *wire.Message
+	origin  *recentMsg // nil if no found
+}
+
+// handleModifyPacket check a recall or edit message from client, then relay it like a chat message.
+// A message sent on another server or before restarting isn't in recent, it is looked up in the message store.
+func (h *Hub) handleModifyPacket(from wire.Addr, message *wire.Message, resp chan *Resp) {
+	header := message.Header
+	msgID := modifiedMsgID(message)
+	if time.Since(msgIDTime(msgID)) > h.config.live().RecallWindow {
+		respond(resp, wire.MsgStatusExpired)
+		return
+	}
+	if origin, has := h.recent[msgID]; has {
+		h.checkModify(from, message, origin, resp)
+		return
+	}
+	if h.config.ms == nil {
+		respond(resp, wire.MsgStatusMessageNoFound)
+		return
+	}
+	// the hub is never blocked by database, the result is handled in the hub loop again
+	go func() {
+		origin, err := lookupOrigin(h.config.ms, header.Dest, msgID)
+		if err != nil {
+			h.log.Warn("look up modified message failed", logger.F("msgid", msgID), logger.Err(err))
+			if resp != nil {
+				resp <- &Resp{Status: wire.MsgStatusException, Err: err}
+			}
+			return
+		}
+		h.packetQueue <- &Packet{from: from, use: useForModify, content: &modifyLookup{message: message, origin: origin}, resp: resp}
+	}()
+}
+
+// handleModifyLookupPacket check a recall or edit with the origin found in the message store
+func (h *Hub) handleModifyLookupPacket(from wire.Addr, lookup *modifyLookup, resp chan<- *Resp) {
+	if lookup.origin == nil {
+		respond(resp, wire.MsgStatusMessageNoFound)
+		return
+	}
+	h.checkModify(from, lookup.message, lookup.origin, resp)
+}
+
+// checkModify only the sender can modify a message, from any of its devices
+func (h *Hub) checkModify(from wire.Addr, message *wire.Message, origin *recentMsg, resp chan<- *Resp) {
+	header := message.Header
+	if !sameEntity(origin.dest, header.Dest) {
+		respond(resp, wire.MsgStatusMessageNoFound)
+		return
+	}
+	if !sameEntity(origin.source, header.Source) {
+		respond(resp, wire.MsgStatusForbidden)
+		return
+	}
+	h.handleRelayPacket(from, message, resp)
+}
+
+// lookupOrigin sender and receiver of a stored message, nil if it isn't stored or is recalled
+func lookupOrigin(ms database.MessageStore, dest wire.Addr, msgID uint64) (*recentMsg, error) {
+	switch dest.Type() {
+	case wire.AddrClient:
+		msg, err := ms.GetChatMsg(msgID)
+		if err != nil || msg == nil || msg.Recalled {
+			return nil, err
+		}
+		source, _ := wire.NewAddr(wire.AddrClient, msg.FromDomain, wire.DeviceNone, msg.From)
+		to, _ := wire.NewAddr(wire.AddrClient, msg.ToDomain, wire.DeviceNone, msg.To)
+		return &recentMsg{source: *source, dest: *to}, nil
+	case wire.AddrGroup:
+		msg, err := ms.GetGroupMsg(msgID)
+		if err != nil || msg == nil || msg.Recalled {
+			return nil, err
+		}
+		source, _ := wire.NewAddr(wire.AddrClient, msg.FromDomain, wire.DeviceNone, msg.From)
+		to, _ := wire.NewGroupAddr(msg.ToDomain, msg.To)
+		return &recentMsg{source: *source, dest: *to}, nil
+	}
+	return nil, nil
+}
+
+func modifiedMsgID(message *wire.Message) uint64 {
+	if message.Header.Command == wire.MsgTypeRecall {
+		return message.Body.(*wire.MsgRecall).MsgID
+	}
+	return message.Body.(*wire.MsgEdit).MsgID
+}
+
+// sameEntity the addresses are the same client or group, devices are ignored
+func sameEntity(a, b wire.Addr) bool {
+	return a.Type() == b.Type() && a.Domain() == b.Domain() && a.Address() == b.Address()
+}
+
+func isModifyCommand(command uint8) bool {
+	return command == wire.MsgTypeRecall || command == wire.MsgTypeEdit
+}
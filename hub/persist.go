@@ -0,0 +1,150 @@
+package hub
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ws-cluster/wire"
+)
+
+// persistAction what is done with a message before it is relayed
+type persistAction uint8
+
+const (
+	// persistSkip the message is neither logged nor saved
+	persistSkip persistAction = iota
+	// persistSave the message is saved as a chat or group message
+	persistSave
+	// persistAudit the membership change is saved to the audit table
+	persistAudit
+)
+
+// defaultPersistPolicy chat messages and their recalls and edits are saved, the others are skipped
+const defaultPersistPolicy = "chat:client:*:save;chat:group:*:save;recall:*:*:save;edit:*:*:save"
+
+var persistCommands = map[string]uint8{
+	"chat":       wire.MsgTypeChat,
+	"groupinout": wire.MsgTypeGroupInOut,
+	"recall":     wire.MsgTypeRecall,
+	"edit":       wire.MsgTypeEdit,
+	"binary":     wire.MsgTypeBinary,
+	"filebegin":  wire.MsgTypeFileBegin,
+	"fileend":    wire.MsgTypeFileEnd,
+}
+
+var persistDests = map[string]byte{
+	"client":    wire.AddrClient,
+	"group":     wire.AddrGroup,
+	"server":    wire.AddrServer,
+	"broadcast": wire.AddrBroadcast,
+}
+
+var persistActions = map[string]persistAction{
+	"skip":  persistSkip,
+	"save":  persistSave,
+	"audit": persistAudit,
+}
+
+// persistRule matches messages by command, type of dest and domain, a nil field matches any
+type persistRule struct {
+	command *uint8
+	dest    *byte
+	domains map[uint32]bool
+	action  persistAction
+}
+
+func (r *persistRule) match(header *wire.Header) bool {
+	if r.command != nil && *r.command != header.Command {
+		return false
+	}
+	if r.dest != nil && *r.dest != header.Dest.Type() {
+		return false
+	}
+	if r.domains != nil && !r.domains[persistDomain(header)] {
+		return false
+	}
+	return true
+}
+
+// persistPolicy an ordered list of rules, the first matched rule decides the action.
+// A message matching no rule is skipped.
+type persistPolicy struct {
+	rules []persistRule
+}
+
+// parsePersistPolicy parse rules separated by ';', a rule is command:dest:domains:action,
+// eg: chat:group:1,3:save;chat:broadcast:*:skip;groupinout:*:*:audit.
+// '*' matches any command, type of dest or domain.
+func parsePersistPolicy(s string) (*persistPolicy, error) {
+	policy := new(persistPolicy)
+	for _, text := range strings.Split(s, ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid persist rule %v, it should be command:dest:domains:action", text)
+		}
+		var rule persistRule
+		if fields[0] != "*" {
+			command, ok := persistCommands[fields[0]]
+			if !ok {
+				return nil, fmt.Errorf("invalid command %v in persist rule %v", fields[0], text)
+			}
+			rule.command = &command
+		}
+		if fields[1] != "*" {
+			dest, ok := persistDests[fields[1]]
+			if !ok {
+				return nil, fmt.Errorf("invalid dest %v in persist rule %v", fields[1], text)
+			}
+			rule.dest = &dest
+		}
+		if fields[2] != "*" {
+			rule.domains = make(map[uint32]bool)
+			for _, d := range strings.Split(fields[2], ",") {
+				domain, err := strconv.ParseUint(strings.TrimSpace(d), 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("invalid domain %v in persist rule %v", d, text)
+				}
+				rule.domains[uint32(domain)] = true
+			}
+		}
+		action, ok := persistActions[fields[3]]
+		if !ok {
+			return nil, fmt.Errorf("invalid action %v in persist rule %v", fields[3], text)
+		}
+		// only chat messages are saved, and only membership changes are audited
+		if rule.command != nil {
+			if action == persistSave && !(*rule.command == wire.MsgTypeChat || isModifyCommand(*rule.command)) {
+				return nil, fmt.Errorf("%v can't be saved in persist rule %v", fields[0], text)
+			}
+			if action == persistAudit && *rule.command != wire.MsgTypeGroupInOut {
+				return nil, fmt.Errorf("%v can't be audited in persist rule %v", fields[0], text)
+			}
+		}
+		rule.action = action
+		policy.rules = append(policy.rules, rule)
+	}
+	return policy, nil
+}
+
+// action the action of the first matched rule
+func (p *persistPolicy) action(header *wire.Header) persistAction {
+	for i := range p.rules {
+		if p.rules[i].match(header) {
+			return p.rules[i].action
+		}
+	}
+	return persistSkip
+}
+
+// persistDomain domain of dest, or domain of source for a command message sent to server
+func persistDomain(header *wire.Header) uint32 {
+	if header.Dest.Type() == wire.AddrServer {
+		return header.Source.Domain()
+	}
+	return header.Dest.Domain()
+}
@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/ws-cluster/wire"
+)
+
+func TestParsePersistPolicy(t *testing.T) {
+	tests := []struct {
+		policy  string
+		rules   int
+		wantErr bool
+	}{
+		{defaultPersistPolicy, 4, false},
+		{"", 0, false},
+		{" chat:group:1, 3:save ; ;groupinout:*:*:audit", 2, false},
+		{"*:*:*:skip", 1, false},
+		{"chat:group:save", 0, true},
+		{"chat:group:1:save:more", 0, true},
+		{"unknown:*:*:save", 0, true},
+		{"chat:room:*:save", 0, true},
+		{"chat:*:a:save", 0, true},
+		{"chat:*:*:keep", 0, true},
+		{"binary:*:*:save", 0, true},
+		{"filebegin:client:*:save", 0, true},
+		{"chat:*:*:audit", 0, true},
+		{"recall:*:*:audit", 0, true},
+		{"groupinout:*:*:save", 0, true},
+		// a rule of any command saves only chat messages and modifies of them
+		{"*:*:*:save", 1, false},
+	}
+	for _, tt := range tests {
+		policy, err := parsePersistPolicy(tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePersistPolicy(%q) error = %v, wantErr %v", tt.policy, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(policy.rules) != tt.rules {
+			t.Errorf("parsePersistPolicy(%q) has %v rules, want %v", tt.policy, len(policy.rules), tt.rules)
+		}
+	}
+}
+
+func TestPersistPolicy_Action(t *testing.T) {
+	policy, err := parsePersistPolicy("chat:group:3:skip;chat:*:1,3:save;chat:broadcast:*:skip;groupinout:*:2:audit;chat:*:*:save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := wire.ParseCorrectAddr("/c/1/0/alice")
+	carol := wire.ParseCorrectAddr("/c/3/0/carol")
+	dave := wire.ParseCorrectAddr("/c/2/0/dave")
+	room := wire.ParseCorrectAddr("/g/3/0/room")
+	hall := wire.ParseCorrectAddr("/g/1/0/hall")
+	server := wire.ParseCorrectAddr("/s/0/0/1")
+	tests := []struct {
+		name    string
+		command uint8
+		source  *wire.Addr
+		dest    *wire.Addr
+		want    persistAction
+	}{
+		{"first match", wire.MsgTypeChat, alice, room, persistSkip},
+		{"domain list", wire.MsgTypeChat, alice, hall, persistSave},
+		{"domain of dest", wire.MsgTypeChat, alice, carol, persistSave},
+		{"wildcard", wire.MsgTypeChat, carol, dave, persistSave},
+		{"membership to server by domain of source", wire.MsgTypeGroupInOut, dave, server, persistAudit},
+		{"membership of another domain", wire.MsgTypeGroupInOut, alice, server, persistSkip},
+		{"no rule matched", wire.MsgTypeRecall, alice, carol, persistSkip},
+	}
+	for _, tt := range tests {
+		header := &wire.Header{Command: tt.command, Source: *tt.source, Dest: *tt.dest}
+		if got := policy.action(header); got != tt.want {
+			t.Errorf("%v: action() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// the default policy
+	policy, _ = parsePersistPolicy(defaultPersistPolicy)
+	for _, command := range []uint8{wire.MsgTypeChat, wire.MsgTypeRecall, wire.MsgTypeEdit} {
+		if got := policy.action(&wire.Header{Command: command, Source: *alice, Dest: *room}); got != persistSave {
+			t.Errorf("default action() of %v = %v, want save", command, got)
+		}
+	}
+	if got := policy.action(&wire.Header{Command: wire.MsgTypeBinary, Source: *alice, Dest: *carol}); got != persistSkip {
+		t.Errorf("default action() of binary = %v, want skip", got)
+	}
+}
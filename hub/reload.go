@@ -0,0 +1,200 @@
+package hub
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ws-cluster/logger"
+)
+
+// reloadableOptions options applied by Reload without restarting, the others must be unchanged
+var reloadableOptions = map[string]bool{
+	"origins":                true,
+	"client-token":           true,
+	"server-token":           true,
+	"token-rotation-overlap": true,
+	"group-buffer-size":      true,
+	"transfer-window":        true,
+	"transfer-timeout":       true,
+	"signal-rate":            true,
+	"signal-burst":           true,
+	"recall-window":          true,
+	"drain-timeout":          true,
+	"drain-urls":             true,
+	"log-level":              true,
+	"log-format":             true,
+	"tap-rate":               true,
+	"tap-max":                true,
+}
+
+// secretOptions values aren't logged
+var secretOptions = map[string]bool{
+	"client-token": true,
+	"server-token": true,
+	"admin-token":  true,
+}
+
+// randomOptions defaults are random, they are unchanged if they aren't set
+var randomOptions = map[string]bool{
+	"client-token": true,
+	"server-token": true,
+}
+
+// liveConfig reloadable options, it is replaced as a whole by Reload.
+// Signal limits and group buffer size are applied to new clients and groups, tap limits to new taps.
+type liveConfig struct {
+	Origins         string
+	ClientToken     string
+	ServerToken     string
+	TokenOverlap    time.Duration
+	PrevClientToken string // accepted until PrevClientUntil after rotation
+	PrevClientUntil time.Time
+	PrevServerToken string
+	PrevServerUntil time.Time
+	GroupBufferSize int
+	TransferWindow  int
+	TransferTimeout time.Duration
+	SignalRate      float64
+	SignalBurst     int
+	RecallWindow    time.Duration
+	DrainTimeout    time.Duration
+	DrainURLs       []string
+	TapRate         float64
+	TapMax          int
+}
+
+func newLiveConfig(sc *serverConfig, tokenOverlap time.Duration) *liveConfig {
+	return &liveConfig{
+		Origins:         sc.Origins,
+		ClientToken:     sc.ClientToken,
+		ServerToken:     sc.ServerToken,
+		TokenOverlap:    tokenOverlap,
+		GroupBufferSize: sc.GroupBufferSize,
+		TransferWindow:  sc.TransferWindow,
+		TransferTimeout: sc.TransferTimeout,
+		SignalRate:      sc.SignalRate,
+		SignalBurst:     sc.SignalBurst,
+		RecallWindow:    sc.RecallWindow,
+		DrainTimeout:    sc.DrainTimeout,
+		DrainURLs:       sc.DrainURLs,
+		TapRate:         sc.TapRate,
+		TapMax:          sc.TapMax,
+	}
+}
+
+// live the current reloadable options
+func (c *Config) live() *liveConfig {
+	return c.liveValue.Load().(*liveConfig)
+}
+
+// checkOrigin origin is allowed for clients
+func (l *liveConfig) checkOrigin(origin string) bool {
+	return l.Origins == "*" || strings.Contains(l.Origins, origin)
+}
+
+// checkClientDigest digest is signed by the client token, or the previous one in the overlap period
+func (l *liveConfig) checkClientDigest(text, digest string) bool {
+	return checkDigest(l.ClientToken, text, digest) ||
+		(l.PrevClientToken != "" && time.Now().Before(l.PrevClientUntil) && checkDigest(l.PrevClientToken, text, digest))
+}
+
+// checkServerDigest digest is signed by the server token, or the previous one in the overlap period
+func (l *liveConfig) checkServerDigest(text, digest string) bool {
+	return checkDigest(l.ServerToken, text, digest) ||
+		(l.PrevServerToken != "" && time.Now().Before(l.PrevServerUntil) && checkDigest(l.PrevServerToken, text, digest))
+}
+
+type optionChange struct {
+	name, old, new string
+}
+
+func (c *optionChange) String() string {
+	if secretOptions[c.name] {
+		return "-" + c.name + " changed"
+	}
+	return "-" + c.name + " " + c.old + " -> " + c.new
+}
+
+// diffOptions options which are set in either flag set and have different values
+func diffOptions(old, new *flag.FlagSet) []*optionChange {
+	oldSet, newSet := make(map[string]bool), make(map[string]bool)
+	old.Visit(func(f *flag.Flag) { oldSet[f.Name] = true })
+	new.Visit(func(f *flag.Flag) { newSet[f.Name] = true })
+	changes := make([]*optionChange, 0)
+	new.VisitAll(func(f *flag.Flag) {
+		if !oldSet[f.Name] && !newSet[f.Name] {
+			return // default
+		}
+		if randomOptions[f.Name] && !newSet[f.Name] {
+			return
+		}
+		o := old.Lookup(f.Name)
+		if o == nil || o.Value.String() != f.Value.String() {
+			change := &optionChange{name: f.Name, new: f.Value.String()}
+			if o != nil {
+				change.old = o.Value.String()
+			}
+			changes = append(changes, change)
+		}
+	})
+	return changes
+}
+
+// reloadLive the live config after the options change from the old flag set to the new one.
+// loaded is the live config of the new options, the tokens are kept from current unless they are changed,
+// then the replaced ones are accepted until now plus the overlap. Nothing is applied if any changed option
+// isn't reloadable, the changes are returned either way
+func reloadLive(current, loaded *liveConfig, old, new *flag.FlagSet, now time.Time) (*liveConfig, []*optionChange, error) {
+	changes := diffOptions(old, new)
+	for _, change := range changes {
+		if !reloadableOptions[change.name] {
+			return nil, changes, errors.New("reload rejected, restart to apply the options")
+		}
+	}
+
+	live := *loaded
+	live.ClientToken, live.ServerToken = current.ClientToken, current.ServerToken
+	live.PrevClientToken, live.PrevClientUntil = current.PrevClientToken, current.PrevClientUntil
+	live.PrevServerToken, live.PrevServerUntil = current.PrevServerToken, current.PrevServerUntil
+	for _, change := range changes {
+		switch change.name {
+		case "client-token":
+			live.PrevClientToken, live.PrevClientUntil = current.ClientToken, now.Add(live.TokenOverlap)
+			live.ClientToken = loaded.ClientToken
+		case "server-token":
+			live.PrevServerToken, live.PrevServerUntil = current.ServerToken, now.Add(live.TokenOverlap)
+			live.ServerToken = loaded.ServerToken
+		}
+	}
+	return &live, changes, nil
+}
+
+// Reload read options again from the command line, environment variables and the config file,
+// and apply the reloadable ones. Nothing is applied if any other option is changed.
+func (h *Hub) Reload() error {
+	conf, err := loadConfig(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		return err
+	}
+	live, changes, err := reloadLive(h.config.live(), conf.live(), h.config.flags, conf.flags, time.Now())
+	if err != nil {
+		for _, change := range changes {
+			if !reloadableOptions[change.name] {
+				h.log.Warn("option can't be reloaded", logger.F("change", change))
+			}
+		}
+		return err
+	}
+	for _, change := range changes {
+		if change.name == "log-level" || change.name == "log-format" {
+			conf.applyLogging()
+		}
+		h.log.Info("option reloaded", logger.F("change", change))
+	}
+	h.config.liveValue.Store(live)
+	h.config.flags = conf.flags
+	return nil
+}
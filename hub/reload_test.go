@@ -0,0 +1,92 @@
+package hub
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/segmentio/ksuid"
+)
+
+// reloadFlagSet a flag set with reloadable options and not, tokens default to random values like loadConfig
+func reloadFlagSet(t *testing.T, args ...string) (*flag.FlagSet, *liveConfig) {
+	var sc serverConfig
+	var overlap time.Duration
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&sc.ListenHost, "listen-host", "0.0.0.0:8380", "")
+	fs.StringVar(&sc.Origins, "origins", "*", "")
+	fs.StringVar(&sc.ClientToken, "client-token", ksuid.New().String(), "")
+	fs.StringVar(&sc.ServerToken, "server-token", ksuid.New().String(), "")
+	fs.DurationVar(&overlap, "token-rotation-overlap", time.Minute, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return fs, newLiveConfig(&sc, overlap)
+}
+
+func sign(token, text string) string {
+	h := md5.Sum([]byte(text + token))
+	return hex.EncodeToString(h[:])
+}
+
+func TestReloadLive(t *testing.T) {
+	now := time.Now()
+	oldFlags, current := reloadFlagSet(t, "-client-token", "old", "-origins", "a.com")
+
+	// options which can't be reloaded
+	newFlags, loaded := reloadFlagSet(t, "-client-token", "old", "-origins", "a.com", "-listen-host", "0.0.0.0:9000")
+	if _, changes, err := reloadLive(current, loaded, oldFlags, newFlags, now); err == nil || len(changes) != 1 {
+		t.Errorf("reloadLive() of -listen-host error = %v, changes %v", err, changes)
+	}
+
+	// random defaults of tokens aren't changes
+	newFlags, loaded = reloadFlagSet(t, "-client-token", "old", "-origins", "b.com")
+	live, changes, err := reloadLive(current, loaded, oldFlags, newFlags, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].name != "origins" {
+		t.Errorf("reloadLive() changes = %v, want -origins", changes)
+	}
+	if live.Origins != "b.com" || live.ClientToken != "old" || live.ServerToken != current.ServerToken || live.PrevServerToken != "" {
+		t.Errorf("reloadLive() = %+v", live)
+	}
+
+	// rotation
+	newFlags, loaded = reloadFlagSet(t, "-client-token", "new", "-token-rotation-overlap", "10m")
+	live, _, err = reloadLive(current, loaded, oldFlags, newFlags, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.ClientToken != "new" || live.PrevClientToken != "old" || !live.PrevClientUntil.Equal(now.Add(10*time.Minute)) {
+		t.Errorf("reloadLive() client tokens %v, previous %v until %v", live.ClientToken, live.PrevClientToken, live.PrevClientUntil)
+	}
+	if live.PrevServerToken != "" {
+		t.Errorf("reloadLive() rotated the server token")
+	}
+	if !live.checkClientDigest("nonce", sign("new", "nonce")) {
+		t.Errorf("checkClientDigest() refused the new token")
+	}
+	if !live.checkClientDigest("nonce", sign("old", "nonce")) {
+		t.Errorf("checkClientDigest() refused the previous token inside the overlap")
+	}
+	if live.checkClientDigest("nonce", sign("other", "nonce")) {
+		t.Errorf("checkClientDigest() accepted another token")
+	}
+
+	// the previous token is refused after the overlap
+	live, _, err = reloadLive(current, loaded, oldFlags, newFlags, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if live.checkClientDigest("nonce", sign("old", "nonce")) {
+		t.Errorf("checkClientDigest() accepted the previous token after the overlap")
+	}
+	if !live.checkClientDigest("nonce", sign("new", "nonce")) {
+		t.Errorf("checkClientDigest() refused the new token")
+	}
+}
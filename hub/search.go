@@ -0,0 +1,151 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ws-cluster/database"
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+const (
+	// searchConsumer name of the message log consumer feeding the search index
+	searchConsumer     = "search"
+	defaultSearchName  = "search.db"
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// indexMessages index logged chat messages which are saved by the persist policy, and their recalls and edits
+func indexMessages(index *database.SearchIndex, policy *persistPolicy, bufs []*bytes.Buffer) error {
+	msgs := make([]*database.SearchMsg, 0)
+	mods := make([]*database.MsgModify, 0)
+	for _, buf := range bufs {
+		packet := new(wire.Message)
+		if err := packet.Decode(buf); err != nil {
+			hubLog.Error("decode logged message failed", logger.Err(err))
+			continue
+		}
+		header := packet.Header
+		destType := header.Dest.Type()
+		if policy.action(header) != persistSave || (destType != wire.AddrClient && destType != wire.AddrGroup) {
+			continue
+		}
+		switch header.Command {
+		case wire.MsgTypeChat:
+			body := packet.Body.(*wire.Msgchat)
+			if body.MsgID == 0 {
+				continue
+			}
+			msgs = append(msgs, &database.SearchMsg{
+				IsGroup:    destType == wire.AddrGroup,
+				MsgID:      body.MsgID,
+				FromDomain: header.Source.Domain(),
+				ToDomain:   header.Dest.Domain(),
+				From:       header.Source.Address(),
+				To:         header.Dest.Address(),
+				Type:       body.Type,
+				Text:       body.Text,
+				Extra:      body.Extra,
+				CreateAt:   msgIDTime(body.MsgID),
+			})
+		case wire.MsgTypeRecall:
+			mods = append(mods, &database.MsgModify{
+				MsgID:      packet.Body.(*wire.MsgRecall).MsgID,
+				FromDomain: header.Source.Domain(),
+				From:       header.Source.Address(),
+				Recall:     true,
+			})
+		case wire.MsgTypeEdit:
+			body := packet.Body.(*wire.MsgEdit)
+			mods = append(mods, &database.MsgModify{
+				MsgID:      body.MsgID,
+				FromDomain: header.Source.Domain(),
+				From:       header.Source.Address(),
+				Text:       body.Text,
+				Extra:      body.Extra,
+				ModifyAt:   time.Now(),
+			})
+		}
+	}
+	if len(msgs) > 0 {
+		if err := index.Index(msgs); err != nil {
+			return err
+		}
+	}
+	// modify after indexing, the message may be in the same batch
+	if len(mods) > 0 {
+		return index.Modify(mods)
+	}
+	return nil
+}
+
+// 按关键字搜索消息
+// /admin/search?domain=&q=&from_domain=&from=&to=&group=&start=&end=&before_id=&limit=
+// start and end are unix milliseconds
+func adminSearchHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if hub.config.index == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	domain, err := strconv.ParseUint(q.Get("domain"), 10, 32)
+	if err != nil {
+		handleHTTPErr(w, err)
+		return
+	}
+	query := &database.SearchQuery{
+		Domain:  uint32(domain),
+		Keyword: q.Get("q"),
+		From:    q.Get("from"),
+		To:      q.Get("to"),
+		Group:   q.Get("group"),
+	}
+	if s := q.Get("from_domain"); s != "" {
+		fromDomain, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			handleHTTPErr(w, err)
+			return
+		}
+		query.FromDomain = uint32(fromDomain)
+	}
+	if start, _ := strconv.ParseUint(q.Get("start"), 10, 64); start != 0 {
+		query.StartTime = millisToTime(start)
+	}
+	if end, _ := strconv.ParseUint(q.Get("end"), 10, 64); end != 0 {
+		query.EndTime = millisToTime(end)
+	}
+	query.BeforeID, _ = strconv.ParseUint(q.Get("before_id"), 10, 64)
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	} else if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	query.Limit = limit + 1 // one more to tell if there is next page
+
+	hits, err := hub.config.index.Search(query)
+	if err == database.ErrEmptyKeyword {
+		handleHTTPErr(w, err)
+		return
+	}
+	if err != nil {
+		hub.log.Error("search failed", logger.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	res := struct {
+		Hits []*database.SearchHit
+		More bool
+	}{hits, false}
+	if len(hits) > limit {
+		res.Hits = hits[:limit]
+		res.More = true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
@@ -5,12 +5,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/ws-cluster/peer"
+	"github.com/ws-cluster/tracing"
 	"github.com/ws-cluster/wire"
 )
 
@@ -22,14 +23,21 @@ type ServerPeer struct {
 	HostServer *Server // host
 	Server     *Server // Server
 
-	packet chan<- *Packet
+	packet   chan<- *Packet
+	tracer   *tracing.Tracer
+	features uint32 // reported by the server on connecting
 }
 
 // OnMessage 接收消息
 func (p *ServerPeer) OnMessage(message *wire.Message) error {
+	span := p.tracer.StartChild(traceParent(message.Header), spanServerReceive, tracing.KindServer)
+	setMessageAttrs(span, message.Header)
+	setTrace(message.Header, span)
 	respchan := make(chan *Resp)
 	p.packet <- &Packet{from: p.Addr, use: useForRelayMessage, content: message, resp: respchan}
-	<-respchan
+	resp := <-respchan
+	span.SetError(resp.Err)
+	span.End()
 	// header := message.Header
 	// if !header.Dest.IsEmpty() {
 	// 	log.Printf("message %v to %v , Type: %v", header.Source.String(), header.Dest.String(), header.Command)
@@ -50,7 +58,7 @@ func (p *ServerPeer) OnDisconnect() error {
 	p.packet <- &Packet{from: p.Addr, use: useForDelServerPeer, content: p, resp: respchan}
 	<-respchan
 
-	log.Printf("server %v disconnected", p.Addr.String())
+	p.Logger().Info("server disconnected")
 
 	// // 尝试重连
 	// for p.reconnectTimes < reconnectTimes {
@@ -73,7 +81,8 @@ func (p *ServerPeer) OnDisconnect() error {
 	return nil
 }
 
-func (p *ServerPeer) connect() error {
+// connect dial the server, trace contexts are written if it reports FeatureTraceContext
+func (p *ServerPeer) connect(config *peer.Config) error {
 	host := p.HostServer
 	// 生成加密摘要
 	h := md5.New()
@@ -86,6 +95,7 @@ func (p *ServerPeer) connect() error {
 	header.Add("server_url", host.AdvertiseServerURL.String())
 	header.Add("client_url", host.AdvertiseClientURL.String())
 	header.Add("digest", digest)
+	header.Add("features", strconv.FormatUint(uint64(serverFeatures), 10))
 
 	// log.Printf("connecting to %s", u.String())
 
@@ -96,39 +106,44 @@ func (p *ServerPeer) connect() error {
 
 	conn, resp, err := dialar.Dial(fmt.Sprintf("%v/server", p.Server.AdvertiseServerURL.String()), header)
 	if err != nil {
-		log.Println("dial:", err)
 		return err
 	}
 	if resp.StatusCode != 101 {
 		return fmt.Errorf("connect fail,code:%v", resp.StatusCode)
 	}
+	p.features = remoteFeatures(resp.Header)
+	config.TraceContext = p.features&wire.FeatureTraceContext != 0
 	p.SetConnection(conn)
 	return nil
 }
 
 // newServerPeer 主动去连接另一台服务节点器
 func newServerPeer(h *Hub, server *Server) (*ServerPeer, error) {
+	host := *h.Server
+	host.Token = h.config.live().ServerToken // the token may be reloaded
 	serverPeer := &ServerPeer{
-		HostServer: h.Server,
+		HostServer: &host,
 		Server:     server,
 		IsOut:      true,
 		packet:     h.packetQueue,
+		tracer:     h.tracer,
 	}
 
-	peer := peer.NewPeer(server.Addr, server.AdvertiseServerURL.Host,
-		&peer.Config{
-			Listeners: &peer.MessageListeners{
-				OnMessage:    serverPeer.OnMessage,
-				OnDisconnect: serverPeer.OnDisconnect,
-			},
-			PingPeriod:     time.Second * 20,
-			PongWait:       time.Second * 30,
-			MaxMessageSize: 1024 * 10, //1M
-		})
+	config := &peer.Config{
+		Listeners: &peer.MessageListeners{
+			OnMessage:    serverPeer.OnMessage,
+			OnDisconnect: serverPeer.OnDisconnect,
+		},
+		PingPeriod:     time.Second * 20,
+		PongWait:       time.Second * 30,
+		MaxMessageSize: 1024 * 10, //1M
+		Logger:         h.peerLogger(server.Addr, server.AdvertiseServerURL.Host),
+	}
+	peer := peer.NewPeer(server.Addr, server.AdvertiseServerURL.Host, config)
 
 	serverPeer.Peer = peer
 	// 主动进行连接
-	if err := serverPeer.connect(); err != nil {
+	if err := serverPeer.connect(config); err != nil {
 		return nil, err
 	}
 
@@ -136,12 +151,15 @@ func newServerPeer(h *Hub, server *Server) (*ServerPeer, error) {
 }
 
 // bindServerPeer 处理其它服务器节点过来的连接
-func bindServerPeer(h *Hub, conn *websocket.Conn, server *Server, remoteAddr string) (*ServerPeer, error) {
+// features are reported by the server, trace contexts are written if it has FeatureTraceContext
+func bindServerPeer(h *Hub, conn *websocket.Conn, server *Server, remoteAddr string, features uint32) (*ServerPeer, error) {
 	serverPeer := &ServerPeer{
 		HostServer: h.Server,
 		Server:     server,
 		IsOut:      false,
 		packet:     h.packetQueue,
+		tracer:     h.tracer,
+		features:   features,
 	}
 
 	peer := peer.NewPeer(server.Addr, remoteAddr,
@@ -153,6 +171,8 @@ func bindServerPeer(h *Hub, conn *websocket.Conn, server *Server, remoteAddr str
 			PingPeriod:     time.Second * 20,
 			PongWait:       time.Second * 30,
 			MaxMessageSize: 1024 * 10, //1M
+			Logger:         h.peerLogger(server.Addr, remoteAddr),
+			TraceContext:   features&wire.FeatureTraceContext != 0,
 		})
 
 	serverPeer.Peer = peer
@@ -0,0 +1,405 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+const (
+	// tapQueueSize events waiting for the admin websocket, more are dropped
+	tapQueueSize = 256
+	// tapRefresh taps are sent to the other servers again in this interval
+	tapRefresh = 15 * time.Second
+	// tapExpire a tap of another server is removed if it isn't sent again in this duration
+	tapExpire       = 3 * tapRefresh
+	tapWriteWait    = 10 * time.Second
+	tapPingInterval = 20 * time.Second
+)
+
+var (
+	// ErrTooManyTaps -tap-max taps are opened on this server
+	ErrTooManyTaps = errors.New("too many taps")
+
+	tapUpgrader = &websocket.Upgrader{}
+)
+
+type tapKey struct {
+	server wire.Addr // server the tap is opened on
+	id     uint64
+}
+
+// tap messages matching the filter are sent as events, to the websocket of a tap opened on this server,
+// or to the server opened it. It is owned by packetHandler.
+type tap struct {
+	key     tapKey
+	filter  *wire.MsgTap
+	limiter *rateLimiter
+	dropped uint64      // events dropped since the last event
+	events  chan []byte // events of a tap opened on this server
+	expire  time.Time   // of a tap opened on another server
+}
+
+// tapEvent a message handled by packetHandler of Server, which is received from From
+type tapEvent struct {
+	Time    time.Time
+	Server  wire.Addr
+	From    wire.Addr
+	Source  wire.Addr
+	Dest    wire.Addr
+	Command string
+	Seq     uint32
+	Body    json.RawMessage
+	Dropped uint64 `json:",omitempty"` // events dropped by the server since its previous event
+}
+
+// newTapLimiter the rate asked by the tap is lowered to the cap, 0 means the cap
+func newTapLimiter(cap float64, rate uint32) (*rateLimiter, float64) {
+	if rate > 0 && float64(rate) < cap {
+		cap = float64(rate)
+	}
+	burst := int(cap)
+	if burst < 1 {
+		burst = 1
+	}
+	return newRateLimiter(cap, burst), cap
+}
+
+// tapMatch empty fields of the filter match any message, taps and their events are never matched
+func tapMatch(filter *wire.MsgTap, header *wire.Header) bool {
+	if header.Command == wire.MsgTypeTap || header.Command == wire.MsgTypeTapEvent {
+		return false
+	}
+	if !filter.Source.IsEmpty() && header.Source != filter.Source {
+		return false
+	}
+	if !filter.Dest.IsEmpty() && header.Dest != filter.Dest {
+		return false
+	}
+	if filter.Domain != 0 && header.Source.Domain() != filter.Domain && header.Dest.Domain() != filter.Domain {
+		return false
+	}
+	if len(filter.Commands) == 0 {
+		return true
+	}
+	for _, command := range filter.Commands {
+		if command == header.Command {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTapFilter source=&dest=&domain=&command=chat,3&rate=, commands are names of metrics or numbers
+func parseTapFilter(query url.Values) (*wire.MsgTap, error) {
+	filter := &wire.MsgTap{Commands: []uint8{}}
+	for _, f := range []struct {
+		name string
+		addr *wire.Addr
+	}{{"source", &filter.Source}, {"dest", &filter.Dest}} {
+		if s := query.Get(f.name); s != "" {
+			addr, err := wire.ParseAddr(s)
+			if err != nil || addr.IsEmpty() {
+				return nil, fmt.Errorf("invalid %v %v", f.name, s)
+			}
+			*f.addr = *addr
+		}
+	}
+	if s := query.Get("domain"); s != "" {
+		domain, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid domain %v", s)
+		}
+		filter.Domain = uint32(domain)
+	}
+	if s := query.Get("rate"); s != "" {
+		rate, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate %v", s)
+		}
+		filter.Rate = uint32(rate)
+	}
+	if s := query.Get("command"); s != "" {
+	commands:
+		for _, name := range strings.Split(s, ",") {
+			name = strings.TrimSpace(name)
+			if command, err := strconv.ParseUint(name, 10, 8); err == nil {
+				filter.Commands = append(filter.Commands, uint8(command))
+				continue
+			}
+			for command, n := range commandNames {
+				if n == name {
+					filter.Commands = append(filter.Commands, command)
+					continue commands
+				}
+			}
+			return nil, fmt.Errorf("invalid command %v", name)
+		}
+		if len(filter.Commands) > math.MaxUint8 {
+			return nil, wire.ErrTooManyCommands
+		}
+	}
+	return filter, nil
+}
+
+// 监听集群中的消息，消息经过任一服务器的处理循环时以 json 发送到 websocket，
+// 经过多台服务器的消息每台发送一次，每台服务器每秒最多发送 -tap-rate 条
+// GET /admin/tap?source=&dest=&domain=&command=chat,signal&rate=
+func adminTapHandler(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	filter, err := parseTapFilter(r.URL.Query())
+	if err != nil {
+		handleHTTPErr(w, err)
+		return
+	}
+	t := &tap{filter: filter, events: make(chan []byte, tapQueueSize)}
+	resp, err := hub.tapRequest(useForAddTap, t, func(resp *Resp) {
+		if resp.Err == nil { // opened after the timeout
+			hub.tapRequest(useForDelTap, t.key, nil)
+		}
+	})
+	if err != nil {
+		hub.log.Warn("open tap failed", logger.Err(err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if resp.Err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintln(w, resp.Err)
+		return
+	}
+	defer func() {
+		if _, err := hub.tapRequest(useForDelTap, t.key, nil); err != nil {
+			hub.log.Warn("close tap failed, it is closed later", logger.F("tap", t.key.id), logger.Err(err))
+		}
+	}()
+
+	conn, err := tapUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		hub.log.Warn("upgrade failed", logger.F(logger.KeyRemote, r.RemoteAddr), logger.Err(err))
+		return
+	}
+	defer conn.Close()
+	closed := make(chan struct{})
+	go func() { // nothing is expected from the admin, read until it closes
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	ticker := time.NewTicker(tapPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event := <-t.events:
+			conn.SetWriteDeadline(time.Now().Add(tapWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(tapWriteWait)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// tapRequest send a tap packet to the hub loop and wait for the response in defaultProbeTimeout.
+// If the hub doesn't respond in time, the packet is still sent and late is called with its response in a new routine.
+func (h *Hub) tapRequest(use uint8, content interface{}, late func(*Resp)) (*Resp, error) {
+	resp := make(chan *Resp, 1)
+	packet := &Packet{from: h.Server.Addr, use: use, content: content, resp: resp}
+	timer := time.NewTimer(defaultProbeTimeout)
+	defer timer.Stop()
+	select {
+	case h.packetQueue <- packet:
+	case <-timer.C:
+		go func() {
+			h.packetQueue <- packet
+			if r := <-resp; late != nil {
+				late(r)
+			}
+		}()
+		return nil, ErrProbeTimeout
+	}
+	select {
+	case r := <-resp:
+		return r, nil
+	case <-timer.C:
+		go func() {
+			if r := <-resp; late != nil {
+				late(r)
+			}
+		}()
+		return nil, ErrProbeTimeout
+	}
+}
+
+// handleTapAddPacket open a tap on this server and send it to the other servers
+func (h *Hub) handleTapAddPacket(t *tap, resp chan<- *Resp) {
+	live := h.config.live()
+	opened := 0
+	for key := range h.taps {
+		if key.server == h.Server.Addr {
+			opened++
+		}
+	}
+	if opened >= live.TapMax {
+		resp <- &Resp{Status: wire.MsgStatusForbidden, Err: ErrTooManyTaps}
+		return
+	}
+	h.tapSeq++
+	t.key = tapKey{server: h.Server.Addr, id: h.tapSeq}
+	t.filter.ID = h.tapSeq
+	var rate float64
+	t.limiter, rate = newTapLimiter(live.TapRate, t.filter.Rate)
+	t.filter.Rate = uint32(math.Ceil(rate)) // other servers lower it to their caps
+	h.taps[t.key] = t
+	for _, speer := range h.serverPeers {
+		h.sendTap(speer, t.filter)
+	}
+	h.log.Info("tap opened", logger.F("tap", t.key.id), logger.F("rate", rate))
+	respond(resp, wire.MsgStatusOk)
+}
+
+// handleTapDelPacket close a tap opened on this server
+func (h *Hub) handleTapDelPacket(key tapKey, resp chan<- *Resp) {
+	if t, has := h.taps[key]; has {
+		delete(h.taps, key)
+		stop := &wire.MsgTap{ID: key.id, Stop: true, Commands: []uint8{}}
+		for _, speer := range h.serverPeers {
+			h.sendTap(speer, stop)
+		}
+		h.log.Info("tap closed", logger.F("tap", key.id), logger.F("dropped", t.dropped))
+	}
+	respond(resp, wire.MsgStatusOk)
+}
+
+// handleRemoteTap a tap of another server is opened, refreshed or closed
+func (h *Hub) handleRemoteTap(from wire.Addr, filter *wire.MsgTap) {
+	key := tapKey{server: from, id: filter.ID}
+	if filter.Stop {
+		delete(h.taps, key)
+		return
+	}
+	if t, has := h.taps[key]; has {
+		t.expire = time.Now().Add(tapExpire)
+		return
+	}
+	t := &tap{key: key, filter: filter, expire: time.Now().Add(tapExpire)}
+	t.limiter, _ = newTapLimiter(h.config.live().TapRate, filter.Rate)
+	h.taps[key] = t
+	h.log.Debug("tap of server opened", logger.F(logger.KeyPeer, from.String()), logger.F("tap", key.id))
+}
+
+// handleTapEvent an event of a tap opened on this server is sent by another server
+func (h *Hub) handleTapEvent(event *wire.MsgTapEvent) {
+	if t, has := h.taps[tapKey{server: h.Server.Addr, id: event.ID}]; has {
+		t.push([]byte(event.Event))
+	}
+}
+
+// sendTap to a server which supports taps
+func (h *Hub) sendTap(speer *ServerPeer, filter *wire.MsgTap) {
+	if speer.features&wire.FeatureMessageTap == 0 {
+		return
+	}
+	message := wire.MakeEmptyHeaderMessage(wire.MsgTypeTap, filter)
+	message.Header.Source = h.Server.Addr
+	message.Header.Dest = speer.Addr
+	speer.PushMessage(message, nil)
+}
+
+// refreshTaps send taps opened on this server again, so servers joined later get them,
+// and remove expired taps of other servers
+func (h *Hub) refreshTaps(now time.Time) {
+	refresh := now.Sub(h.tapRefreshed) >= tapRefresh
+	if refresh {
+		h.tapRefreshed = now
+	}
+	for key, t := range h.taps {
+		if key.server != h.Server.Addr {
+			if now.After(t.expire) {
+				delete(h.taps, key)
+			}
+		} else if refresh {
+			for _, speer := range h.serverPeers {
+				h.sendTap(speer, t.filter)
+			}
+		}
+	}
+}
+
+// dropServerTaps remove taps of a disconnected server
+func (h *Hub) dropServerTaps(server wire.Addr) {
+	for key := range h.taps {
+		if key.server == server {
+			delete(h.taps, key)
+		}
+	}
+}
+
+// tapMessage send an event of the message to matching taps, at most the rate of each tap
+func (h *Hub) tapMessage(from wire.Addr, message *wire.Message) {
+	var body json.RawMessage
+	for _, t := range h.taps {
+		if !tapMatch(t.filter, message.Header) {
+			continue
+		}
+		if !t.limiter.Allow() {
+			t.dropped++
+			continue
+		}
+		if body == nil {
+			var err error
+			if body, err = json.Marshal(message.Body); err != nil {
+				h.log.Warn("encode tapped message failed", logger.F(logger.KeyCommand, message.Header.Command), logger.Err(err))
+				return
+			}
+		}
+		header := message.Header
+		event, _ := json.Marshal(&tapEvent{
+			Time:    time.Now(),
+			Server:  h.Server.Addr,
+			From:    from,
+			Source:  header.Source,
+			Dest:    header.Dest,
+			Command: commandName(header.Command),
+			Seq:     header.Seq,
+			Body:    body,
+			Dropped: t.dropped,
+		})
+		t.dropped = 0
+		if t.key.server == h.Server.Addr {
+			t.push(event)
+		} else if speer, has := h.serverPeers[t.key.server]; has {
+			tapEvent := wire.MakeEmptyHeaderMessage(wire.MsgTypeTapEvent, &wire.MsgTapEvent{ID: t.key.id, Event: string(event)})
+			tapEvent.Header.Source = h.Server.Addr
+			tapEvent.Header.Dest = t.key.server
+			speer.PushMessage(tapEvent, nil)
+		}
+	}
+}
+
+// push never blocks, the event is dropped if the websocket is slow
+func (t *tap) push(event []byte) {
+	select {
+	case t.events <- event:
+	default:
+		t.dropped++
+	}
+}
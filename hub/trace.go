@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ws-cluster/tracing"
+	"github.com/ws-cluster/wire"
+)
+
+// names of spans, a message from a client on this server to a group spread over other servers makes
+// client.receive > hub.queue, messagelog.write, hub.relay > hub.broadcast, group.deliver
+// and on the other servers server.receive > hub.queue, hub.relay > group.deliver
+const (
+	spanClientReceive = "client.receive"
+	spanServerReceive = "server.receive"
+	spanQueue         = "hub.queue"
+	spanMessageLog    = "messagelog.write"
+	spanRelay         = "hub.relay"
+	spanBroadcast     = "hub.broadcast"
+	spanGroupDeliver  = "group.deliver"
+)
+
+// serverFeatures features reported to other servers in header features on connecting
+const serverFeatures = wire.FeatureTraceContext | wire.FeatureMessageTap
+
+// newTracer tracer exporting spans to the file, nil if the file isn't set
+func newTracer(sc *serverConfig, serverAddr wire.Addr) (*tracing.Tracer, error) {
+	if sc.TraceFile == "" {
+		return nil, nil
+	}
+	exporter, err := tracing.NewFileExporter(sc.TraceFile,
+		tracing.Attr("service.name", "wscluster"), tracing.Attr("service.instance.id", serverAddr.String()))
+	if err != nil {
+		return nil, err
+	}
+	return tracing.NewTracer(&tracing.Config{SampleRate: sc.TraceSample, Exporter: exporter}), nil
+}
+
+// traceParent context carried by the header, it is invalid if there is none
+func traceParent(header *wire.Header) tracing.SpanContext {
+	if header.Trace == nil {
+		return tracing.SpanContext{}
+	}
+	return tracing.SpanContext{TraceID: header.Trace.TraceID, SpanID: header.Trace.SpanID, Flags: header.Trace.Flags}
+}
+
+// setTrace the span becomes the parent of the following stages, the header is unchanged for a nil span
+func setTrace(header *wire.Header, span *tracing.Span) {
+	if span == nil {
+		return
+	}
+	sc := span.Context()
+	header.Trace = &wire.TraceContext{TraceID: sc.TraceID, SpanID: sc.SpanID, Flags: sc.Flags}
+}
+
+// withTrace a copy of the message whose header carries the span as the parent, the message itself
+// for a nil span. The header of a message delivered to several peers isn't changed
+func withTrace(message *wire.Message, span *tracing.Span) *wire.Message {
+	if span == nil {
+		return message
+	}
+	header := *message.Header
+	setTrace(&header, span)
+	return &wire.Message{Header: &header, Body: message.Body}
+}
+
+// setMessageAttrs describe the message by attributes of the span, they are built only if it is sampled
+func setMessageAttrs(span *tracing.Span, header *wire.Header) {
+	if span == nil {
+		return
+	}
+	span.SetAttr(tracing.Attr("wscluster.command", header.Command),
+		tracing.Attr("wscluster.seq", header.Seq),
+		tracing.Attr("wscluster.source", header.Source.String()))
+	if !header.Dest.IsEmpty() { // empty for commands to the server
+		span.SetAttr(tracing.Attr("wscluster.dest", header.Dest.String()))
+	}
+}
+
+// remoteFeatures features reported by another server, 0 for an old server
+func remoteFeatures(header http.Header) uint32 {
+	features, _ := strconv.ParseUint(header.Get("features"), 10, 32)
+	return uint32(features)
+}
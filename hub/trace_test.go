@@ -0,0 +1,36 @@
+package hub
+
+import (
+	"testing"
+
+	"github.com/ws-cluster/tracing"
+	"github.com/ws-cluster/wire"
+)
+
+type nopExporter struct{}
+
+func (nopExporter) Export(span *tracing.SpanData) {}
+func (nopExporter) Close() error                  { return nil }
+
+func TestWithTrace(t *testing.T) {
+	tracer := tracing.NewTracer(&tracing.Config{SampleRate: 1, Exporter: nopExporter{}})
+	relay := tracer.Start(spanRelay, tracing.KindInternal)
+	message := wire.MakeEmptyHeaderMessage(wire.MsgTypeChat, &wire.Msgchat{Text: "hi"})
+	setTrace(message.Header, relay)
+
+	if got := withTrace(message, nil); got != message {
+		t.Errorf("withTrace() of a nil span copied the message")
+	}
+
+	span := tracer.StartChild(traceParent(message.Header), spanBroadcast, tracing.KindProducer)
+	sent := withTrace(message, span)
+	if traceParent(sent.Header) != span.Context() {
+		t.Errorf("withTrace() parent = %+v, want the broadcast span %+v", traceParent(sent.Header), span.Context())
+	}
+	if traceParent(message.Header) != relay.Context() {
+		t.Errorf("withTrace() changed the header of the message")
+	}
+	if sent.Header.Trace.TraceID != relay.Context().TraceID || sent.Body != message.Body {
+		t.Errorf("withTrace() = %+v, want the same trace and body", sent)
+	}
+}
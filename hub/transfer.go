@@ -0,0 +1,196 @@
+package hub
+
+import (
+	"hash"
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+
+	"github.com/ws-cluster/logger"
+	"github.com/ws-cluster/wire"
+)
+
+// transferKey a transfer id is only unique for its sender
+type transferKey struct {
+	source wire.Addr
+	id     uint64
+}
+
+// transfer state of a file transfer, only kept in the server the sender logined in.
+// chunks are relayed one by one, the whole file is never buffered.
+// Chunks in the window reach the hub in any order, as each message of a peer is handled in its own routine,
+// the ones ahead of next are kept until the chunks before them arrive, so crc is computed in the order of index.
+type transfer struct {
+	dest     wire.Addr
+	size     uint64
+	received uint64
+	next     uint32            // index of the first chunk not received
+	early    map[uint32][]byte // chunks received ahead of next, at most the window
+	crc      hash.Hash32
+	inflight int32 // chunks relayed but not written to the next hop yet
+	activeAt time.Time
+}
+
+func newTransfer(dest wire.Addr, size uint64) *transfer {
+	return &transfer{
+		dest:     dest,
+		size:     size,
+		early:    make(map[uint32][]byte),
+		crc:      crc32.NewIEEE(),
+		activeAt: time.Now(),
+	}
+}
+
+// accept a chunk in the window from next, false if it is out of the window or received already
+func (t *transfer) accept(index uint32, data []byte, window int) bool {
+	if index < t.next || uint64(index) >= uint64(t.next)+uint64(window) {
+		return false
+	}
+	if index != t.next {
+		if _, has := t.early[index]; has {
+			return false
+		}
+		t.early[index] = data
+		t.received += uint64(len(data))
+		return true
+	}
+	t.crc.Write(data)
+	t.received += uint64(len(data))
+	t.next++
+	for {
+		data, has := t.early[t.next]
+		if !has {
+			return true
+		}
+		delete(t.early, t.next)
+		t.crc.Write(data)
+		t.next++
+	}
+}
+
+// complete all chunks are received in order, and the size and crc are the same
+func (t *transfer) complete(end *wire.MsgFileEnd) bool {
+	return len(t.early) == 0 && t.received == t.size && t.next == end.Chunks && t.crc.Sum32() == end.Checksum
+}
+
+func (h *Hub) handleTransferPacket(from wire.Addr, message *wire.Message, resp chan<- *Resp) {
+	header := message.Header
+	switch header.Command {
+	case wire.MsgTypeFileBegin:
+		body := message.Body.(*wire.MsgFileBegin)
+		key := transferKey{header.Source, body.TransferID}
+		// the window can't cover the members of a group
+		if _, has := h.transfers[key]; has || header.Dest.Type() != wire.AddrClient {
+			respond(resp, wire.MsgStatusTransferInvaild)
+			return
+		}
+		h.transfers[key] = newTransfer(header.Dest, body.Size)
+		h.handleRelayPacket(from, message, resp)
+	case wire.MsgTypeFileChunk:
+		body := message.Body.(*wire.MsgFileChunk)
+		t, has := h.transfers[transferKey{header.Source, body.TransferID}]
+		if !has || t.dest != header.Dest {
+			respond(resp, wire.MsgStatusTransferInvaild)
+			return
+		}
+		window := h.config.live().TransferWindow
+		if atomic.LoadInt32(&t.inflight) >= int32(window) {
+			respond(resp, wire.MsgStatusBusy)
+			return
+		}
+		if !t.accept(body.Index, body.Data, window) {
+			respond(resp, wire.MsgStatusTransferInvaild)
+			return
+		}
+		t.activeAt = time.Now()
+		atomic.AddInt32(&t.inflight, 1)
+		h.relayChunk(from, message, t, resp)
+	case wire.MsgTypeFileEnd:
+		body := message.Body.(*wire.MsgFileEnd)
+		key := transferKey{header.Source, body.TransferID}
+		t, has := h.transfers[key]
+		if !has || t.dest != header.Dest {
+			respond(resp, wire.MsgStatusTransferInvaild)
+			return
+		}
+		delete(h.transfers, key)
+		if !t.complete(body) {
+			// still relay the end, the receiver discards the file by the status
+			header.Status = wire.MsgStatusChecksumMismatch
+			h.handleRelayPacket(from, message, nil)
+			respond(resp, wire.MsgStatusChecksumMismatch)
+			return
+		}
+		h.handleRelayPacket(from, message, resp)
+	}
+}
+
+// relayChunk relay a chunk and acknowledge it after it is written to the next hop,
+// so the sender can't have more than the window size of chunks buffered in server.
+// The next hop is the connection of dest client in this server, or the link to the server dest is located in,
+// the ack doesn't mean the chunk is received by a remote client. If dest isn't located,
+// the chunk is broadcast and acknowledged when it is queued.
+func (h *Hub) relayChunk(from wire.Addr, message *wire.Message, t *transfer, resp chan<- *Resp) {
+	done := make(chan error, 1)
+	dest := message.Header.Dest
+	pushed := false
+	if dest.Type() == wire.AddrClient {
+		if cpeer, ok := h.clientPeers[dest]; ok {
+			cpeer.PushMessage(message, done)
+			pushed = true
+		} else if serverAddr, has := h.location[dest]; has {
+			if speer, ok := h.serverPeers[serverAddr]; ok {
+				speer.PushMessage(message, done)
+				pushed = true
+			}
+		}
+	}
+	if !pushed { // no single link to wait for, relay as usual
+		relayResp := make(chan *Resp, 1)
+		h.handleRelayPacket(from, message, relayResp)
+		done <- (<-relayResp).Err
+	}
+
+	go func() {
+		err := <-done
+		atomic.AddInt32(&t.inflight, -1)
+		if resp == nil {
+			return
+		}
+		status := wire.MsgStatusOk
+		if err != nil && err != ErrPeerNoFound {
+			status = wire.MsgStatusException
+		}
+		resp <- &Resp{Status: status, Err: err}
+	}()
+}
+
+// cleanTransfers drop transfers which are inactive for a while
+func (h *Hub) cleanTransfers() {
+	deadline := time.Now().Add(-h.config.live().TransferTimeout)
+	for key, t := range h.transfers {
+		if t.activeAt.Before(deadline) {
+			h.log.Info("transfer timeout", logger.F("transfer", key.id), logger.F("source", key.source.String()))
+			delete(h.transfers, key)
+		}
+	}
+}
+
+// dropTransfers drop all transfers of a sender
+func (h *Hub) dropTransfers(source wire.Addr) {
+	for key := range h.transfers {
+		if key.source == source {
+			delete(h.transfers, key)
+		}
+	}
+}
+
+func isTransferCommand(command uint8) bool {
+	return command == wire.MsgTypeFileBegin || command == wire.MsgTypeFileChunk || command == wire.MsgTypeFileEnd
+}
+
+func respond(resp chan<- *Resp, status uint8) {
+	if resp != nil {
+		resp <- &Resp{Status: status}
+	}
+}
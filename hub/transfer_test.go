@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"testing"
+
+	"github.com/ws-cluster/wire"
+)
+
+func TestTransfer_AcceptWindow(t *testing.T) {
+	const window = 8
+	chunks := make([][]byte, 3*window)
+	file := make([]byte, 0)
+	for i := range chunks {
+		chunks[i] = []byte{byte(i), byte(i * 7), byte(i * 13)}
+		file = append(file, chunks[i]...)
+	}
+	end := &wire.MsgFileEnd{Chunks: uint32(len(chunks)), Checksum: crc32.ChecksumIEEE(file)}
+
+	tr := newTransfer(wire.Addr{}, uint64(len(file)))
+	r := rand.New(rand.NewSource(1))
+	// a full window is sent before any ack, and reaches the hub in any order
+	for start := 0; start < len(chunks); start += window {
+		for _, i := range r.Perm(window) {
+			index := start + i
+			if !tr.accept(uint32(index), chunks[index], window) {
+				t.Fatalf("accept(%v) = false, next %v", index, tr.next)
+			}
+		}
+		if tr.next != uint32(start+window) || len(tr.early) != 0 {
+			t.Fatalf("next = %v with %v early chunks, want %v", tr.next, len(tr.early), start+window)
+		}
+	}
+	if !tr.complete(end) {
+		t.Errorf("complete() = false, crc %x want %x", tr.crc.Sum32(), end.Checksum)
+	}
+}
+
+func TestTransfer_AcceptInvalid(t *testing.T) {
+	const window = 4
+	tr := newTransfer(wire.Addr{}, 12)
+	tests := []struct {
+		name  string
+		index uint32
+		want  bool
+	}{
+		{"ahead", 2, true},
+		{"ahead twice", 2, false},
+		{"out of window", window, false},
+		{"next", 0, true},
+		{"received", 0, false},
+		{"fill the gap", 1, true},
+		{"before next", 2, false},
+	}
+	for _, tt := range tests {
+		if got := tr.accept(tt.index, []byte{1, 2, 3}, window); got != tt.want {
+			t.Errorf("%v: accept(%v) = %v, want %v", tt.name, tt.index, got, tt.want)
+		}
+	}
+	if tr.next != 3 || len(tr.early) != 0 {
+		t.Errorf("next = %v with %v early chunks, want 3", tr.next, len(tr.early))
+	}
+	if tr.complete(&wire.MsgFileEnd{Chunks: 4, Checksum: tr.crc.Sum32()}) {
+		t.Errorf("complete() = true with a missing chunk")
+	}
+}
@@ -0,0 +1,303 @@
+// Package logger leveled logging with structured fields. Each subsystem has its own level,
+// which can be changed at runtime, and entries are written as text or json lines.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level of a log entry
+type Level int32
+
+const (
+	// LevelDebug details for debugging, such as every message
+	LevelDebug Level = iota
+	// LevelInfo state changes, such as connections
+	LevelInfo
+	// LevelWarn recoverable errors
+	LevelWarn
+	// LevelError errors which lose messages or stop a subsystem
+	LevelError
+)
+
+// keys of common fields
+const (
+	KeyPeer    = "peer"    // logic address of a client or server peer
+	KeyRemote  = "remote"  // remote ip:port of a connection
+	KeyServer  = "server"  // logic address of a server
+	KeyCommand = "command" // command of a message
+	KeySeq     = "seq"     // seq of a message
+	KeyError   = "err"
+)
+
+const timeFormat = "2006/01/02 15:04:05.000"
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parse debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %v", s)
+}
+
+// Field a key and value of a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F make a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err make an error field
+func Err(err error) Field {
+	return Field{Key: KeyError, Value: err}
+}
+
+type subsystem struct {
+	name  string
+	level int32
+}
+
+var (
+	mu           sync.Mutex // guards subsystems, defaultLevel and out
+	subsystems              = make(map[string]*subsystem)
+	defaultLevel            = LevelInfo
+	out          io.Writer  = os.Stderr
+	jsonFormat   int32
+)
+
+// Logger write entries of a subsystem with fields, it is safe for concurrent use
+type Logger struct {
+	sub    *subsystem
+	fields []Field
+}
+
+// New the logger of a subsystem, loggers of a subsystem share the level
+func New(name string) *Logger {
+	mu.Lock()
+	defer mu.Unlock()
+	return &Logger{sub: getSubsystem(name)}
+}
+
+func getSubsystem(name string) *subsystem {
+	sub, ok := subsystems[name]
+	if !ok {
+		sub = &subsystem{name: name, level: int32(defaultLevel)}
+		subsystems[name] = sub
+	}
+	return sub
+}
+
+// SetLevel set the level of a subsystem, an empty name sets the default level and all subsystems
+func SetLevel(name string, level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	if name == "" {
+		defaultLevel = level
+		for _, sub := range subsystems {
+			atomic.StoreInt32(&sub.level, int32(level))
+		}
+		return
+	}
+	atomic.StoreInt32(&getSubsystem(name).level, int32(level))
+}
+
+// SetLevels set levels by a spec like "info,peer=debug,filelog=warn",
+// a level without name is the default one and it is set before the others
+func SetLevels(spec string) error {
+	levels, err := ParseLevels(spec)
+	if err != nil {
+		return err
+	}
+	if level, ok := levels[""]; ok {
+		SetLevel("", level)
+	}
+	for name, level := range levels {
+		if name != "" {
+			SetLevel(name, level)
+		}
+	}
+	return nil
+}
+
+// ParseLevels parse a spec of SetLevels, the default level has an empty name
+func ParseLevels(spec string) (map[string]Level, error) {
+	levels := make(map[string]Level)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, text := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			name, text = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+			if name == "" {
+				return nil, fmt.Errorf("invalid log level %v", item)
+			}
+		}
+		level, err := ParseLevel(text)
+		if err != nil {
+			return nil, err
+		}
+		levels[name] = level
+	}
+	return levels, nil
+}
+
+// Levels levels of all subsystems
+func Levels() map[string]Level {
+	mu.Lock()
+	defer mu.Unlock()
+	levels := make(map[string]Level, len(subsystems))
+	for name, sub := range subsystems {
+		levels[name] = Level(atomic.LoadInt32(&sub.level))
+	}
+	return levels
+}
+
+// SetJSON write entries as json lines if it is true, otherwise as text
+func SetJSON(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&jsonFormat, v)
+}
+
+// SetOutput set the writer of all loggers
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// With a logger which adds fields to every entry
+func (l *Logger) With(fields ...Field) *Logger {
+	merged := make([]Field, 0, len(l.fields)+len(fields))
+	merged = append(append(merged, l.fields...), fields...)
+	return &Logger{sub: l.sub, fields: merged}
+}
+
+// Enabled entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.sub.level))
+}
+
+// Debug write a debug entry
+func (l *Logger) Debug(msg string, fields ...Field) {
+	l.log(LevelDebug, msg, fields)
+}
+
+// Info write an info entry
+func (l *Logger) Info(msg string, fields ...Field) {
+	l.log(LevelInfo, msg, fields)
+}
+
+// Warn write a warn entry
+func (l *Logger) Warn(msg string, fields ...Field) {
+	l.log(LevelWarn, msg, fields)
+}
+
+// Error write an error entry
+func (l *Logger) Error(msg string, fields ...Field) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level Level, msg string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	buf := &bytes.Buffer{}
+	now := time.Now()
+	if atomic.LoadInt32(&jsonFormat) == 1 {
+		l.writeJSON(buf, now, level, msg, fields)
+	} else {
+		l.writeText(buf, now, level, msg, fields)
+	}
+	mu.Lock()
+	out.Write(buf.Bytes())
+	mu.Unlock()
+}
+
+// writeText 2006/01/02 15:04:05.000 INFO [hub] msg key=value
+func (l *Logger) writeText(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	fmt.Fprintf(buf, "%v %v [%v] %v", now.Format(timeFormat), strings.ToUpper(level.String()), l.sub.name, msg)
+	for _, field := range [][]Field{l.fields, fields} {
+		for _, f := range field {
+			s := fmt.Sprint(fieldValue(f.Value))
+			if s == "" || strings.ContainsAny(s, " \"=\n\t") {
+				s = strconv.Quote(s)
+			}
+			fmt.Fprintf(buf, " %v=%v", f.Key, s)
+		}
+	}
+	buf.WriteByte('\n')
+}
+
+// writeJSON {"time":"","level":"","subsystem":"","msg":"",fields...}, fields are sorted by key
+func (l *Logger) writeJSON(buf *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	all := make([]Field, 0, len(l.fields)+len(fields))
+	all = append(append(all, l.fields...), fields...)
+	sort.SliceStable(all, func(i, j int) bool { return all[i].Key < all[j].Key })
+
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, now.Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"subsystem":`)
+	writeJSONValue(buf, l.sub.name)
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for _, f := range all {
+		buf.WriteByte(',')
+		writeJSONValue(buf, f.Key)
+		buf.WriteByte(':')
+		writeJSONValue(buf, fieldValue(f.Value))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// fieldValue errors and stringers are written as strings
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
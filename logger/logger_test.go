@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseLevels(t *testing.T) {
+	levels, err := ParseLevels("info, peer=debug,filelog=WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Level{"": LevelInfo, "peer": LevelDebug, "filelog": LevelWarn}
+	if len(levels) != len(want) {
+		t.Fatalf("ParseLevels() = %v, want %v", levels, want)
+	}
+	for name, level := range want {
+		if levels[name] != level {
+			t.Errorf("level of %q = %v, want %v", name, levels[name], level)
+		}
+	}
+	for _, spec := range []string{"verbose", "peer=", "=debug"} {
+		if _, err := ParseLevels(spec); err == nil {
+			t.Errorf("ParseLevels(%q) accepts an invalid spec", spec)
+		}
+	}
+}
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	defer SetOutput(nopWriter{})
+	defer SetLevel("", LevelInfo)
+
+	l := New("test").With(F(KeyPeer, "/c/1/1/a"))
+	if err := SetLevels("warn,test=info"); err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("dropped")
+	l.Info("connected", F(KeyRemote, "127.0.0.1:1"), F("note", "two words"))
+	New("other").Info("dropped")
+	line := buf.String()
+	if strings.Contains(line, "dropped") {
+		t.Errorf("entries under the level are written: %q", line)
+	}
+	for _, s := range []string{"INFO [test] connected", "peer=/c/1/1/a", "remote=127.0.0.1:1", `note="two words"`} {
+		if !strings.Contains(line, s) {
+			t.Errorf("text entry %q doesn't contain %q", line, s)
+		}
+	}
+
+	buf.Reset()
+	SetJSON(true)
+	defer SetJSON(false)
+	l.Error("failed", Err(errors.New("broken")), F(KeySeq, 7))
+	entry := make(map[string]interface{})
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("json entry %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{"level": "error", "subsystem": "test", "msg": "failed", "peer": "/c/1/1/a", "err": "broken", "seq": 7.0}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("json entry %v = %v, want %v", key, entry[key], value)
+		}
+	}
+	if Levels()["test"] != LevelInfo || Levels()["other"] != LevelWarn {
+		t.Errorf("Levels() = %v", Levels())
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
@@ -4,10 +4,11 @@ import (
 	"bytes"
 	"container/list"
 	"errors"
-	"log"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ws-cluster/logger"
 	"github.com/ws-cluster/wire"
 
 	"github.com/gorilla/websocket"
@@ -25,11 +26,17 @@ const (
 
 	// Maximum message size allowed from peer.
 	defaultMaxMessageSize = 1024
+
+	// ephemeral messages are dropped when there are more pending messages than this
+	ephemeralDropLen = 64
 )
 
 // ErrPeerNotOpen peer has closed, pushmessage failed
 var ErrPeerNotOpen = errors.New("peer not open")
 
+// ErrMessageDropped an ephemeral message is dropped because the peer is busy
+var ErrMessageDropped = errors.New("message dropped")
+
 // MessageListeners 消息监听
 type MessageListeners struct {
 	// OnGetAddr is invoked when a peer receives a getaddr bitcoin message.
@@ -49,6 +56,10 @@ type Config struct {
 	PingPeriod time.Duration
 	// Maximum message size allowed from peer.
 	MaxMessageSize int
+	// Logger defaults to the logger of subsystem peer with the addresses of peer
+	Logger *logger.Logger
+	// TraceContext write trace contexts of headers, the remote peer must understand them
+	TraceContext bool
 
 	Listeners *MessageListeners
 }
@@ -79,10 +90,15 @@ type Peer struct {
 	sendDone   chan struct{}
 	// quit          chan quitMessage
 	connclosed    chan struct{}
+	closed        chan struct{} // closed when the connection is closed by either side
+	closeOnce     sync.Once
 	timeConnected time.Time
 
+	log *logger.Logger
+
 	connected int32 // 0 unconnected 1 connected 2 closing
 	autoSeq   uint32
+	pending   int32 // messages waiting in packetQueueHandler
 }
 
 // NewPeer 创建一个新的节点
@@ -103,7 +119,11 @@ func NewPeer(addr wire.Addr, RemoteAddr string, config *Config) *Peer {
 	if config.PingPeriod >= config.PongWait {
 		config.PingPeriod = (config.PongWait * 9) / 10
 	}
+	if config.Logger == nil {
+		config.Logger = logger.New("peer").With(logger.F(logger.KeyPeer, addr.String()), logger.F(logger.KeyRemote, RemoteAddr))
+	}
 	return &Peer{
+		log:        config.Logger,
 		Addr:       addr,
 		RemoteAddr: RemoteAddr,
 		config:     config,
@@ -112,6 +132,7 @@ func NewPeer(addr wire.Addr, RemoteAddr string, config *Config) *Peer {
 		sendDone:   make(chan struct{}, 1),
 		// quit:       make(chan quitMessage, 1),
 		connclosed: make(chan struct{}, 1),
+		closed:     make(chan struct{}),
 	}
 }
 
@@ -151,7 +172,7 @@ func (p *Peer) inMessageHandler() {
 		if err != nil {
 			// if websocket.IsCloseError(err,websocket.E) {
 			// }
-			log.Println(p.Addr.String(), err)
+			p.log.Info("read failed", logger.Err(err))
 
 			// if websocket.IsUnexpectedCloseError(err, websocket.CloseMessageTooBig) &&
 			// 	p.Addr.Type() == wire.AddrServer {
@@ -160,7 +181,7 @@ func (p *Peer) inMessageHandler() {
 			break
 		}
 		if messageType == websocket.CloseMessage {
-			log.Println("closed:", p.Addr.String())
+			p.log.Info("closed by peer")
 			break
 		}
 		if len(message) == 0 {
@@ -177,11 +198,14 @@ func (p *Peer) inMessageHandler() {
 			if p.Addr.Type() == wire.AddrClient {
 				msg.Header.Source = p.Addr // set source
 			}
+			if p.log.Enabled(logger.LevelDebug) {
+				p.log.Debug("message received", logger.F(logger.KeyCommand, msg.Header.Command), logger.F(logger.KeySeq, msg.Header.Seq),
+					logger.F("dest", msg.Header.Dest.String()))
+			}
 
 			go func() {
-				err = p.config.Listeners.OnMessage(msg)
-				if err != nil {
-					log.Println("peer.go line:162 ", p.Addr.String(), err)
+				if err := p.config.Listeners.OnMessage(msg); err != nil {
+					p.log.Warn("message not handled", logger.F(logger.KeyCommand, msg.Header.Command), logger.F(logger.KeySeq, msg.Header.Seq), logger.Err(err))
 				}
 			}()
 		}
@@ -224,6 +248,9 @@ func (p *Peer) writeMessage(message *wire.Message) error {
 		p.autoSeq++
 		header.Seq = p.autoSeq
 	}
+	if !p.config.TraceContext {
+		message = message.WithoutTrace()
+	}
 
 	p.conn.SetWriteDeadline(time.Now().Add(p.config.WriteWait))
 
@@ -254,6 +281,10 @@ func (p *Peer) packetQueueHandler() {
 	queuePacket := func(msg packet, list *list.List, waiting bool) bool {
 		if !waiting {
 			p.sendQueue <- msg
+		} else if list.Len() >= ephemeralDropLen && isEphemeral(msg) {
+			if msg.done != nil {
+				msg.done <- ErrMessageDropped
+			}
 		} else {
 			list.PushBack(msg)
 		}
@@ -265,6 +296,7 @@ Loop:
 		select {
 		case msg, _ := <-p.outQueue:
 			waiting = queuePacket(msg, pendingMsgs, waiting)
+			atomic.StoreInt32(&p.pending, int32(pendingMsgs.Len()))
 		case <-p.sendDone:
 			next := pendingMsgs.Front()
 			if next == nil {
@@ -275,6 +307,7 @@ Loop:
 			// Notify the handleWirte about the next item to
 			// asynchronously send.
 			val := pendingMsgs.Remove(next)
+			atomic.StoreInt32(&p.pending, int32(pendingMsgs.Len()))
 			p.sendQueue <- val.(packet)
 		case <-p.connclosed: //connection has closed
 			break Loop
@@ -287,10 +320,19 @@ Loop:
 	}
 }
 
+func isEphemeral(msg packet) bool {
+	if msg.use != packetUseForMessage {
+		return false
+	}
+	return wire.IsEphemeral(msg.content.(*wire.Message).Header.Command)
+}
+
 // PushMessage 把消息写到队列中，等待处理。如果连接已经关系，消息会被丢掉
 func (p *Peer) PushMessage(message *wire.Message, doneChan chan error) {
 	if !p.IsConnected() {
-		doneChan <- ErrPeerNotOpen
+		if doneChan != nil {
+			doneChan <- ErrPeerNotOpen
+		}
 		return
 	}
 
@@ -317,8 +359,10 @@ func (p *Peer) closeConnect() {
 	if !atomic.CompareAndSwapInt32(&p.connected, 2, 0) {
 		return
 	}
+	p.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(p.config.WriteWait))
 	p.conn.Close()
 	p.connclosed <- struct{}{}
+	p.closeOnce.Do(func() { close(p.closed) })
 }
 
 // connection has been closed by other side
@@ -330,8 +374,24 @@ func (p *Peer) connectionClosed() {
 
 	err := p.config.Listeners.OnDisconnect()
 	if err != nil {
-		log.Println(err)
+		p.log.Warn("disconnect not handled", logger.Err(err))
 	}
+	p.closeOnce.Do(func() { close(p.closed) })
+}
+
+// Done closed when the connection is closed, by Close or by the other side
+func (p *Peer) Done() <-chan struct{} {
+	return p.closed
+}
+
+// QueueLen count of messages waiting to be written
+func (p *Peer) QueueLen() int {
+	return int(atomic.LoadInt32(&p.pending))
+}
+
+// Logger logger of the peer, entries have the addresses of peer
+func (p *Peer) Logger() *logger.Logger {
+	return p.log
 }
 
 // IsConnected 判断连接是否正常
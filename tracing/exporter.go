@@ -0,0 +1,249 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	scopeName       = "github.com/ws-cluster"
+	exportQueueSize = 4096
+	exportBatchSize = 512
+	flushInterval   = time.Second
+)
+
+// FileExporter append spans to a file as OTLP json lines, each line is an ExportTraceServiceRequest,
+// which can be read by the otlpjsonfile receiver of OpenTelemetry collector.
+// Spans are written in background, they are dropped if the queue is full.
+type FileExporter struct {
+	file     *os.File
+	resource []otlpKeyValue
+	spans    chan *SpanData
+	dropped  uint64
+
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// NewFileExporter open or create the file, resource attributes describe this server, eg: service.name
+func NewFileExporter(path string, resource ...Attribute) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	e := &FileExporter{
+		file:     file,
+		resource: otlpAttributes(resource),
+		spans:    make(chan *SpanData, exportQueueSize),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.loop()
+	return e, nil
+}
+
+// Export queue a span
+func (e *FileExporter) Export(span *SpanData) {
+	select {
+	case e.spans <- span:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// Dropped count of spans dropped because the queue is full
+func (e *FileExporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Close write queued spans and close the file
+func (e *FileExporter) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.quit)
+		<-e.done
+		if err := e.file.Close(); err != nil && e.err == nil {
+			e.err = err
+		}
+	})
+	return e.err
+}
+
+func (e *FileExporter) loop() {
+	defer close(e.done)
+	w := bufio.NewWriter(e.file)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*SpanData, 0, exportBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.write(w, batch); err != nil && e.err == nil {
+			e.err = err
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= exportBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.quit:
+			for n := len(e.spans); n > 0; n-- {
+				batch = append(batch, <-e.spans)
+				if len(batch) >= exportBatchSize {
+					flush()
+				}
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func (e *FileExporter) write(w *bufio.Writer, batch []*SpanData) error {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Name:              s.Name,
+			Kind:              int(s.Kind),
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		if s.Err != "" {
+			span.Status = otlpStatus{Code: statusError, Message: s.Err}
+		}
+		spans = append(spans, span)
+	}
+	req := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: e.resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: spans}},
+	}}}
+	if err := json.NewEncoder(w).Encode(&req); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// OTLP json, see opentelemetry-proto/opentelemetry/proto/collector/trace/v1
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+// status code of OTLP
+const statusError = 2
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue one of the values is set, 64 bit integers are strings in OTLP json
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, attr := range attrs {
+		kvs = append(kvs, otlpKeyValue{Key: attr.Key, Value: otlpValue(attr.Value)})
+	}
+	return kvs
+}
+
+func otlpValue(v interface{}) otlpAnyValue {
+	var i int64
+	switch v := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	case float32:
+		f := float64(v)
+		return otlpAnyValue{DoubleValue: &f}
+	case int:
+		i = int64(v)
+	case int8:
+		i = int64(v)
+	case int16:
+		i = int64(v)
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case uint8:
+		i = int64(v)
+	case uint16:
+		i = int64(v)
+	case uint32:
+		i = int64(v)
+	case uint64:
+		i = int64(v)
+	case fmt.Stringer:
+		s := v.String()
+		return otlpAnyValue{StringValue: &s}
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+	s := strconv.FormatInt(i, 10)
+	return otlpAnyValue{IntValue: &s}
+}
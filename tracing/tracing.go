@@ -0,0 +1,222 @@
+// Package tracing spans of a message passing through servers, compatible with OpenTelemetry.
+// Trace and span ids follow W3C trace context, and spans are exported in OTLP json.
+package tracing
+
+import (
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// TraceID id of a trace, all spans of a message have the same one
+type TraceID [16]byte
+
+// SpanID id of a span
+type SpanID [8]byte
+
+// FlagSampled the trace is sampled, W3C trace-flags
+const FlagSampled = byte(1)
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid an all zero id is invalid
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsValid an all zero id is invalid
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+// SpanContext identifies a span, it is propagated to the children of the span
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// IsValid both ids are valid
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// IsSampled spans of the trace are recorded
+func (sc SpanContext) IsSampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// Kind span kind of OTLP
+type Kind int
+
+const (
+	// KindInternal an operation inside a server
+	KindInternal Kind = 1
+	// KindServer handling a message received from a remote server
+	KindServer Kind = 2
+	// KindClient sending a message to a remote server
+	KindClient Kind = 3
+	// KindProducer a message is queued for an asynchronous consumer
+	KindProducer Kind = 4
+	// KindConsumer an asynchronous consumer of a queued message
+	KindConsumer Kind = 5
+)
+
+// Attribute a key and value of a span, value is a string, bool, integer or float
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr make an attribute
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData a finished span
+type SpanData struct {
+	Context    SpanContext
+	Parent     SpanID // invalid for a root span
+	Name       string
+	Kind       Kind
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Err        string // empty means ok
+}
+
+// Exporter receives finished spans, Export must not block
+type Exporter interface {
+	Export(span *SpanData)
+	Close() error
+}
+
+// Config of a Tracer
+type Config struct {
+	// SampleRate ratio of root spans which are sampled, 0-1
+	SampleRate float64
+	Exporter   Exporter
+}
+
+// Tracer start spans, a nil Tracer starts nothing and all methods of a nil Span are no-op,
+// so that tracing can be disabled without checking it everywhere
+type Tracer struct {
+	sampleRate float64
+	exporter   Exporter
+
+	mu   sync.Mutex // guards rand
+	rand *rand.Rand
+}
+
+// NewTracer new a Tracer
+func NewTracer(config *Config) *Tracer {
+	return &Tracer{
+		sampleRate: config.SampleRate,
+		exporter:   config.Exporter,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Start start a span of a new trace, it is nil if the trace isn't sampled
+func (t *Tracer) Start(name string, kind Kind, attrs ...Attribute) *Span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	sampled := t.sampleRate > 0 && t.rand.Float64() < t.sampleRate
+	var sc SpanContext
+	if sampled {
+		t.rand.Read(sc.TraceID[:])
+		t.rand.Read(sc.SpanID[:])
+	}
+	t.mu.Unlock()
+	if !sampled {
+		return nil
+	}
+	sc.Flags = FlagSampled
+	return t.newSpan(sc, SpanID{}, name, kind, attrs)
+}
+
+// StartChild start a child span of parent, it is nil if parent is invalid or not sampled
+func (t *Tracer) StartChild(parent SpanContext, name string, kind Kind, attrs ...Attribute) *Span {
+	if t == nil || !parent.IsValid() || !parent.IsSampled() {
+		return nil
+	}
+	sc := SpanContext{TraceID: parent.TraceID, Flags: parent.Flags}
+	t.mu.Lock()
+	t.rand.Read(sc.SpanID[:])
+	t.mu.Unlock()
+	return t.newSpan(sc, parent.SpanID, name, kind, attrs)
+}
+
+func (t *Tracer) newSpan(sc SpanContext, parent SpanID, name string, kind Kind, attrs []Attribute) *Span {
+	return &Span{
+		tracer: t,
+		data: SpanData{
+			Context:    sc,
+			Parent:     parent,
+			Name:       name,
+			Kind:       kind,
+			Start:      time.Now(),
+			Attributes: attrs,
+		},
+	}
+}
+
+// Close close the exporter, spans ended after it are dropped
+func (t *Tracer) Close() error {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	return t.exporter.Close()
+}
+
+// Span an operation of a trace, it is used by one goroutine
+type Span struct {
+	tracer *Tracer
+	data   SpanData
+	ended  bool
+}
+
+// Context context of the span, it is invalid for a nil span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.data.Context
+}
+
+// SetAttr add attributes
+func (s *Span) SetAttr(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// SetError mark the span failed, a nil err is ignored
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.data.Err = err.Error()
+}
+
+// End finish the span and export it, only the first call takes effect
+func (s *Span) End() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	if s.tracer.exporter != nil {
+		s.tracer.exporter.Export(&s.data)
+	}
+}
@@ -0,0 +1,117 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memExporter struct {
+	spans []*SpanData
+}
+
+func (e *memExporter) Export(span *SpanData) { e.spans = append(e.spans, span) }
+func (e *memExporter) Close() error          { return nil }
+
+func TestTracer(t *testing.T) {
+	var disabled *Tracer
+	span := disabled.Start("root", KindInternal)
+	span.SetAttr(Attr("k", 1))
+	span.End()
+	if span != nil || span.Context().IsValid() {
+		t.Fatal("a nil tracer starts spans")
+	}
+
+	if NewTracer(&Config{SampleRate: 0}).Start("root", KindInternal) != nil {
+		t.Error("rate 0 samples a trace")
+	}
+
+	exporter := &memExporter{}
+	tracer := NewTracer(&Config{SampleRate: 1, Exporter: exporter})
+	root := tracer.Start("root", KindInternal)
+	if !root.Context().IsValid() || !root.Context().IsSampled() {
+		t.Fatalf("root context %+v", root.Context())
+	}
+	child := tracer.StartChild(root.Context(), "child", KindServer, Attr("seq", 7))
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End()
+	root.End()
+	if tracer.StartChild(SpanContext{}, "orphan", KindInternal) != nil {
+		t.Error("a child of an invalid context is started")
+	}
+	unsampled := root.Context()
+	unsampled.Flags = 0
+	if tracer.StartChild(unsampled, "unsampled", KindInternal) != nil {
+		t.Error("a child of an unsampled context is started")
+	}
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %v spans, want 2", len(exporter.spans))
+	}
+	c, r := exporter.spans[0], exporter.spans[1]
+	if c.Context.TraceID != r.Context.TraceID || c.Parent != r.Context.SpanID || r.Parent.IsValid() {
+		t.Errorf("child %+v isn't in the trace of root %+v", c.Context, r.Context)
+	}
+	if c.Err != "failed" || c.End.Before(c.Start) {
+		t.Errorf("child %+v", c)
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.jsonl")
+	exporter, err := NewFileExporter(path, Attr("service.name", "wscluster"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(&Config{SampleRate: 1, Exporter: exporter})
+	root := tracer.Start("root", KindInternal, Attr("command", uint8(3)), Attr("ok", true))
+	child := tracer.StartChild(root.Context(), "child", KindServer)
+	child.SetError(errors.New("failed"))
+	child.End()
+	root.End()
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	spans := make([]otlpSpan, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var req otlpRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		rs := req.ResourceSpans[0]
+		if kv := rs.Resource.Attributes[0]; kv.Key != "service.name" || *kv.Value.StringValue != "wscluster" {
+			t.Errorf("resource %+v", rs.Resource)
+		}
+		spans = append(spans, rs.ScopeSpans[0].Spans...)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("read %v spans, want 2", len(spans))
+	}
+	c, r := spans[0], spans[1]
+	if c.TraceID != root.Context().TraceID.String() || c.ParentSpanID != r.SpanID || r.ParentSpanID != "" {
+		t.Errorf("child %+v, root %+v", c, r)
+	}
+	if c.Kind != int(KindServer) || c.Status.Code != statusError || c.Status.Message != "failed" {
+		t.Errorf("child %+v", c)
+	}
+	if len(r.Attributes) != 2 || *r.Attributes[0].Value.IntValue != "3" || !*r.Attributes[1].Value.BoolValue {
+		t.Errorf("root attributes %+v", r.Attributes)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"strconv"
 	"strings"
 )
@@ -67,20 +66,47 @@ var (
 	DevicePc = byte(3) // pc
 )
 
+const (
+	// MaxAddressLen max length of the address detail
+	MaxAddressLen = 64
+
+	// legacyAddrSize size of an encoded address in the fixed format
+	legacyAddrSize = 32
+	// legacyAddressLen max length of the address detail in the fixed format
+	legacyAddressLen = 26
+	// addrLongFlag the length bits of an address in the long format
+	addrLongFlag = byte(0x1F)
+	// addrLenIndex where the length of a long address is kept in memory
+	addrLenIndex = 6 + MaxAddressLen
+)
+
 // Addr Address
+//
+// An address whose detail is at most 26 bytes is encoded in the fixed format:
 // /  3 bit     / 5 bit   / 4 byte  / 1byte / 26 byte /
 // / message type/ length   / domain / device /address /
-type Addr [32]byte
+//
+// A longer address is encoded in the long format, without padding:
+// /  3 bit     / 5 bit 0x1F / 1 byte / 4 byte  / 1byte / length byte /
+// / message type/ long flag  / length / domain / device /address     /
+//
+// In memory an Addr is always a fixed size array, so it can be used as a map key.
+type Addr [addrLenIndex + 1]byte
 
 // NewAddr new an Addr object
 func NewAddr(Typ byte, domain uint32, device byte, address string) (*Addr, error) {
 	addr := new(Addr)
 	addrBytes := []byte(address)
 	addrlen := len(addrBytes)
-	if addrlen > 26 {
+	if addrlen > MaxAddressLen {
 		return nil, ErrAddrOverflow
 	}
-	addr[0] = byte(Typ<<5) | byte(addrlen)
+	if addrlen > legacyAddressLen {
+		addr[0] = byte(Typ<<5) | addrLongFlag
+		addr[addrLenIndex] = byte(addrlen)
+	} else {
+		addr[0] = byte(Typ<<5) | byte(addrlen)
+	}
 	bs := make([]byte, 4)
 	littleEndian.PutUint32(bs, domain)
 	copy(addr[1:5], bs)
@@ -150,18 +176,50 @@ func ParseServerAddr(addr string) (*Addr, error) {
 	return NewAddr(AddrServer, uint32(domain), byte(device), addrs[4])
 }
 
-// Decode Decode reader to Header
+// Decode Decode reader to Addr, both of the fixed and the long format are accepted
 func (addr *Addr) Decode(r io.Reader) error {
-	_, err := r.Read(addr[0:])
+	*addr = Addr{}
+	if _, err := io.ReadFull(r, addr[0:1]); err != nil {
+		return err
+	}
+	if !addr.isLong() {
+		if _, err := io.ReadFull(r, addr[1:legacyAddrSize]); err != nil {
+			return err
+		}
+		if addr.Len() > legacyAddressLen {
+			return ErrInvaildAddress
+		}
+		return nil
+	}
+	if _, err := io.ReadFull(r, addr[addrLenIndex:]); err != nil {
+		return err
+	}
+	addrlen := int(addr[addrLenIndex])
+	if addrlen <= legacyAddressLen || addrlen > MaxAddressLen {
+		return ErrInvaildAddress
+	}
+	_, err := io.ReadFull(r, addr[1:6+addrlen])
 	return err
 }
 
-// Encode Encode Header to writer
+// Encode Encode Addr to writer
 func (addr *Addr) Encode(w io.Writer) error {
-	_, err := w.Write(addr[0:])
+	if !addr.isLong() {
+		_, err := w.Write(addr[0:legacyAddrSize])
+		return err
+	}
+	buf := make([]byte, 0, 7+MaxAddressLen)
+	buf = append(buf, addr[0], addr[addrLenIndex])
+	buf = append(buf, addr[1:6+addr.Len()]...)
+	_, err := w.Write(buf)
 	return err
 }
 
+// isLong the address is encoded in the long format
+func (addr *Addr) isLong() bool {
+	return addr[0]&addrLongFlag == addrLongFlag
+}
+
 // Type address type,return AddrSingle ,AddrGroup ,AddrBroadcast
 func (addr *Addr) Type() byte {
 	return addr[0] >> 5
@@ -169,7 +227,10 @@ func (addr *Addr) Type() byte {
 
 // Len address length
 func (addr *Addr) Len() byte {
-	return addr[0] & ^byte(3<<5)
+	if addr.isLong() {
+		return addr[addrLenIndex]
+	}
+	return addr[0] & addrLongFlag
 }
 
 // Domain domain is the scope of client
@@ -195,6 +256,19 @@ func (addr *Addr) String() string {
 	return fmt.Sprintf("/%c/%v/%v/%v", AddrMap[addr.Type()], addr.Domain(), addr.Device(), addr.Address())
 }
 
+// MarshalText the full address, empty for an empty address
+func (addr *Addr) MarshalText() ([]byte, error) {
+	if addr.IsEmpty() {
+		return []byte{}, nil
+	}
+	return []byte(addr.String()), nil
+}
+
+// IsLegacy the address can be encoded in the fixed format, which is understood by every protocol version
+func (addr *Addr) IsLegacy() bool {
+	return !addr.isLong()
+}
+
 // IsEmpty address is empty
 func (addr *Addr) IsEmpty() bool {
 	return addr[0] == 0
@@ -331,7 +405,6 @@ func WriteAscllString(w io.Writer, str string, capacity int) error {
 		}
 		buf[i] = byte(ch)
 	}
-	log.Print(buf)
 	_, err := w.Write(buf)
 	return err
 }
@@ -343,7 +416,6 @@ func ReadAscllString(r io.Reader, str string, capacity int) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	log.Print(buf)
 	i := 0
 	for ; i < len(buf); i++ {
 		if buf[i] == 0 {
@@ -6,9 +6,11 @@ package wire
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -64,31 +66,85 @@ func TestWriteAscllString(t *testing.T) {
 }
 
 func TestNewAddr(t *testing.T) {
-	// type args struct {
-	// 	Typ     byte
-	// 	domain  uint32
-	// 	address string
-	// }
-	// tests := []struct {
-	// 	name    string
-	// 	args    args
-	// 	want    *Addr
-	// 	wantErr bool
-	// }{
-	// 	// TODO: Add test cases.
+	type args struct {
+		Typ     byte
+		domain  uint32
+		device  byte
+		address string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		size    int // encoded size
+		wantErr bool
+	}{
+		{"short", args{AddrClient, 1, DevicePhone, "client_1"}, 32, false},
+		{"fixed max", args{AddrClient, 1, DevicePhone, strings.Repeat("a", 26)}, 32, false},
+		{"uuid", args{AddrClient, 1, DevicePhone, "usr_0f8fad5b-d9cb-469f-a165-70867728950e"}, 7 + 40, false},
+		{"long max", args{AddrGroup, 3, DeviceNone, strings.Repeat("g", MaxAddressLen)}, 7 + MaxAddressLen, false},
+		{"overflow", args{AddrClient, 1, DevicePhone, strings.Repeat("a", MaxAddressLen+1)}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewAddr(tt.args.Typ, tt.args.domain, tt.args.device, tt.args.address)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewAddr() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			if got.Type() != tt.args.Typ || got.Domain() != tt.args.domain || got.Device() != tt.args.device || got.Address() != tt.args.address {
+				t.Errorf("NewAddr() = %v", got.String())
+			}
+			buf := &bytes.Buffer{}
+			if err := got.Encode(buf); err != nil {
+				t.Fatal(err)
+			}
+			if buf.Len() != tt.size {
+				t.Errorf("Addr.Encode() size = %v, want %v", buf.Len(), tt.size)
+			}
+			decoded := new(Addr)
+			if err := decoded.Decode(buf); err != nil {
+				t.Fatal(err)
+			}
+			if *decoded != *got {
+				t.Errorf("Addr.Decode() = %v, want %v", decoded.String(), got.String())
+			}
+		})
+	}
+}
 
-	// }
-	// for _, tt := range tests {
-	// 	t.Run(tt.name, func(t *testing.T) {
-	// 		got, err := NewAddr(tt.args.Typ, tt.args.domain, tt.args.address)
-	// 		if (err != nil) != tt.wantErr {
-	// 			t.Errorf("NewAddr() error = %v, wantErr %v", err, tt.wantErr)
-	// 			return
-	// 		}
-	// 		if !reflect.DeepEqual(got, tt.want) {
-	// 			t.Errorf("NewAddr() = %v, want %v", got, tt.want)
-	// 		}
-	// 	})
-	// }
+func TestAddr_DecodeFixed(t *testing.T) {
+	// an address encoded by an old version
+	fixed := make([]byte, 32)
+	fixed[0] = AddrClient<<5 | 3
+	littleEndian.PutUint32(fixed[1:5], 7)
+	fixed[5] = DevicePc
+	copy(fixed[6:], "abc")
 
+	addr := new(Addr)
+	if err := addr.Decode(bytes.NewReader(fixed)); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := NewAddr(AddrClient, 7, DevicePc, "abc")
+	if *addr != *want {
+		t.Errorf("Addr.Decode() = %v, want %v", addr.String(), want.String())
+	}
+
+	fixed[0] = AddrClient<<5 | 27 // length out of range
+	if err := addr.Decode(bytes.NewReader(fixed)); err != ErrInvaildAddress {
+		t.Errorf("Addr.Decode() error = %v, want %v", err, ErrInvaildAddress)
+	}
+}
+
+func TestAddr_MarshalText(t *testing.T) {
+	addr, _ := NewGroupAddr(1, "room")
+	b, err := json.Marshal(&struct{ Addr, Empty Addr }{Addr: *addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"Addr":"/g/1/0/room","Empty":""}`; string(b) != want {
+		t.Errorf("json = %s, want %s", b, want)
+	}
 }
@@ -26,9 +26,46 @@ const (
 	MsgTypeQueryClient = uint8(15)
 	// MsgTypeQueryServers query servers
 	MsgTypeQueryServers = uint8(17)
+	// MsgTypeBinary 二进制消息
+	MsgTypeBinary = uint8(19)
+	// MsgTypeFileBegin begin a file transfer
+	MsgTypeFileBegin = uint8(21)
+	// MsgTypeFileChunk a chunk of file
+	MsgTypeFileChunk = uint8(23)
+	// MsgTypeFileEnd end a file transfer
+	MsgTypeFileEnd = uint8(25)
+	// MsgTypeSignal ephemeral signal, such as typing
+	MsgTypeSignal = uint8(27)
+	// MsgTypeRecall recall a chat message
+	MsgTypeRecall = uint8(29)
+	// MsgTypeEdit edit a chat message
+	MsgTypeEdit = uint8(31)
+	// MsgTypeChatAck tell the sender the id of a chat message
+	MsgTypeChatAck = uint8(33)
+	// MsgTypeHistory query history messages
+	MsgTypeHistory = uint8(35)
+	// MsgTypeHistoryResp history messages
+	MsgTypeHistoryResp = uint8(36)
+	// MsgTypeConversations query conversations with unread counts
+	MsgTypeConversations = uint8(37)
+	// MsgTypeConversationsResp conversations
+	MsgTypeConversationsResp = uint8(38)
+	// MsgTypeMarkRead mark a conversation read, synced to other devices of the client
+	MsgTypeMarkRead = uint8(39)
+	// MsgTypeDrain the server is draining, reconnect to another server
+	MsgTypeDrain = uint8(41)
+	// MsgTypeTap tap messages on another server
+	MsgTypeTap = uint8(43)
+	// MsgTypeTapEvent a message matching a tap
+	MsgTypeTapEvent = uint8(45)
 
 	// MsgTypeEmpty MsgTypeEmpty
 	MsgTypeEmpty = uint8(200)
+
+	// CommandTraceContext written in place of the command if the header carries a trace context,
+	// it is followed by the context and the real command.
+	// It is only sent to servers which report FeatureTraceContext.
+	CommandTraceContext = uint8(250)
 )
 
 // const (
@@ -46,14 +83,46 @@ type Protocol interface {
 	Encode(io.Writer) error
 }
 
+// TraceContext W3C trace context of the span which sent the message
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   uint8
+}
+
+// Decode Decode
+func (t *TraceContext) Decode(r io.Reader) error {
+	if _, err := io.ReadFull(r, t.TraceID[:]); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(r, t.SpanID[:]); err != nil {
+		return err
+	}
+	var err error
+	t.Flags, err = ReadUint8(r)
+	return err
+}
+
+// Encode Encode
+func (t *TraceContext) Encode(w io.Writer) error {
+	if _, err := w.Write(t.TraceID[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(t.SpanID[:]); err != nil {
+		return err
+	}
+	return WriteUint8(w, t.Flags)
+}
+
 // Header is Message Header
 type Header struct {
-	Source  Addr   //source address
-	Dest    Addr   //destination address
-	Seq     uint32 //消息序列号，peer唯一
-	AckSeq  uint32 //应答消息序列号
-	Command uint8  //命令类型
-	Status  uint8  // respose status
+	Source  Addr          //source address
+	Dest    Addr          //destination address
+	Seq     uint32        //消息序列号，peer唯一
+	AckSeq  uint32        //应答消息序列号
+	Command uint8         //命令类型
+	Status  uint8         // respose status
+	Trace   *TraceContext // optional, only between servers
 }
 
 // Decode Decode reader to Header
@@ -74,6 +143,15 @@ func (h *Header) Decode(r io.Reader) error {
 	if h.Command, err = ReadUint8(r); err != nil {
 		return err
 	}
+	if h.Command == CommandTraceContext {
+		h.Trace = new(TraceContext)
+		if err = h.Trace.Decode(r); err != nil {
+			return err
+		}
+		if h.Command, err = ReadUint8(r); err != nil {
+			return err
+		}
+	}
 	if h.Status, err = ReadUint8(r); err != nil {
 		return err
 	}
@@ -95,6 +173,14 @@ func (h *Header) Encode(w io.Writer) error {
 	if err = WriteUint32(w, h.AckSeq); err != nil {
 		return err
 	}
+	if h.Trace != nil {
+		if err = WriteUint8(w, CommandTraceContext); err != nil {
+			return err
+		}
+		if err = h.Trace.Encode(w); err != nil {
+			return err
+		}
+	}
 	if err = WriteUint8(w, h.Command); err != nil {
 		return err
 	}
@@ -131,6 +217,28 @@ func (m *Message) Decode(r io.Reader) error {
 	return nil
 }
 
+// WithoutTrace the message itself if its header has no trace context, otherwise a copy without it
+func (m *Message) WithoutTrace() *Message {
+	if m.Header.Trace == nil {
+		return m
+	}
+	header := *m.Header
+	header.Trace = nil
+	return &Message{Header: &header, Body: m.Body}
+}
+
+// IsLegacy all addresses of the message, in the header and the body, can be encoded in the fixed format,
+// so a client below ProtocolVersion2 can decode it
+func (m *Message) IsLegacy() bool {
+	if !m.Header.Source.IsLegacy() || !m.Header.Dest.IsLegacy() {
+		return false
+	}
+	if body, ok := m.Body.(interface{ IsLegacy() bool }); ok {
+		return body.IsLegacy()
+	}
+	return true
+}
+
 // Encode Encode Header to Message
 func (m *Message) Encode(w io.Writer) error {
 	if err := m.Header.Encode(w); err != nil {
@@ -166,6 +274,38 @@ func MakeEmptyBody(Command uint8) (Protocol, error) {
 		body = &MsgQueryClient{}
 	case MsgTypeQueryServers:
 		body = &MsgQueryServers{}
+	case MsgTypeBinary:
+		body = &MsgBinary{}
+	case MsgTypeFileBegin:
+		body = &MsgFileBegin{}
+	case MsgTypeFileChunk:
+		body = &MsgFileChunk{}
+	case MsgTypeFileEnd:
+		body = &MsgFileEnd{}
+	case MsgTypeSignal:
+		body = &MsgSignal{}
+	case MsgTypeRecall:
+		body = &MsgRecall{}
+	case MsgTypeEdit:
+		body = &MsgEdit{}
+	case MsgTypeChatAck:
+		body = &MsgChatAck{}
+	case MsgTypeHistory:
+		body = &MsgHistory{}
+	case MsgTypeHistoryResp:
+		body = &MsgHistoryResp{}
+	case MsgTypeConversations:
+		body = &MsgConversations{}
+	case MsgTypeConversationsResp:
+		body = &MsgConversationsResp{}
+	case MsgTypeMarkRead:
+		body = &MsgMarkRead{}
+	case MsgTypeDrain:
+		body = &MsgDrain{}
+	case MsgTypeTap:
+		body = &MsgTap{}
+	case MsgTypeTapEvent:
+		body = &MsgTapEvent{}
 	case MsgTypeEmpty:
 		body = &MsgEmpty{}
 	default:
@@ -174,6 +314,12 @@ func MakeEmptyBody(Command uint8) (Protocol, error) {
 	return body, nil
 }
 
+// IsEphemeral ephemeral messages are never persisted, acknowledged or queued for offline delivery,
+// and they are dropped first under back-pressure
+func IsEphemeral(Command uint8) bool {
+	return Command == MsgTypeSignal
+}
+
 // MakeEmptyHeaderMessage Make a Message which header is empty
 func MakeEmptyHeaderMessage(Command uint8, body Protocol) *Message {
 	return &Message{
@@ -1,7 +1,9 @@
 package wire
 
 import (
+	"bytes"
 	"io"
+	"reflect"
 	"testing"
 )
 
@@ -39,3 +41,112 @@ func TestHeader_Decode(t *testing.T) {
 		})
 	}
 }
+
+func TestMessage_Decode(t *testing.T) {
+	source, _ := NewAddr(AddrClient, 1, DevicePhone, "sender")
+	dest, _ := NewGroupAddr(1, "receivers")
+	tests := []struct {
+		name    string
+		command uint8
+		body    Protocol
+	}{
+		{"binary", MsgTypeBinary, &MsgBinary{Type: 2, Body: []byte{0, 1, 2, 255}, Extra: "{}"}},
+		{"file begin", MsgTypeFileBegin, &MsgFileBegin{TransferID: 7, Name: "a.png", Mime: "image/png", Size: 1 << 20}},
+		{"file chunk", MsgTypeFileChunk, &MsgFileChunk{TransferID: 7, Index: 3, Data: []byte("chunk")}},
+		{"file end", MsgTypeFileEnd, &MsgFileEnd{TransferID: 7, Chunks: 4, Checksum: 0xcbf43926}},
+		{"signal", MsgTypeSignal, &MsgSignal{Kind: SignalTyping, State: SignalStart}},
+		{"chat", MsgTypeChat, &Msgchat{Type: 1, Text: "hello", MsgID: 1 << 40}},
+		{"chat ack", MsgTypeChatAck, &MsgChatAck{MsgID: 1 << 40}},
+		{"recall", MsgTypeRecall, &MsgRecall{MsgID: 1 << 40}},
+		{"edit", MsgTypeEdit, &MsgEdit{MsgID: 1 << 40, Text: "hello!"}},
+		{"history", MsgTypeHistory, &MsgHistory{Peer: *dest, BeforeID: 100, AfterTime: 1 << 40, Limit: 20}},
+		{"history resp", MsgTypeHistoryResp, &MsgHistoryResp{More: true, Messages: []HistoryMsg{
+			{ID: 99, MsgID: 1 << 40, Source: *source, Dest: *dest, Type: 1, Text: "hello", CreateAt: 1 << 40, EditAt: 1<<40 + 1},
+			{ID: 98, Source: *source, Dest: *dest, Recalled: true},
+		}}},
+		{"conversations", MsgTypeConversations, &MsgConversations{BeforeTime: 1 << 40, Limit: 20}},
+		{"conversations resp", MsgTypeConversationsResp, &MsgConversationsResp{More: true, Conversations: []Conversation{
+			{Peer: *dest, Last: HistoryMsg{MsgID: 1 << 40, Source: *source, Dest: *dest, Text: "hello"}, Unread: 3, ReadMsgID: 1 << 39},
+			{Peer: *source},
+		}}},
+		{"mark read", MsgTypeMarkRead, &MsgMarkRead{Peer: *dest}},
+		{"drain", MsgTypeDrain, &MsgDrain{URLs: []string{"ws://10.0.0.2:8380", "ws://10.0.0.3:8380"}, Deadline: 1 << 40}},
+		{"tap", MsgTypeTap, &MsgTap{ID: 1 << 40, Source: *source, Domain: 1, Commands: []uint8{MsgTypeChat, MsgTypeSignal}, Rate: 50}},
+		{"tap stop", MsgTypeTap, &MsgTap{ID: 1 << 40, Stop: true, Commands: []uint8{}}},
+		{"tap event", MsgTypeTapEvent, &MsgTapEvent{ID: 1 << 40, Event: `{"Command":3}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := MakeEmptyHeaderMessage(tt.command, tt.body)
+			m.Header.Source = *source
+			m.Header.Dest = *dest
+			buf := &bytes.Buffer{}
+			if err := m.Encode(buf); err != nil {
+				t.Fatal(err)
+			}
+			got := new(Message)
+			if err := got.Decode(buf); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Errorf("Message.Decode() = %v, want %v", got.Body, m.Body)
+			}
+		})
+	}
+}
+
+func TestHeader_Trace(t *testing.T) {
+	source, _ := NewAddr(AddrClient, 1, DevicePhone, "sender")
+	dest, _ := NewGroupAddr(1, "receivers")
+	m := MakeEmptyHeaderMessage(MsgTypeChat, &Msgchat{Type: 1, Text: "hello"})
+	m.Header.Source = *source
+	m.Header.Dest = *dest
+	plain := &bytes.Buffer{}
+	m.Encode(plain)
+
+	m.Header.Trace = &TraceContext{TraceID: [16]byte{1, 2, 3}, SpanID: [8]byte{4, 5}, Flags: 1}
+	buf := &bytes.Buffer{}
+	if err := m.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := new(Message)
+	if err := got.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("Message.Decode() = %v, want %v", got.Header, m.Header)
+	}
+
+	stripped := &bytes.Buffer{}
+	m.WithoutTrace().Encode(stripped)
+	if !bytes.Equal(stripped.Bytes(), plain.Bytes()) || m.Header.Trace == nil {
+		t.Errorf("WithoutTrace() encoded %v, want %v", stripped.Bytes(), plain.Bytes())
+	}
+}
+
+func TestMsgchat_DecodeLegacy(t *testing.T) {
+	// a chat message of an old client, without MsgID
+	buf := &bytes.Buffer{}
+	WriteUint8(buf, 1)
+	WriteString(buf, "hello")
+	WriteString(buf, "")
+
+	m := new(Msgchat)
+	if err := m.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if m.Text != "hello" || m.MsgID != 0 {
+		t.Errorf("Msgchat.Decode() = %v", m)
+	}
+}
+
+func TestMsgTap_EncodeTooManyCommands(t *testing.T) {
+	m := &MsgTap{Commands: make([]uint8, 256)}
+	if err := m.Encode(&bytes.Buffer{}); err != ErrTooManyCommands {
+		t.Errorf("MsgTap.Encode() = %v, want %v", err, ErrTooManyCommands)
+	}
+	m.Commands = m.Commands[:255]
+	if err := m.Encode(&bytes.Buffer{}); err != nil {
+		t.Errorf("MsgTap.Encode() = %v", err)
+	}
+}
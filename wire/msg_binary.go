@@ -0,0 +1,42 @@
+package wire
+
+import (
+	"io"
+)
+
+// MsgBinary 二进制消息，Body 不做任何编码，例如一张图片
+type MsgBinary struct {
+	Type  uint8 // 2: image 3: voice ...
+	Body  []byte
+	Extra string
+}
+
+// Decode Decode
+func (m *MsgBinary) Decode(r io.Reader) error {
+	var err error
+	if m.Type, err = ReadUint8(r); err != nil {
+		return err
+	}
+	if m.Body, err = ReadBytes(r); err != nil {
+		return err
+	}
+	if m.Extra, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgBinary) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint8(w, m.Type); err != nil {
+		return err
+	}
+	if err = WriteBytes(w, m.Body); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Extra); err != nil {
+		return err
+	}
+	return nil
+}
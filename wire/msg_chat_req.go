@@ -9,6 +9,10 @@ type Msgchat struct {
 	Type  uint8 // 1: text 2: image
 	Text  string
 	Extra string
+	// MsgID assigned by the server the sender logined in, used to recall or edit the message.
+	// It is always encoded, as the last field so clients below ProtocolVersion3 ignore it,
+	// and it may be missing in a message of such a client. An id sent by a client is replaced.
+	MsgID uint64
 }
 
 // Decode Decode
@@ -23,6 +27,10 @@ func (m *Msgchat) Decode(r io.Reader) error {
 	if m.Extra, err = ReadString(r); err != nil {
 		return err
 	}
+	// message of an old client ends without MsgID
+	if m.MsgID, err = ReadUint64(r); err != nil && err != io.EOF {
+		return err
+	}
 	return nil
 }
 
@@ -38,5 +46,8 @@ func (m *Msgchat) Encode(w io.Writer) error {
 	if err = WriteString(w, m.Extra); err != nil {
 		return err
 	}
+	if err = WriteUint64(w, m.MsgID); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,146 @@
+package wire
+
+import "io"
+
+// MsgConversations 查询会话列表，按最后一条消息的时间从新到旧
+// BeforeTime is unix milliseconds of the cursor, 0 means the latest.
+type MsgConversations struct {
+	BeforeTime uint64
+	Limit      uint16
+}
+
+// Decode Decode
+func (m *MsgConversations) Decode(r io.Reader) error {
+	var err error
+	if m.BeforeTime, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Limit, err = ReadUint16(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgConversations) Encode(w io.Writer) error {
+	if err := WriteUint64(w, m.BeforeTime); err != nil {
+		return err
+	}
+	return WriteUint16(w, m.Limit)
+}
+
+// Conversation a conversation with a client or group, Last is the last message in it
+type Conversation struct {
+	Peer      Addr
+	Last      HistoryMsg
+	Unread    uint32
+	ReadMsgID uint64 // the last message read by the client
+}
+
+// Decode Decode
+func (m *Conversation) Decode(r io.Reader) error {
+	var err error
+	if err = m.Peer.Decode(r); err != nil {
+		return err
+	}
+	if err = m.Last.Decode(r); err != nil {
+		return err
+	}
+	if m.Unread, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if m.ReadMsgID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *Conversation) Encode(w io.Writer) error {
+	var err error
+	if err = m.Peer.Encode(w); err != nil {
+		return err
+	}
+	if err = m.Last.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Unread); err != nil {
+		return err
+	}
+	return WriteUint64(w, m.ReadMsgID)
+}
+
+// MsgConversationsResp 会话列表应答，More 表示还有下一页
+type MsgConversationsResp struct {
+	Conversations []Conversation
+	More          bool
+}
+
+// Decode Decode
+func (m *MsgConversationsResp) Decode(r io.Reader) error {
+	count, err := ReadUint16(r)
+	if err != nil {
+		return err
+	}
+	m.Conversations = make([]Conversation, count)
+	for i := range m.Conversations {
+		if err = m.Conversations[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	var more uint8
+	if more, err = ReadUint8(r); err != nil {
+		return err
+	}
+	m.More = more == 1
+	return nil
+}
+
+// Encode Encode
+func (m *MsgConversationsResp) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint16(w, uint16(len(m.Conversations))); err != nil {
+		return err
+	}
+	for i := range m.Conversations {
+		if err = m.Conversations[i].Encode(w); err != nil {
+			return err
+		}
+	}
+	more := uint8(0)
+	if m.More {
+		more = 1
+	}
+	return WriteUint8(w, more)
+}
+
+// MsgMarkRead 会话已读，客户端发给服务器后，服务器转发给同一用户的其它设备
+type MsgMarkRead struct {
+	Peer Addr
+}
+
+// Decode Decode
+func (m *MsgMarkRead) Decode(r io.Reader) error {
+	return m.Peer.Decode(r)
+}
+
+// Encode Encode
+func (m *MsgMarkRead) Encode(w io.Writer) error {
+	return m.Peer.Encode(w)
+}
+
+// IsLegacy all peers and addresses of the last messages can be encoded in the fixed format
+func (m *MsgConversationsResp) IsLegacy() bool {
+	for i := range m.Conversations {
+		c := &m.Conversations[i]
+		if !c.Peer.IsLegacy() || !c.Last.Source.IsLegacy() || !c.Last.Dest.IsLegacy() {
+			return false
+		}
+	}
+	return true
+}
+
+// IsLegacy the peer can be encoded in the fixed format
+func (m *MsgMarkRead) IsLegacy() bool {
+	return m.Peer.IsLegacy()
+}
@@ -0,0 +1,43 @@
+package wire
+
+import "io"
+
+// MsgDrain 服务器即将下线，客户端应在 Deadline 之前重连到 URLs 中的其它服务器
+// Deadline is unix milliseconds, the connection is closed by the server after it.
+// URLs may be empty, then the client reconnects as usual.
+type MsgDrain struct {
+	URLs     []string
+	Deadline uint64
+}
+
+// Decode Decode
+func (m *MsgDrain) Decode(r io.Reader) error {
+	count, err := ReadUint16(r)
+	if err != nil {
+		return err
+	}
+	m.URLs = make([]string, count)
+	for i := range m.URLs {
+		if m.URLs[i], err = ReadString(r); err != nil {
+			return err
+		}
+	}
+	if m.Deadline, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgDrain) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint16(w, uint16(len(m.URLs))); err != nil {
+		return err
+	}
+	for _, u := range m.URLs {
+		if err = WriteString(w, u); err != nil {
+			return err
+		}
+	}
+	return WriteUint64(w, m.Deadline)
+}
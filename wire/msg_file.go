@@ -0,0 +1,134 @@
+package wire
+
+import (
+	"io"
+)
+
+// A file is sent as a MsgFileBegin, a sequence of MsgFileChunk and a MsgFileEnd,
+// all of them carry the same TransferID chosen by the sender. Chunks must be sent in order,
+// the sender may have at most the window size of chunks unacknowledged.
+
+// MsgFileBegin 开始传输一个文件
+type MsgFileBegin struct {
+	TransferID uint64
+	Name       string
+	Mime       string
+	Size       uint64 // total bytes of the file
+	Extra      string
+}
+
+// Decode Decode
+func (m *MsgFileBegin) Decode(r io.Reader) error {
+	var err error
+	if m.TransferID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Name, err = ReadString(r); err != nil {
+		return err
+	}
+	if m.Mime, err = ReadString(r); err != nil {
+		return err
+	}
+	if m.Size, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Extra, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgFileBegin) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.TransferID); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Name); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Mime); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.Size); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Extra); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MsgFileChunk 文件的一个分片
+type MsgFileChunk struct {
+	TransferID uint64
+	Index      uint32 // start from 0
+	Data       []byte
+}
+
+// Decode Decode
+func (m *MsgFileChunk) Decode(r io.Reader) error {
+	var err error
+	if m.TransferID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Index, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if m.Data, err = ReadBytes(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgFileChunk) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.TransferID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Index); err != nil {
+		return err
+	}
+	if err = WriteBytes(w, m.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MsgFileEnd 文件传输结束
+type MsgFileEnd struct {
+	TransferID uint64
+	Chunks     uint32 // number of chunks sent
+	Checksum   uint32 // crc32 (IEEE) of the whole file
+}
+
+// Decode Decode
+func (m *MsgFileEnd) Decode(r io.Reader) error {
+	var err error
+	if m.TransferID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Chunks, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if m.Checksum, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgFileEnd) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.TransferID); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Chunks); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Checksum); err != nil {
+		return err
+	}
+	return nil
+}
@@ -52,3 +52,13 @@ func (m *MsgGroupInOut) Encode(w io.Writer) error {
 	}
 	return nil
 }
+
+// IsLegacy all groups can be encoded in the fixed format
+func (m *MsgGroupInOut) IsLegacy() bool {
+	for i := range m.Groups {
+		if !m.Groups[i].IsLegacy() {
+			return false
+		}
+	}
+	return true
+}
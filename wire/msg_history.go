@@ -0,0 +1,207 @@
+package wire
+
+import "io"
+
+// MsgHistory 查询历史消息，Peer 是单聊的对方或者群
+// Cursors are message ids or unix milliseconds, 0 means no limit.
+// Messages are returned from the newest to the oldest,
+// or from the oldest to the newest if an after cursor is set without a before cursor.
+type MsgHistory struct {
+	Peer       Addr
+	BeforeID   uint64
+	AfterID    uint64
+	BeforeTime uint64
+	AfterTime  uint64
+	Limit      uint16
+}
+
+// Decode Decode
+func (m *MsgHistory) Decode(r io.Reader) error {
+	var err error
+	if err = m.Peer.Decode(r); err != nil {
+		return err
+	}
+	if m.BeforeID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.AfterID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.BeforeTime, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.AfterTime, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Limit, err = ReadUint16(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgHistory) Encode(w io.Writer) error {
+	var err error
+	if err = m.Peer.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.BeforeID); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.AfterID); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.BeforeTime); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.AfterTime); err != nil {
+		return err
+	}
+	if err = WriteUint16(w, m.Limit); err != nil {
+		return err
+	}
+	return nil
+}
+
+// HistoryMsg a message in history, ID is the cursor for next page
+type HistoryMsg struct {
+	ID       uint64
+	MsgID    uint64
+	Source   Addr
+	Dest     Addr
+	Type     uint8
+	Text     string
+	Extra    string
+	CreateAt uint64 // unix milliseconds
+	EditAt   uint64 // 0 if it is never edited
+	Recalled bool
+}
+
+// Decode Decode
+func (m *HistoryMsg) Decode(r io.Reader) error {
+	var err error
+	if m.ID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.MsgID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if err = m.Source.Decode(r); err != nil {
+		return err
+	}
+	if err = m.Dest.Decode(r); err != nil {
+		return err
+	}
+	if m.Type, err = ReadUint8(r); err != nil {
+		return err
+	}
+	if m.Text, err = ReadString(r); err != nil {
+		return err
+	}
+	if m.Extra, err = ReadString(r); err != nil {
+		return err
+	}
+	if m.CreateAt, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.EditAt, err = ReadUint64(r); err != nil {
+		return err
+	}
+	var recalled uint8
+	if recalled, err = ReadUint8(r); err != nil {
+		return err
+	}
+	m.Recalled = recalled == 1
+	return nil
+}
+
+// Encode Encode
+func (m *HistoryMsg) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.ID); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.MsgID); err != nil {
+		return err
+	}
+	if err = m.Source.Encode(w); err != nil {
+		return err
+	}
+	if err = m.Dest.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint8(w, m.Type); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Text); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Extra); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.CreateAt); err != nil {
+		return err
+	}
+	if err = WriteUint64(w, m.EditAt); err != nil {
+		return err
+	}
+	recalled := uint8(0)
+	if m.Recalled {
+		recalled = 1
+	}
+	return WriteUint8(w, recalled)
+}
+
+// MsgHistoryResp 历史消息应答，More 表示还有下一页
+type MsgHistoryResp struct {
+	Messages []HistoryMsg
+	More     bool
+}
+
+// Decode Decode
+func (m *MsgHistoryResp) Decode(r io.Reader) error {
+	count, err := ReadUint16(r)
+	if err != nil {
+		return err
+	}
+	m.Messages = make([]HistoryMsg, count)
+	for i := range m.Messages {
+		if err = m.Messages[i].Decode(r); err != nil {
+			return err
+		}
+	}
+	var more uint8
+	if more, err = ReadUint8(r); err != nil {
+		return err
+	}
+	m.More = more == 1
+	return nil
+}
+
+// Encode Encode
+func (m *MsgHistoryResp) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint16(w, uint16(len(m.Messages))); err != nil {
+		return err
+	}
+	for i := range m.Messages {
+		if err = m.Messages[i].Encode(w); err != nil {
+			return err
+		}
+	}
+	more := uint8(0)
+	if m.More {
+		more = 1
+	}
+	return WriteUint8(w, more)
+}
+
+// IsLegacy all addresses of the messages can be encoded in the fixed format
+func (m *MsgHistoryResp) IsLegacy() bool {
+	for i := range m.Messages {
+		if !m.Messages[i].Source.IsLegacy() || !m.Messages[i].Dest.IsLegacy() {
+			return false
+		}
+	}
+	return true
+}
@@ -12,13 +12,13 @@ type MsgLoc struct {
 // Decode Decode
 func (m *MsgLoc) Decode(r io.Reader) error {
 	var err error
-	if m.Target.Decode(r); err != nil {
+	if err = m.Target.Decode(r); err != nil {
 		return err
 	}
-	if m.Peer.Decode(r); err != nil {
+	if err = m.Peer.Decode(r); err != nil {
 		return err
 	}
-	if m.In.Decode(r); err != nil {
+	if err = m.In.Decode(r); err != nil {
 		return err
 	}
 	return nil
@@ -27,13 +27,13 @@ func (m *MsgLoc) Decode(r io.Reader) error {
 // Encode Encode
 func (m *MsgLoc) Encode(w io.Writer) error {
 	var err error
-	if m.Target.Encode(w); err != nil {
+	if err = m.Target.Encode(w); err != nil {
 		return err
 	}
-	if m.Peer.Encode(w); err != nil {
+	if err = m.Peer.Encode(w); err != nil {
 		return err
 	}
-	if m.In.Encode(w); err != nil {
+	if err = m.In.Encode(w); err != nil {
 		return err
 	}
 	return nil
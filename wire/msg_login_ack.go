@@ -4,10 +4,19 @@ import (
 	"io"
 )
 
-// MsgLoginAck 单聊消息应答
+// MsgLoginAck 登录应答，携带协议协商结果
 type MsgLoginAck struct {
 	RemoteAddr string
 	LoginAt    uint64
+	// the negotiated protocol version
+	Version uint16
+	// protocol versions supported by server
+	MinVersion uint16
+	MaxVersion uint16
+	// enabled features, see Feature*
+	Features uint32
+	// Maximum message size allowed from client
+	MaxMessageSize uint32
 }
 
 // Decode Decode
@@ -19,6 +28,21 @@ func (m *MsgLoginAck) Decode(r io.Reader) error {
 	if m.LoginAt, err = ReadUint64(r); err != nil {
 		return err
 	}
+	if m.Version, err = ReadUint16(r); err != nil {
+		return err
+	}
+	if m.MinVersion, err = ReadUint16(r); err != nil {
+		return err
+	}
+	if m.MaxVersion, err = ReadUint16(r); err != nil {
+		return err
+	}
+	if m.Features, err = ReadUint32(r); err != nil {
+		return err
+	}
+	if m.MaxMessageSize, err = ReadUint32(r); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -31,5 +55,20 @@ func (m *MsgLoginAck) Encode(w io.Writer) error {
 	if err = WriteUint64(w, m.LoginAt); err != nil {
 		return err
 	}
+	if err = WriteUint16(w, m.Version); err != nil {
+		return err
+	}
+	if err = WriteUint16(w, m.MinVersion); err != nil {
+		return err
+	}
+	if err = WriteUint16(w, m.MaxVersion); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Features); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.MaxMessageSize); err != nil {
+		return err
+	}
 	return nil
 }
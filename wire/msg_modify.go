@@ -0,0 +1,78 @@
+package wire
+
+import "io"
+
+// MsgChatAck 聊天消息应答，告诉发送者服务器分配的消息 ID
+type MsgChatAck struct {
+	MsgID uint64
+}
+
+// Decode Decode
+func (m *MsgChatAck) Decode(r io.Reader) error {
+	var err error
+	if m.MsgID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgChatAck) Encode(w io.Writer) error {
+	return WriteUint64(w, m.MsgID)
+}
+
+// MsgRecall 撤回一条消息，Dest 必须是原消息的 Dest
+type MsgRecall struct {
+	MsgID uint64
+}
+
+// Decode Decode
+func (m *MsgRecall) Decode(r io.Reader) error {
+	var err error
+	if m.MsgID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgRecall) Encode(w io.Writer) error {
+	return WriteUint64(w, m.MsgID)
+}
+
+// MsgEdit 修改一条消息，Dest 必须是原消息的 Dest
+type MsgEdit struct {
+	MsgID uint64
+	Text  string
+	Extra string
+}
+
+// Decode Decode
+func (m *MsgEdit) Decode(r io.Reader) error {
+	var err error
+	if m.MsgID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Text, err = ReadString(r); err != nil {
+		return err
+	}
+	if m.Extra, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgEdit) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.MsgID); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Text); err != nil {
+		return err
+	}
+	if err = WriteString(w, m.Extra); err != nil {
+		return err
+	}
+	return nil
+}
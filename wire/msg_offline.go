@@ -13,7 +13,7 @@ type MsgOffline struct {
 // Decode Decode
 func (m *MsgOffline) Decode(r io.Reader) error {
 	var err error
-	if m.Peer.Decode(r); err != nil {
+	if err = m.Peer.Decode(r); err != nil {
 		return err
 	}
 	if m.Notice, err = ReadUint8(r); err != nil {
@@ -37,7 +37,7 @@ func (m *MsgOffline) Decode(r io.Reader) error {
 // Encode Encode
 func (m *MsgOffline) Encode(w io.Writer) error {
 	var err error
-	if m.Peer.Encode(w); err != nil {
+	if err = m.Peer.Encode(w); err != nil {
 		return err
 	}
 	if err = WriteUint8(w, m.Notice); err != nil {
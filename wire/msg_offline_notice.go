@@ -10,7 +10,7 @@ type MsgOfflineNotice struct {
 // Decode Decode
 func (m *MsgOfflineNotice) Decode(r io.Reader) error {
 	var err error
-	if m.Peer.Decode(r); err != nil {
+	if err = m.Peer.Decode(r); err != nil {
 		return err
 	}
 	return nil
@@ -19,8 +19,13 @@ func (m *MsgOfflineNotice) Decode(r io.Reader) error {
 // Encode Encode
 func (m *MsgOfflineNotice) Encode(w io.Writer) error {
 	var err error
-	if m.Peer.Encode(w); err != nil {
+	if err = m.Peer.Encode(w); err != nil {
 		return err
 	}
 	return nil
 }
+
+// IsLegacy the peer can be encoded in the fixed format
+func (m *MsgOfflineNotice) IsLegacy() bool {
+	return m.Peer.IsLegacy()
+}
@@ -12,7 +12,7 @@ type MsgQueryClient struct {
 // Decode Decode
 func (m *MsgQueryClient) Decode(r io.Reader) error {
 	var err error
-	if m.Peer.Decode(r); err != nil {
+	if err = m.Peer.Decode(r); err != nil {
 		return err
 	}
 	return nil
@@ -21,7 +21,7 @@ func (m *MsgQueryClient) Decode(r io.Reader) error {
 // Encode Encode
 func (m *MsgQueryClient) Encode(w io.Writer) error {
 	var err error
-	if m.Peer.Encode(w); err != nil {
+	if err = m.Peer.Encode(w); err != nil {
 		return err
 	}
 	return nil
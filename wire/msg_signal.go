@@ -0,0 +1,50 @@
+package wire
+
+import "io"
+
+const (
+	// SignalTyping the peer is typing
+	SignalTyping = uint8(1)
+	// SignalRecording the peer is recording a voice
+	SignalRecording = uint8(2)
+	// SignalViewing the peer is viewing the conversation
+	SignalViewing = uint8(3)
+)
+
+const (
+	// SignalStop the action stopped
+	SignalStop = uint8(0)
+	// SignalStart the action started
+	SignalStart = uint8(1)
+)
+
+// MsgSignal 临时信号，例如"正在输入"。
+// 信号是 ephemeral 消息：不落盘，不应答，不做离线保存，拥塞时最先被丢弃
+type MsgSignal struct {
+	Kind  uint8
+	State uint8
+}
+
+// Decode Decode
+func (m *MsgSignal) Decode(r io.Reader) error {
+	var err error
+	if m.Kind, err = ReadUint8(r); err != nil {
+		return err
+	}
+	if m.State, err = ReadUint8(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgSignal) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint8(w, m.Kind); err != nil {
+		return err
+	}
+	if err = WriteUint8(w, m.State); err != nil {
+		return err
+	}
+	return nil
+}
@@ -14,4 +14,20 @@ const (
 
 	// MsgStatusDestNoFound the Dest in header is empty
 	MsgStatusDestNoFound = uint8(103)
+
+	// MsgStatusBusy too many chunks of a transfer are unacknowledged, send it later
+	MsgStatusBusy = uint8(104)
+	// MsgStatusTransferInvaild the transfer is unknown or not to a client, or the chunk is out of the window or sent twice
+	MsgStatusTransferInvaild = uint8(105)
+	// MsgStatusChecksumMismatch the received file doesn't match the checksum
+	MsgStatusChecksumMismatch = uint8(106)
+
+	// MsgStatusExpired the message can't be recalled or edited any more
+	MsgStatusExpired = uint8(107)
+	// MsgStatusMessageNoFound the message to recall or edit no found
+	MsgStatusMessageNoFound = uint8(108)
+	// MsgStatusForbidden only the sender can recall or edit the message
+	MsgStatusForbidden = uint8(109)
+	// MsgStatusAddrUnsupported the dest client speaks a protocol version which can't decode an address of the message
+	MsgStatusAddrUnsupported = uint8(110)
 )
@@ -0,0 +1,121 @@
+package wire
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrTooManyCommands commands of a tap are more than 255
+var ErrTooManyCommands = errors.New("too many commands")
+
+// MsgTap 在接收的服务器上监听符合条件的消息，匹配的消息以 MsgTapEvent 发回。
+// A tap is identified by the sending server and ID, it is removed by Stop,
+// or expires if it isn't sent again in a while. Empty fields match any message.
+// It is only sent to servers which report FeatureMessageTap.
+type MsgTap struct {
+	ID       uint64
+	Stop     bool
+	Source   Addr
+	Dest     Addr
+	Domain   uint32  // domain of source or dest
+	Commands []uint8 // 255 at most
+	Rate     uint32  // events per second sent back at most
+}
+
+// Decode Decode
+func (m *MsgTap) Decode(r io.Reader) error {
+	var err error
+	if m.ID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	stop, err := ReadUint8(r)
+	if err != nil {
+		return err
+	}
+	m.Stop = stop == 1
+	if err = m.Source.Decode(r); err != nil {
+		return err
+	}
+	if err = m.Dest.Decode(r); err != nil {
+		return err
+	}
+	if m.Domain, err = ReadUint32(r); err != nil {
+		return err
+	}
+	count, err := ReadUint8(r)
+	if err != nil {
+		return err
+	}
+	m.Commands = make([]uint8, count)
+	if _, err = io.ReadFull(r, m.Commands); err != nil {
+		return err
+	}
+	if m.Rate, err = ReadUint32(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgTap) Encode(w io.Writer) error {
+	var err error
+	if err = WriteUint64(w, m.ID); err != nil {
+		return err
+	}
+	stop := uint8(0)
+	if m.Stop {
+		stop = 1
+	}
+	if err = WriteUint8(w, stop); err != nil {
+		return err
+	}
+	if err = m.Source.Encode(w); err != nil {
+		return err
+	}
+	if err = m.Dest.Encode(w); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Domain); err != nil {
+		return err
+	}
+	if len(m.Commands) > math.MaxUint8 {
+		return ErrTooManyCommands
+	}
+	if err = WriteUint8(w, uint8(len(m.Commands))); err != nil {
+		return err
+	}
+	if _, err = w.Write(m.Commands); err != nil {
+		return err
+	}
+	if err = WriteUint32(w, m.Rate); err != nil {
+		return err
+	}
+	return nil
+}
+
+// MsgTapEvent 一条匹配 MsgTap 的消息，Event 为 json
+type MsgTapEvent struct {
+	ID    uint64
+	Event string
+}
+
+// Decode Decode
+func (m *MsgTapEvent) Decode(r io.Reader) error {
+	var err error
+	if m.ID, err = ReadUint64(r); err != nil {
+		return err
+	}
+	if m.Event, err = ReadString(r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Encode Encode
+func (m *MsgTapEvent) Encode(w io.Writer) error {
+	if err := WriteUint64(w, m.ID); err != nil {
+		return err
+	}
+	return WriteString(w, m.Event)
+}
@@ -1,10 +0,0 @@
-package wire
-
-import (
-	"fmt"
-	"testing"
-)
-
-func TestGetOutboundIP(t *testing.T) {
-	fmt.Println(GetOutboundIP().String())
-}
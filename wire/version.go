@@ -0,0 +1,68 @@
+package wire
+
+import "fmt"
+
+const (
+	// ProtocolVersion1 the original wire format, assumed when a client does not declare a version
+	ProtocolVersion1 = uint16(1)
+	// ProtocolVersion2 addresses longer than 26 bytes are encoded in the long format
+	ProtocolVersion2 = uint16(2)
+	// ProtocolVersion3 Msgchat carries the MsgID, a chat message is acknowledged with MsgChatAck
+	ProtocolVersion3 = uint16(3)
+	// ProtocolVersion4 the server pushes MsgMarkRead to sync the read state between devices of a client
+	ProtocolVersion4 = uint16(4)
+	// ProtocolVersion5 the server sends MsgDrain before closing the connection on draining
+	ProtocolVersion5 = uint16(5)
+
+	// ProtocolVersionMin oldest protocol version the server still speaks
+	ProtocolVersionMin = ProtocolVersion1
+	// ProtocolVersionMax newest protocol version the server speaks
+	ProtocolVersionMax = ProtocolVersion5
+)
+
+// Feature bits reported to the client in MsgLoginAck
+const (
+	// FeatureCompression websocket per-message compression is enabled
+	FeatureCompression = uint32(1 << 0)
+	// FeatureReliable messages are acknowledged and stored for redelivery
+	FeatureReliable = uint32(1 << 1)
+	// FeatureCodecBinary messages are encoded with the binary codec of this package
+	FeatureCodecBinary = uint32(1 << 2)
+	// FeatureCodecJSON messages may be encoded as json
+	FeatureCodecJSON = uint32(1 << 3)
+	// FeatureFileTransfer binary messages and chunked file transfer are supported
+	FeatureFileTransfer = uint32(1 << 4)
+	// FeatureTraceContext headers may carry a trace context, servers report it to each other on connecting
+	FeatureTraceContext = uint32(1 << 5)
+	// FeatureMessageTap the server accepts MsgTap from other servers
+	FeatureMessageTap = uint32(1 << 6)
+)
+
+// Websocket close codes sent by the server, in the private range 4000-4999
+const (
+	// CloseUnsupportedVersion the protocol version declared by the client is not supported
+	CloseUnsupportedVersion = 4001
+)
+
+// NegotiateVersion returns the protocol version to speak with a client declaring version,
+// 0 means a legacy client which didn't declare any version.
+func NegotiateVersion(version uint16) (uint16, error) {
+	if version == 0 {
+		return ProtocolVersion1, nil
+	}
+	if version < ProtocolVersionMin || version > ProtocolVersionMax {
+		return 0, fmt.Errorf("unsupported protocol version %d, server supports %d-%d", version, ProtocolVersionMin, ProtocolVersionMax)
+	}
+	return version, nil
+}
+
+// CommandVersion the protocol version a client must speak to be pushed the command by the server
+func CommandVersion(command uint8) uint16 {
+	switch command {
+	case MsgTypeMarkRead:
+		return ProtocolVersion4
+	case MsgTypeDrain:
+		return ProtocolVersion5
+	}
+	return ProtocolVersion1
+}
@@ -0,0 +1,94 @@
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version uint16
+		want    uint16
+		wantErr bool
+	}{
+		{"legacy", 0, ProtocolVersion1, false},
+		{"max", ProtocolVersionMax, ProtocolVersionMax, false},
+		{"too new", ProtocolVersionMax + 1, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NegotiateVersion(tt.version)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NegotiateVersion() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("NegotiateVersion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMsgLoginAck_Encode(t *testing.T) {
+	ack := &MsgLoginAck{
+		RemoteAddr:     "127.0.0.1:5000",
+		LoginAt:        1571500000000,
+		Version:        ProtocolVersionMax,
+		MinVersion:     ProtocolVersionMin,
+		MaxVersion:     ProtocolVersionMax,
+		Features:       FeatureCodecBinary | FeatureCompression,
+		MaxMessageSize: 2048,
+	}
+	buf := &bytes.Buffer{}
+	if err := ack.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	got := new(MsgLoginAck)
+	if err := got.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, ack) {
+		t.Errorf("MsgLoginAck.Decode() = %v, want %v", got, ack)
+	}
+}
+
+func TestMessage_IsLegacy(t *testing.T) {
+	short, _ := NewAddr(AddrClient, 1, DevicePc, "alice")
+	long, _ := NewAddr(AddrClient, 1, DevicePc, strings.Repeat("a", 40))
+	tests := []struct {
+		name   string
+		source *Addr
+		body   Protocol
+		want   bool
+	}{
+		{"short", short, &Msgchat{Text: "hi"}, true},
+		{"long source", long, &Msgchat{Text: "hi"}, false},
+		{"long in body", short, &MsgOfflineNotice{Peer: *long}, false},
+		{"long in conversations", short, &MsgConversationsResp{Conversations: []Conversation{{Peer: *short}, {Peer: *short, Last: HistoryMsg{Source: *long}}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := MakeEmptyHeaderMessage(MsgTypeChat, tt.body)
+			m.Header.Source = *tt.source
+			m.Header.Dest = *short
+			if got := m.IsLegacy(); got != tt.want {
+				t.Errorf("Message.IsLegacy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandVersion(t *testing.T) {
+	if got := CommandVersion(MsgTypeChat); got != ProtocolVersion1 {
+		t.Errorf("CommandVersion(chat) = %v, want %v", got, ProtocolVersion1)
+	}
+	if got := CommandVersion(MsgTypeMarkRead); got != ProtocolVersion4 {
+		t.Errorf("CommandVersion(markread) = %v, want %v", got, ProtocolVersion4)
+	}
+	if got := CommandVersion(MsgTypeDrain); got != ProtocolVersion5 {
+		t.Errorf("CommandVersion(drain) = %v, want %v", got, ProtocolVersion5)
+	}
+}